@@ -0,0 +1,17 @@
+-- Run history of time trial routes, which replaces playerTimeTrials.
+-- Records from playerTimeTrials are copied in with -migrate-time-trials, which
+-- leaves the legacy table in place and can be run again safely.
+CREATE TABLE IF NOT EXISTS playerTimeTrialRuns (
+	id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+	uuid VARCHAR(16) NOT NULL,
+	game VARCHAR(16) NOT NULL,
+	routeId VARCHAR(32) NOT NULL,
+	mapId INT NOT NULL,
+	seconds INT NOT NULL,
+	splits TEXT NOT NULL,
+	personalBest TINYINT(1) NOT NULL DEFAULT 0,
+	timestampCompleted DATETIME NOT NULL,
+	PRIMARY KEY (id),
+	KEY playerRoute (uuid, game, routeId, mapId),
+	KEY routeRecords (game, routeId, mapId, seconds)
+);
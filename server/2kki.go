@@ -1,32 +1,381 @@
 package server
 
-import "strings"
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
 
-func isValid2kkiSprite(name string, room int) bool {
-	if (allowed2kkiSprites[name] ||
-		(strings.Contains(name, "syujinkou") ||
-			strings.Contains(name, "effect") ||
-			strings.Contains(name, "yukihitsuji_game") ||
-			strings.Contains(name, "zenmaigaharaten_kisekae") ||
-			strings.Contains(name, "主人公"))) &&
-		!(strings.Contains(name, "zenmaigaharaten_kisekae") && room != 176) {
-		return true
+const (
+	yume2kkiDebugSwitchId = 11
+
+	// yume2kkiImportMaxDepth is the deepest depth sampled when importing
+	// locations from Yume 2kki Explorer
+	yume2kkiImportMaxDepth = 40
+	// yume2kkiImportMissLimit is how many samples in a row may find no new
+	// locations before moving to the next depth
+	yume2kkiImportMissLimit = 20
+	// yume2kkiImportRequestDelay is the pause between requests to Yume 2kki
+	// Explorer when importing locations, to avoid flooding it
+	yume2kkiImportRequestDelay = 500 * time.Millisecond
+)
+
+// yume2kkiPlugin keeps its sprite whitelist in the config and its time trials
+// in data files
+type yume2kkiPlugin struct {
+	defaultGamePlugin
+}
+
+func (p *yume2kkiPlugin) JoinRoom(c *RoomClient) {
+	if c.sClient.rank == 0 {
+		c.send <- buildMsg("ss", yume2kkiDebugSwitchId, 2)
+	}
+}
+
+func (p *yume2kkiPlugin) SyncSwitch(c *RoomClient, switchId int, value bool) (bool, error) {
+	if c.sClient.rank == 0 && switchId == yume2kkiDebugSwitchId && value {
+		c.sClient.disconnect()
 	}
 
+	return false, nil
+}
+
+func (p *yume2kkiPlugin) GetApiRoutes() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"/api/2kki": handle2kkiApi,
+	}
+}
+
+func (p *yume2kkiPlugin) HasEventLocationSource() bool {
 	return true
 }
 
-var allowed2kkiSprites = map[string]bool{
-	"#null":                   true,
-	"kodomo_04-1":             true,
-	"Kong_Urotsuki_CharsetFC": true,
-	"kura CharSet01":          true,
-	"kuro9-8":                 true,
-	"natl_char_uro":           true,
-	"nuls_sujinkou":           true,
-	"RioCharset16":            true,
-	"urotsuki_sniper":         true,
-	"urotsuki_Swimsuit01":     true,
-	"urotsuki_Swimsuit02":     true,
-	"urotsuki_taoru":          true,
+// GetEventLocations picks locations from the imported location graph so that
+// expeditions don't depend on Yume 2kki Explorer being online, only querying
+// it when no imported locations fit the depth range
+func (p *yume2kkiPlugin) GetEventLocations(r *rand.Rand, minDepth int, maxDepth int) ([]*EventLocationData, error) {
+	return get2kkiEventLocations(r, minDepth, maxDepth)
+}
+
+// ImportLocations builds locations from Yume 2kki Explorer by sampling random
+// locations at each depth for their depths, colors and maps, as its API has no
+// endpoint listing every location, then adds the map location names cached
+// from players' queries; requests are spaced out to go easy on Explorer
+func (p *yume2kkiPlugin) ImportLocations() ([]*Location, error) {
+	var locations []*Location
+	titleLocations := make(map[string]*Location)
+
+	addLocation := func(location *Location) (added bool) {
+		existingLocation, ok := titleLocations[location.Title]
+		if !ok {
+			titleLocations[location.Title] = location
+			locations = append(locations, location)
+			return true
+		}
+
+		existingLocation.MapIds = mergeLocationLists(existingLocation.MapIds, location.MapIds)
+		return false
+	}
+
+	var requested bool
+	for depth := 0; depth <= yume2kkiImportMaxDepth; depth++ {
+		var misses int
+
+		// sampling stops once enough requests in a row find no new locations
+		for misses < yume2kkiImportMissLimit {
+			if requested {
+				time.Sleep(yume2kkiImportRequestDelay)
+			}
+			requested = true
+
+			eventLocations, err := query2kkiRandomLocations(depth, depth)
+			if err != nil {
+				return nil, err
+			}
+			if len(eventLocations) == 0 {
+				break
+			}
+
+			var found bool
+			for _, eventLocation := range eventLocations {
+				if addLocation(&Location{
+					Title:    eventLocation.Title,
+					TitleJP:  eventLocation.TitleJP,
+					Depth:    eventLocation.Depth,
+					MinDepth: eventLocation.MinDepth,
+					FgColor:  eventLocation.FgColor,
+					BgColor:  eventLocation.BgColor,
+					MapIds:   mergeLocationLists(nil, eventLocation.MapIds),
+				}) {
+					found = true
+				}
+			}
+
+			if found {
+				misses = 0
+			} else {
+				misses++
+			}
+		}
+	}
+
+	results, err := db.Query("SELECT query, response FROM 2kkiApiQueries WHERE action = 'getMapLocationNames'")
+	if err != nil {
+		return nil, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		var queryString, response string
+
+		err := results.Scan(&queryString, &response)
+		if err != nil {
+			return nil, err
+		}
+
+		query, err := url.ParseQuery(queryString)
+		if err != nil {
+			continue
+		}
+
+		mapId, err := strconv.Atoi(query.Get("mapId"))
+		if err != nil {
+			continue
+		}
+
+		// location names are either plain titles or objects with titles
+		var locationNames []json.RawMessage
+		err = json.Unmarshal([]byte(response), &locationNames)
+		if err != nil {
+			continue
+		}
+
+		for _, locationName := range locationNames {
+			var title, titleJP string
+
+			if err := json.Unmarshal(locationName, &title); err != nil {
+				var locationNameData struct {
+					Title   string `json:"title"`
+					TitleJP string `json:"titleJP"`
+				}
+				if err := json.Unmarshal(locationName, &locationNameData); err != nil {
+					continue
+				}
+				title, titleJP = locationNameData.Title, locationNameData.TitleJP
+			}
+			if title == "" {
+				continue
+			}
+
+			addLocation(&Location{Title: title, TitleJP: titleJP, MapIds: []string{fmt.Sprintf("%04d", mapId)}})
+		}
+	}
+
+	return locations, nil
+}
+
+func handle2kkiApi(w http.ResponseWriter, r *http.Request) {
+	actionParam := r.URL.Query().Get("action")
+	if actionParam == "" {
+		handleError(w, r, "action not specified")
+		return
+	}
+
+	query := r.URL.Query()
+	query.Del("action")
+
+	queryString := query.Encode()
+
+	var response string
+	var expired bool
+
+	err := db.QueryRow("SELECT response, CURRENT_TIMESTAMP() >= timestampExpired FROM 2kkiApiQueries WHERE action = ? AND query = ?", actionParam, queryString).Scan(&response, &expired)
+	if err != nil && err != sql.ErrNoRows {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	if err == nil && !expired {
+		w.Write([]byte(response))
+		return
+	}
+
+	body, err := query2kkiApi(actionParam, queryString)
+	if err != nil {
+		// serve the expired response while Yume 2kki Explorer can't be reached
+		if response != "" {
+			w.Write([]byte(response))
+			return
+		}
+
+		handleInternalError(w, r, err)
+		return
+	}
+
+	if strings.HasPrefix(string(body), "{\"error\"") || strings.HasPrefix(string(body), "<!DOCTYPE html>") {
+		writeErrLog(getIp(r), r.URL.Path, "received error response from Yume 2kki Explorer API: "+string(body))
+
+		if response != "" {
+			w.Write([]byte(response))
+			return
+		}
+	} else {
+		var interval string
+		// Shorter expiration for map queries returning unknown location in case of new maps that haven't yet been added to the wiki
+		if actionParam == "getMapLocationNames" && string(body) == "[]" {
+			interval = "1 HOUR"
+		} else {
+			interval = "7 DAY"
+		}
+		_, err = db.Exec("INSERT INTO 2kkiApiQueries (action, query, response, timestampExpired) VALUES (?, ?, ?, DATE_ADD(CURRENT_TIMESTAMP(), INTERVAL "+interval+")) ON DUPLICATE KEY UPDATE response = ?, timestampExpired = DATE_ADD(CURRENT_TIMESTAMP(), INTERVAL "+interval+")", actionParam, queryString, string(body), string(body))
+		if err != nil {
+			writeErrLog(getIp(r), r.URL.Path, err.Error())
+		}
+	}
+
+	w.Write(body)
+}
+
+// query2kkiApi sends a query to the Yume 2kki Explorer API
+func query2kkiApi(action string, queryString string) ([]byte, error) {
+	url := "https://2kki.app/" + action
+	if queryString != "" {
+		url += "?" + queryString
+	}
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
+
+// query2kkiRandomLocations gets random locations within a depth range from
+// Yume 2kki Explorer, returning none if there are no locations in the range
+func query2kkiRandomLocations(minDepth int, maxDepth int) ([]*EventLocationData, error) {
+	query := url.Values{}
+	query.Set("ignoreSecret", "1")
+	query.Set("minDepth", strconv.Itoa(minDepth))
+	if maxDepth >= minDepth {
+		query.Set("maxDepth", strconv.Itoa(maxDepth))
+	}
+
+	body, err := query2kkiApi("getRandomLocations", query.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(string(body), "{\"error\"") {
+		return nil, nil
+	}
+
+	var eventLocations []*EventLocationData
+	err = json.Unmarshal(body, &eventLocations)
+	if err != nil {
+		return nil, err
+	}
+
+	return eventLocations, nil
+}
+
+// get2kkiEventLocations picks a random location within a depth range from the
+// imported location graph with its depth adjusted to the scale used by other
+// games, falling back to Yume 2kki Explorer if there are no imported locations
+// in the range
+func get2kkiEventLocations(r *rand.Rand, minDepth int, maxDepth int) ([]*EventLocationData, error) {
+	var locations []*Location
+	if graph, ok := gameLocationGraphs["2kki"]; ok {
+		for _, location := range graph.locations {
+			if len(location.MapIds) == 0 || location.Depth < minDepth || (maxDepth >= minDepth && location.Depth > maxDepth) {
+				continue
+			}
+			locations = append(locations, location)
+		}
+	}
+
+	if len(locations) == 0 {
+		return query2kkiEventLocations(r, minDepth, maxDepth)
+	}
+
+	location := locations[r.Intn(len(locations))]
+
+	return []*EventLocationData{get2kkiEventLocationData(&EventLocationData{
+		Title:    location.Title,
+		TitleJP:  location.TitleJP,
+		Depth:    location.Depth,
+		MinDepth: location.MinDepth,
+		FgColor:  location.FgColor,
+		BgColor:  location.BgColor,
+		MapIds:   location.MapIds,
+	})}, nil
+}
+
+// query2kkiEventLocations picks a random location within a depth range from
+// Yume 2kki Explorer for when no imported locations are available
+func query2kkiEventLocations(r *rand.Rand, minDepth int, maxDepth int) ([]*EventLocationData, error) {
+	eventLocations, err := query2kkiRandomLocations(minDepth, maxDepth)
+	if err != nil {
+		return nil, err
+	}
+
+	var validEventLocations []*EventLocationData
+	for _, eventLocation := range eventLocations {
+		if len(eventLocation.MapIds) != 0 {
+			validEventLocations = append(validEventLocations, eventLocation)
+		}
+	}
+
+	if len(validEventLocations) == 0 {
+		return nil, fmt.Errorf("no 2kki locations between depth %d and %d", minDepth, maxDepth)
+	}
+
+	eventLocation := validEventLocations[r.Intn(len(validEventLocations))]
+
+	return []*EventLocationData{get2kkiEventLocationData(eventLocation)}, nil
+}
+
+// get2kkiEventLocationData copies a location with its depths adjusted to the
+// scale used by other games
+func get2kkiEventLocationData(location *EventLocationData) *EventLocationData {
+	eventLocation := &EventLocationData{
+		Title:   location.Title,
+		TitleJP: location.TitleJP,
+		Depth:   adjust2kkiDepth(location.Depth),
+		FgColor: location.FgColor,
+		BgColor: location.BgColor,
+		MapIds:  location.MapIds,
+	}
+
+	if location.MinDepth == 0 || location.MinDepth == location.Depth {
+		eventLocation.MinDepth = eventLocation.Depth
+	} else {
+		eventLocation.MinDepth = adjust2kkiDepth(location.MinDepth)
+	}
+
+	return eventLocation
+}
+
+// adjust2kkiDepth scales a Yume 2kki Explorer depth to the scale used by
+// other games
+func adjust2kkiDepth(depth int) int {
+	adjustedDepth := (depth / 3) * 2
+	if depth%3 == 2 {
+		adjustedDepth++
+	}
+	if adjustedDepth > 10 {
+		adjustedDepth = 10
+	}
+
+	return adjustedDepth
 }
@@ -19,16 +19,101 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"net/url"
 )
 
-func adminGetPlayers(w http.ResponseWriter, r *http.Request) {
-	_, _, rank, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
-	if rank == 0 {
-		handleError(w, r, "access denied")
-		return
+var (
+	errAdminTargetNotSpecified = errors.New("uuid, user or msgId not specified")
+	errAdminTargetNotFound     = errors.New("target player not found")
+	errAdminTargetInvalidMsgId = errors.New("invalid msgId")
+)
+
+// lookups used to resolve the target of an admin command, which tests replace
+// to avoid the database
+var (
+	adminTargetPlayerExists  = playerExists
+	adminTargetUuidFromName  = getUuidFromName
+	adminTargetUuidFromMsgId = getUuidFromMsgId
+)
+
+// actions taken by admin commands on their target, which tests replace to
+// check the target each command acts on
+var (
+	adminBanPlayer            = tryBanPlayer
+	adminMutePlayer           = tryMutePlayer
+	adminUnbanPlayer          = tryUnbanPlayer
+	adminUnmutePlayer         = tryUnmutePlayer
+	adminChangePlayerUsername = tryChangePlayerUsername
+	adminUnlockPlayerBadge    = unlockPlayerBadge
+	adminRemovePlayerBadge    = removePlayerBadge
+	adminResetPlayerPassword  = handleResetPw
+)
+
+// resolveAdminTarget gets the player an admin command acts on from its uuid,
+// user or msgId param, where msgId is a chat message sent by the player
+func resolveAdminTarget(query url.Values) (uuid string, err error) {
+	if uuid = query.Get("uuid"); uuid != "" {
+		exists, err := adminTargetPlayerExists(uuid)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return "", errAdminTargetNotFound
+		}
+
+		return uuid, nil
+	}
+
+	if user := query.Get("user"); user != "" {
+		uuid, err = adminTargetUuidFromName(user)
+		if err != nil {
+			return "", err
+		}
+		if uuid == "" {
+			return "", errAdminTargetNotFound
+		}
+
+		return uuid, nil
+	}
+
+	if msgId := query.Get("msgId"); msgId != "" {
+		if len(msgId) != 12 {
+			return "", errAdminTargetInvalidMsgId
+		}
+
+		uuid, err = adminTargetUuidFromMsgId(msgId)
+		if err != nil {
+			return "", err
+		}
+		if uuid == "" {
+			return "", errAdminTargetNotFound
+		}
+
+		return uuid, nil
 	}
 
+	return "", errAdminTargetNotSpecified
+}
+
+// getAdminTarget resolves the target of an admin command, writing the error
+// response if it can't be resolved
+func getAdminTarget(w http.ResponseWriter, r *http.Request) (uuid string, ok bool) {
+	uuid, err := resolveAdminTarget(r.URL.Query())
+	if err != nil {
+		if err == errAdminTargetNotSpecified || err == errAdminTargetNotFound || err == errAdminTargetInvalidMsgId {
+			handleError(w, r, err.Error())
+		} else {
+			handleInternalError(w, r, err)
+		}
+		return "", false
+	}
+
+	return uuid, true
+}
+
+func adminGetPlayers(w http.ResponseWriter, r *http.Request) {
 	var response []PlayerInfo
 	for _, client := range clients.Get() {
 		player := PlayerInfo{
@@ -49,12 +134,6 @@ func adminGetPlayers(w http.ResponseWriter, r *http.Request) {
 }
 
 func adminGetBans(w http.ResponseWriter, r *http.Request) {
-	_, _, rank, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
-	if rank == 0 {
-		handleError(w, r, "access denied")
-		return
-	}
-
 	responseJson, err := json.Marshal(getModeratedPlayers(0))
 	if err != nil {
 		handleError(w, r, "error while marshaling")
@@ -64,12 +143,6 @@ func adminGetBans(w http.ResponseWriter, r *http.Request) {
 }
 
 func adminGetMutes(w http.ResponseWriter, r *http.Request) {
-	_, _, rank, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
-	if rank == 0 {
-		handleError(w, r, "access denied")
-		return
-	}
-
 	responseJson, err := json.Marshal(getModeratedPlayers(1))
 	if err != nil {
 		handleError(w, r, "error while marshaling")
@@ -79,31 +152,20 @@ func adminGetMutes(w http.ResponseWriter, r *http.Request) {
 }
 
 func adminBan(w http.ResponseWriter, r *http.Request) {
-	uuid, _, rank, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
-	if rank == 0 {
-		handleError(w, r, "access denied")
+	uuid := getAdminActor(r).Uuid
+
+	uuidParam, ok := getAdminTarget(w, r)
+	if !ok {
 		return
 	}
 
-	uuidParam := r.URL.Query().Get("uuid")
-	if uuidParam == "" {
-		userParam := r.URL.Query().Get("user")
-		if userParam == "" {
-			handleError(w, r, "uuid or user not specified")
-			return
-		}
-		uuidParam, err := getUuidFromName(userParam)
-		if err != nil {
-			handleInternalError(w, r, err)
-			return
-		}
-		if uuidParam == "" {
-			handleError(w, r, "invalid user specified")
-			return
-		}
+	reason, duration, err := getModerationParams(r)
+	if err != nil {
+		handleError(w, r, err.Error())
+		return
 	}
 
-	err := tryBanPlayer(uuid, uuidParam)
+	err = adminBanPlayer(uuid, uuidParam, reason, duration)
 	if err != nil {
 		handleInternalError(w, r, err)
 		return
@@ -113,31 +175,20 @@ func adminBan(w http.ResponseWriter, r *http.Request) {
 }
 
 func adminMute(w http.ResponseWriter, r *http.Request) {
-	uuid, _, rank, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
-	if rank == 0 {
-		handleError(w, r, "access denied")
+	uuid := getAdminActor(r).Uuid
+
+	uuidParam, ok := getAdminTarget(w, r)
+	if !ok {
 		return
 	}
 
-	uuidParam := r.URL.Query().Get("uuid")
-	if uuidParam == "" {
-		userParam := r.URL.Query().Get("user")
-		if userParam == "" {
-			handleError(w, r, "uuid or user not specified")
-			return
-		}
-		uuidParam, err := getUuidFromName(userParam)
-		if err != nil {
-			handleInternalError(w, r, err)
-			return
-		}
-		if uuidParam == "" {
-			handleError(w, r, "invalid user specified")
-			return
-		}
+	reason, duration, err := getModerationParams(r)
+	if err != nil {
+		handleError(w, r, err.Error())
+		return
 	}
 
-	err := tryMutePlayer(uuid, uuidParam)
+	err = adminMutePlayer(uuid, uuidParam, reason, duration)
 	if err != nil {
 		handleInternalError(w, r, err)
 		return
@@ -147,31 +198,20 @@ func adminMute(w http.ResponseWriter, r *http.Request) {
 }
 
 func adminUnban(w http.ResponseWriter, r *http.Request) {
-	uuid, _, rank, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
-	if rank == 0 {
-		handleError(w, r, "access denied")
+	uuid := getAdminActor(r).Uuid
+
+	uuidParam, ok := getAdminTarget(w, r)
+	if !ok {
 		return
 	}
 
-	uuidParam := r.URL.Query().Get("uuid")
-	if uuidParam == "" {
-		userParam := r.URL.Query().Get("user")
-		if userParam == "" {
-			handleError(w, r, "uuid or user not specified")
-			return
-		}
-		uuidParam, err := getUuidFromName(userParam)
-		if err != nil {
-			handleInternalError(w, r, err)
-			return
-		}
-		if uuidParam == "" {
-			handleError(w, r, "invalid user specified")
-			return
-		}
+	reason, _, err := getModerationParams(r)
+	if err != nil {
+		handleError(w, r, err.Error())
+		return
 	}
 
-	err := tryUnbanPlayer(uuid, uuidParam)
+	err = adminUnbanPlayer(uuid, uuidParam, reason)
 	if err != nil {
 		handleInternalError(w, r, err)
 		return
@@ -181,31 +221,20 @@ func adminUnban(w http.ResponseWriter, r *http.Request) {
 }
 
 func adminUnmute(w http.ResponseWriter, r *http.Request) {
-	uuid, _, rank, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
-	if rank == 0 {
-		handleError(w, r, "access denied")
+	uuid := getAdminActor(r).Uuid
+
+	uuidParam, ok := getAdminTarget(w, r)
+	if !ok {
 		return
 	}
 
-	uuidParam := r.URL.Query().Get("uuid")
-	if uuidParam == "" {
-		userParam := r.URL.Query().Get("user")
-		if userParam == "" {
-			handleError(w, r, "uuid or user not specified")
-			return
-		}
-		uuidParam, err := getUuidFromName(userParam)
-		if err != nil {
-			handleInternalError(w, r, err)
-			return
-		}
-		if uuidParam == "" {
-			handleError(w, r, "invalid user specified")
-			return
-		}
+	reason, _, err := getModerationParams(r)
+	if err != nil {
+		handleError(w, r, err.Error())
+		return
 	}
 
-	err := tryUnmutePlayer(uuid, uuidParam)
+	err = adminUnmutePlayer(uuid, uuidParam, reason)
 	if err != nil {
 		handleInternalError(w, r, err)
 		return
@@ -215,35 +244,20 @@ func adminUnmute(w http.ResponseWriter, r *http.Request) {
 }
 
 func adminChangeUsername(w http.ResponseWriter, r *http.Request) {
-	uuid, _, rank, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
-	if rank == 0 {
-		handleError(w, r, "access denied")
-		return
-	}
-
-	userParam, newUserParam := r.URL.Query().Get("user"), r.URL.Query().Get("newUser")
-
-	if userParam == "" {
-		handleError(w, r, "user not specified")
-		return
-	}
+	uuid := getAdminActor(r).Uuid
 
+	newUserParam := r.URL.Query().Get("newUser")
 	if newUserParam == "" {
 		handleError(w, r, "new username not specified")
 		return
 	}
 
-	userUuid, err := getUuidFromName(userParam)
-	if err != nil {
-		handleInternalError(w, r, err)
-		return
-	}
-	if userUuid == "" {
-		handleError(w, r, "invalid user specified")
+	userUuid, ok := getAdminTarget(w, r)
+	if !ok {
 		return
 	}
 
-	err = tryChangePlayerUsername(uuid, userUuid, newUserParam)
+	err := adminChangePlayerUsername(uuid, userUuid, newUserParam)
 	if err != nil {
 		handleInternalError(w, r, err)
 		return
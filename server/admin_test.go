@@ -0,0 +1,213 @@
+/*
+	Copyright (C) 2021-2023  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testTargetUuid  = "targetplayeruuid"
+	testTargetUser  = "TargetPlayer"
+	testTargetMsgId = "abcdefghijkl"
+)
+
+// stubAdminTargetLookups replaces the admin target lookups with ones that only
+// know of a single player, restoring them when the test ends
+func stubAdminTargetLookups(t *testing.T) {
+	playerExists, uuidFromName, uuidFromMsgId := adminTargetPlayerExists, adminTargetUuidFromName, adminTargetUuidFromMsgId
+	t.Cleanup(func() {
+		adminTargetPlayerExists, adminTargetUuidFromName, adminTargetUuidFromMsgId = playerExists, uuidFromName, uuidFromMsgId
+	})
+
+	adminTargetPlayerExists = func(uuid string) (bool, error) {
+		return uuid == testTargetUuid, nil
+	}
+	adminTargetUuidFromName = func(name string) (string, error) {
+		if name == testTargetUser {
+			return testTargetUuid, nil
+		}
+		return "", nil
+	}
+	adminTargetUuidFromMsgId = func(msgId string) (string, error) {
+		if msgId == testTargetMsgId {
+			return testTargetUuid, nil
+		}
+		return "", nil
+	}
+}
+
+var adminTargetForms = []struct {
+	name    string
+	query   url.Values
+	wantErr error
+}{
+	{"uuid", url.Values{"uuid": {testTargetUuid}}, nil},
+	{"user", url.Values{"user": {testTargetUser}}, nil},
+	{"msgId", url.Values{"msgId": {testTargetMsgId}}, nil},
+	{"missing", url.Values{}, errAdminTargetNotSpecified},
+	{"unknown uuid", url.Values{"uuid": {"unknownuuid"}}, errAdminTargetNotFound},
+	{"unknown user", url.Values{"user": {"UnknownPlayer"}}, errAdminTargetNotFound},
+	{"unknown msgId", url.Values{"msgId": {"zyxwvutsrqpo"}}, errAdminTargetNotFound},
+	{"bad msgId length", url.Values{"msgId": {"abc"}}, errAdminTargetInvalidMsgId},
+}
+
+func TestResolveAdminTarget(t *testing.T) {
+	stubAdminTargetLookups(t)
+
+	for _, tt := range adminTargetForms {
+		t.Run(tt.name, func(t *testing.T) {
+			uuid, err := resolveAdminTarget(tt.query)
+			if err != tt.wantErr {
+				t.Fatalf("resolveAdminTarget() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr != nil {
+				if uuid != "" {
+					t.Errorf("resolveAdminTarget() = %q, want empty uuid", uuid)
+				}
+				return
+			}
+
+			if uuid == "" || uuid != testTargetUuid {
+				t.Errorf("resolveAdminTarget() = %q, want %q", uuid, testTargetUuid)
+			}
+		})
+	}
+}
+
+// stubAdminActions replaces the actions admin commands take with ones that
+// record the player they act on, restoring them when the test ends
+func stubAdminActions(t *testing.T) (actedOn *string) {
+	ban, mute, unban, unmute := adminBanPlayer, adminMutePlayer, adminUnbanPlayer, adminUnmutePlayer
+	changeUsername, unlockBadge, removeBadge, resetPassword := adminChangePlayerUsername, adminUnlockPlayerBadge, adminRemovePlayerBadge, adminResetPlayerPassword
+	gameBadges := badges
+	t.Cleanup(func() {
+		adminBanPlayer, adminMutePlayer, adminUnbanPlayer, adminUnmutePlayer = ban, mute, unban, unmute
+		adminChangePlayerUsername, adminUnlockPlayerBadge, adminRemovePlayerBadge, adminResetPlayerPassword = changeUsername, unlockBadge, removeBadge, resetPassword
+		badges = gameBadges
+	})
+
+	actedOn = new(string)
+
+	adminBanPlayer = func(senderUuid string, recipientUuid string, reason string, duration time.Duration) error {
+		*actedOn = recipientUuid
+		return nil
+	}
+	adminMutePlayer = adminBanPlayer
+	adminUnbanPlayer = func(senderUuid string, recipientUuid string, reason string) error {
+		*actedOn = recipientUuid
+		return nil
+	}
+	adminUnmutePlayer = adminUnbanPlayer
+	adminChangePlayerUsername = func(senderUuid string, recipientUuid string, newUsername string) error {
+		*actedOn = recipientUuid
+		return nil
+	}
+	adminUnlockPlayerBadge = func(playerUuid string, badgeId string) error {
+		*actedOn = playerUuid
+		return nil
+	}
+	adminRemovePlayerBadge = adminUnlockPlayerBadge
+	adminResetPlayerPassword = func(uuid string) (string, error) {
+		*actedOn = uuid
+		return "newpassword", nil
+	}
+
+	badges = map[string]map[string]*Badge{
+		"testgame": {"testbadge": {}},
+	}
+
+	return actedOn
+}
+
+func TestAdminCommandTargets(t *testing.T) {
+	stubAdminTargetLookups(t)
+	actedOn := stubAdminActions(t)
+
+	commands := []struct {
+		name    string
+		handler http.HandlerFunc
+		query   url.Values
+	}{
+		{"ban", adminBan, url.Values{}},
+		{"mute", adminMute, url.Values{}},
+		{"unban", adminUnban, url.Values{}},
+		{"unmute", adminUnmute, url.Values{}},
+		{"rename", adminChangeUsername, url.Values{"newUser": {"NewName"}}},
+		{"grantbadge", handleAdmin, url.Values{"command": {"grantbadge"}, "id": {"testbadge"}}},
+		{"revokebadge", handleAdmin, url.Values{"command": {"revokebadge"}, "id": {"testbadge"}}},
+		{"resetpw", handleAdmin, url.Values{"command": {"resetpw"}}},
+	}
+
+	actor := &AdminActor{
+		Uuid:        "adminplayeruuid",
+		Rank:        2,
+		Permissions: make(map[string]bool),
+	}
+	for _, permission := range permissions {
+		actor.Permissions[permission] = true
+	}
+
+	for _, command := range commands {
+		for _, form := range adminTargetForms {
+			t.Run(command.name+"/"+form.name, func(t *testing.T) {
+				*actedOn = ""
+
+				query := url.Values{}
+				for key, values := range command.query {
+					query[key] = values
+				}
+				for key, values := range form.query {
+					query[key] = values
+				}
+
+				r := httptest.NewRequest(http.MethodGet, "/admin/"+command.name+"?"+query.Encode(), nil)
+				r = r.WithContext(context.WithValue(r.Context(), adminActorKey{}, actor))
+				w := httptest.NewRecorder()
+
+				command.handler(w, r)
+
+				body := strings.TrimSuffix(w.Body.String(), "\n")
+
+				if form.wantErr != nil {
+					if w.Code != http.StatusBadRequest || body != form.wantErr.Error() {
+						t.Errorf("got %d %q, want %d %q", w.Code, body, http.StatusBadRequest, form.wantErr.Error())
+					}
+					if *actedOn != "" {
+						t.Errorf("acted on %q for an invalid target", *actedOn)
+					}
+					return
+				}
+
+				if w.Code != http.StatusOK {
+					t.Fatalf("got %d %q, want %d", w.Code, body, http.StatusOK)
+				}
+				if *actedOn != testTargetUuid {
+					t.Errorf("acted on %q, want %q", *actedOn, testTargetUuid)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,329 @@
+/*
+	Copyright (C) 2021-2023  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ScheduledAnnouncement struct {
+	Id        int       `json:"id"`
+	ActorUuid string    `json:"actorUuid"`
+	Message   string    `json:"message"`
+	MapId     string    `json:"mapId"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func initAdminActions() {
+	scheduledAnnouncements, err := getScheduledAnnouncements()
+	if err != nil {
+		writeErrLog("SERVER", "announcements", err.Error())
+		return
+	}
+
+	for _, scheduledAnnouncement := range scheduledAnnouncements {
+		scheduleAnnouncement(scheduledAnnouncement)
+	}
+}
+
+// sendAnnouncement sends a system announcement to every session, or through
+// the room socket to the clients in one room
+func sendAnnouncement(message string, roomId int) {
+	if roomId < 0 {
+		for _, client := range clients.Get() {
+			select {
+			case client.send <- buildMsg("ann", message):
+			default:
+				writeErrLog(client.uuid, "sess", "send channel is full")
+			}
+		}
+		return
+	}
+
+	room, ok := rooms[roomId]
+	if !ok {
+		return
+	}
+
+	// room.clients belongs to the room clients' processors, so find the
+	// room's clients through their sessions instead
+	for _, client := range clients.Get() {
+		rClient := client.rClient
+		if rClient == nil || rClient.room != room {
+			continue
+		}
+
+		select {
+		case rClient.send <- buildMsg("ann", message):
+		default:
+			writeErrLog(client.uuid, "sess", "send channel is full")
+		}
+	}
+}
+
+func scheduleAnnouncement(scheduledAnnouncement *ScheduledAnnouncement) {
+	roomId := -1
+	if scheduledAnnouncement.MapId != "" {
+		roomId, _ = strconv.Atoi(scheduledAnnouncement.MapId)
+	}
+
+	scheduler.Every(1).Day().StartAt(scheduledAnnouncement.Timestamp).LimitRunsTo(1).Tag(getAnnouncementTag(scheduledAnnouncement.Id)).Do(func() {
+		sendAnnouncement(scheduledAnnouncement.Message, roomId)
+
+		err := deleteScheduledAnnouncement(scheduledAnnouncement.Id)
+		if err != nil {
+			writeErrLog("SERVER", "announcements", err.Error())
+		}
+	})
+}
+
+func getAnnouncementTag(id int) string {
+	return "announcement-" + strconv.Itoa(id)
+}
+
+// getAnnouncementParams reads the message and optional map ID of an
+// announcement, where no map ID sends it to the whole server
+func getAnnouncementParams(r *http.Request) (message string, mapId string, roomId int, err error) {
+	message = strings.TrimSpace(r.URL.Query().Get("message"))
+	if message == "" || len(message) > 500 {
+		return "", "", 0, errors.New("invalid message")
+	}
+
+	roomId = -1
+	if mapIdParam := r.URL.Query().Get("mapId"); mapIdParam != "" {
+		roomId, err = strconv.Atoi(mapIdParam)
+		if err != nil {
+			return "", "", 0, errors.New("invalid mapId value")
+		}
+		if _, ok := rooms[roomId]; !ok {
+			return "", "", 0, errors.New("room not found")
+		}
+		mapId = fmt.Sprintf("%04d", roomId)
+	}
+
+	return message, mapId, roomId, nil
+}
+
+func adminActions(w http.ResponseWriter, r *http.Request) {
+	actor := getAdminActor(r)
+
+	commandParam := r.URL.Query().Get("command")
+	if commandParam == "" {
+		handleError(w, r, "command not specified")
+		return
+	}
+
+	var details string
+
+	switch commandParam {
+	case "kick", "move":
+		if !actor.hasPermission(permissionKick) {
+			handleError(w, r, "access denied")
+			return
+		}
+
+		uuidParam, ok := getAdminTarget(w, r)
+		if !ok {
+			return
+		}
+
+		if !actor.canActOn(uuidParam) {
+			handleError(w, r, "insufficient rank")
+			return
+		}
+
+		reason := r.URL.Query().Get("reason")
+		if len(reason) > 500 {
+			handleError(w, r, "reason too long")
+			return
+		}
+
+		client, ok := clients.Load(uuidParam)
+		if !ok {
+			handleError(w, r, "session not found")
+			return
+		}
+
+		if commandParam == "kick" {
+			client.kick(closeCodeKicked, reason)
+		} else {
+			// removing the room client makes the player leave the room
+			rClient := client.rClient
+			if rClient == nil {
+				handleError(w, r, "player not in a room")
+				return
+			}
+
+			details = rClient.mapId + " "
+			rClient.kick(closeCodeRemoved, reason)
+		}
+
+		details += uuidParam + " " + reason
+	case "announce", "schedule":
+		if !actor.hasPermission(permissionAnnounce) {
+			handleError(w, r, "access denied")
+			return
+		}
+
+		message, mapId, roomId, err := getAnnouncementParams(r)
+		if err != nil {
+			handleError(w, r, err.Error())
+			return
+		}
+
+		if commandParam == "announce" {
+			sendAnnouncement(message, roomId)
+			details = mapId + " " + message
+			break
+		}
+
+		timestamp, err := time.Parse(time.RFC3339, r.URL.Query().Get("time"))
+		if err != nil {
+			handleError(w, r, "invalid time value")
+			return
+		}
+		if !timestamp.After(time.Now()) {
+			handleError(w, r, "time must be in the future")
+			return
+		}
+
+		scheduledAnnouncement := &ScheduledAnnouncement{
+			ActorUuid: actor.Uuid,
+			Message:   message,
+			MapId:     mapId,
+			Timestamp: timestamp.UTC(),
+		}
+
+		scheduledAnnouncement.Id, err = writeScheduledAnnouncement(scheduledAnnouncement)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		scheduleAnnouncement(scheduledAnnouncement)
+
+		details = strconv.Itoa(scheduledAnnouncement.Id) + " " + scheduledAnnouncement.Timestamp.Format(time.RFC3339) + " " + mapId + " " + message
+	case "scheduled":
+		if !actor.hasPermission(permissionAnnounce) {
+			handleError(w, r, "access denied")
+			return
+		}
+
+		scheduledAnnouncements, err := getScheduledAnnouncements()
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		if scheduledAnnouncements == nil {
+			scheduledAnnouncements = []*ScheduledAnnouncement{}
+		}
+
+		scheduledAnnouncementsJson, err := json.Marshal(scheduledAnnouncements)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		w.Write(scheduledAnnouncementsJson)
+		return
+	case "unschedule":
+		if !actor.hasPermission(permissionAnnounce) {
+			handleError(w, r, "access denied")
+			return
+		}
+
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			handleError(w, r, "invalid id value")
+			return
+		}
+
+		err = deleteScheduledAnnouncement(id)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		scheduler.RemoveByTag(getAnnouncementTag(id))
+
+		details = strconv.Itoa(id)
+	default:
+		handleError(w, r, "unknown command")
+		return
+	}
+
+	err := writeAuditLog(actor.Uuid, "actions/"+commandParam, details)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	w.Write([]byte("ok"))
+}
+
+func getScheduledAnnouncements() (scheduledAnnouncements []*ScheduledAnnouncement, err error) {
+	results, err := db.Query("SELECT id, actorUuid, message, mapId, timestamp FROM scheduledAnnouncements WHERE game = ? AND timestamp > UTC_TIMESTAMP() ORDER BY timestamp", config.gameName)
+	if err != nil {
+		return scheduledAnnouncements, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		scheduledAnnouncement := &ScheduledAnnouncement{}
+
+		err := results.Scan(&scheduledAnnouncement.Id, &scheduledAnnouncement.ActorUuid, &scheduledAnnouncement.Message, &scheduledAnnouncement.MapId, &scheduledAnnouncement.Timestamp)
+		if err != nil {
+			return scheduledAnnouncements, err
+		}
+
+		scheduledAnnouncements = append(scheduledAnnouncements, scheduledAnnouncement)
+	}
+
+	return scheduledAnnouncements, nil
+}
+
+func writeScheduledAnnouncement(scheduledAnnouncement *ScheduledAnnouncement) (id int, err error) {
+	result, err := db.Exec("INSERT INTO scheduledAnnouncements (game, actorUuid, message, mapId, timestamp) VALUES (?, ?, ?, ?, ?)", config.gameName, scheduledAnnouncement.ActorUuid, scheduledAnnouncement.Message, scheduledAnnouncement.MapId, scheduledAnnouncement.Timestamp)
+	if err != nil {
+		return 0, err
+	}
+
+	lastInsertId, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(lastInsertId), nil
+}
+
+func deleteScheduledAnnouncement(id int) error {
+	_, err := db.Exec("DELETE FROM scheduledAnnouncements WHERE id = ? AND game = ?", id, config.gameName)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
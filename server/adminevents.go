@@ -0,0 +1,907 @@
+/*
+	Copyright (C) 2021-2023  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type AdminEventLocation struct {
+	Id          int       `json:"id"`
+	Type        int       `json:"type"`
+	Game        string    `json:"game"`
+	Title       string    `json:"title"`
+	TitleJP     string    `json:"titleJP"`
+	Depth       int       `json:"depth"`
+	MinDepth    int       `json:"minDepth"`
+	MapIds      []string  `json:"mapIds"`
+	Exp         int       `json:"exp"`
+	StartDate   time.Time `json:"startDate"`
+	EndDate     time.Time `json:"endDate"`
+	Completions int       `json:"completions"`
+}
+
+type AdminEventVm struct {
+	Id          int       `json:"id"`
+	Game        string    `json:"game"`
+	MapId       int       `json:"mapId"`
+	EventId     int       `json:"eventId"`
+	Exp         int       `json:"exp"`
+	StartDate   time.Time `json:"startDate"`
+	EndDate     time.Time `json:"endDate"`
+	Completions int       `json:"completions"`
+}
+
+type AdminEvents struct {
+	Locations []*AdminEventLocation `json:"locations"`
+	Vms       []*AdminEventVm       `json:"vms"`
+}
+
+func adminEvents(w http.ResponseWriter, r *http.Request) {
+	uuid := getAdminActor(r).Uuid
+
+	commandParam := r.URL.Query().Get("command")
+	if commandParam == "" {
+		handleError(w, r, "command not specified")
+		return
+	}
+
+	if commandParam == "list" {
+		locations, err := getAdminEventLocations()
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		vms, err := getAdminEventVms()
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		responseJson, err := json.Marshal(AdminEvents{Locations: locations, Vms: vms})
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		w.Write(responseJson)
+		return
+	}
+
+	vm := r.URL.Query().Get("type") == "vm"
+
+	// changes to events are serialized with scheduled event jobs, which
+	// share the current event periods and location pools
+	eventsMtx.Lock()
+	defer eventsMtx.Unlock()
+
+	var details string
+	var err error
+
+	switch commandParam {
+	case "create":
+		if vm {
+			details, err = adminCreateEventVm(r)
+		} else {
+			details, err = adminCreateEventLocation(r)
+		}
+	case "replace":
+		if vm {
+			details, err = adminReplaceEventVm(r)
+		} else {
+			details, err = adminReplaceEventLocation(r)
+		}
+	case "extend":
+		details, err = adminExtendEvent(r, vm)
+	case "delete":
+		details, err = adminDeleteEvent(r, vm)
+	case "regenerate":
+		details, err = adminRegenerateEvent(r)
+	default:
+		handleError(w, r, "unknown command")
+		return
+	}
+	if err != nil {
+		handleError(w, r, err.Error())
+		return
+	}
+
+	err = writeAuditLog(uuid, "events/"+commandParam, details)
+	if err != nil {
+		writeErrLog(uuid, r.URL.Path, err.Error())
+	}
+
+	sendEventsUpdate()
+
+	w.Write([]byte("ok"))
+}
+
+// getAdminEventDates reads startDate and endDate or days query parameters,
+// defaulting to a single day starting today
+func getAdminEventDates(r *http.Request) (startDate time.Time, endDate time.Time, err error) {
+	startDate = truncateToDate(time.Now().UTC())
+	if startDateParam := r.URL.Query().Get("startDate"); startDateParam != "" {
+		startDate, err = time.Parse("2006-01-02", startDateParam)
+		if err != nil {
+			return startDate, endDate, errors.New("invalid startDate value")
+		}
+	}
+
+	endDate = startDate.AddDate(0, 0, 1)
+	if endDateParam := r.URL.Query().Get("endDate"); endDateParam != "" {
+		endDate, err = time.Parse("2006-01-02", endDateParam)
+		if err != nil {
+			return startDate, endDate, errors.New("invalid endDate value")
+		}
+	} else if daysParam := r.URL.Query().Get("days"); daysParam != "" {
+		days, err := strconv.Atoi(daysParam)
+		if err != nil || days <= 0 {
+			return startDate, endDate, errors.New("invalid days value")
+		}
+		endDate = startDate.AddDate(0, 0, days)
+	}
+
+	if !endDate.After(startDate) {
+		return startDate, endDate, errors.New("endDate must be after startDate")
+	}
+
+	return startDate, endDate, nil
+}
+
+func getAdminEventIntParam(r *http.Request, name string) (int, error) {
+	value, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil {
+		return 0, errors.New("invalid " + name + " value")
+	}
+
+	return value, nil
+}
+
+// getAdminEventLocationParams reads the location of an event location from
+// query parameters
+func getAdminEventLocationParams(r *http.Request) (eventLocation *EventLocationData, err error) {
+	eventLocation = &EventLocationData{
+		Title:   r.URL.Query().Get("title"),
+		TitleJP: r.URL.Query().Get("titleJP"),
+	}
+	if eventLocation.Title == "" {
+		return nil, errors.New("title not specified")
+	}
+
+	eventLocation.Depth, err = getAdminEventIntParam(r, "depth")
+	if err != nil {
+		return nil, err
+	}
+
+	eventLocation.MinDepth = eventLocation.Depth
+	if r.URL.Query().Get("minDepth") != "" {
+		eventLocation.MinDepth, err = getAdminEventIntParam(r, "minDepth")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	mapIdsParam := r.URL.Query().Get("mapIds")
+	if mapIdsParam == "" {
+		return nil, errors.New("mapIds not specified")
+	}
+	for _, mapId := range strings.Split(mapIdsParam, ",") {
+		mapIdInt, err := strconv.Atoi(mapId)
+		if err != nil {
+			return nil, errors.New("invalid mapIds value")
+		}
+		eventLocation.MapIds = append(eventLocation.MapIds, fmt.Sprintf("%04d", mapIdInt))
+	}
+
+	return eventLocation, nil
+}
+
+func adminCreateEventLocation(r *http.Request) (details string, err error) {
+	gameId := r.URL.Query().Get("game")
+	if gameId == "" {
+		gameId = config.gameName
+	}
+
+	if _, ok := gameCurrentEventPeriods[gameId]; !ok && gameId != config.gameName {
+		return "", errors.New("game has no current event period")
+	}
+	gameEventPeriodId := getGameEventPeriodId(gameId)
+
+	eventType, err := getAdminEventIntParam(r, "eventType")
+	if err != nil {
+		return "", err
+	}
+
+	exp, err := getAdminEventIntParam(r, "exp")
+	if err != nil {
+		return "", err
+	}
+
+	eventLocation, err := getAdminEventLocationParams(r)
+	if err != nil {
+		return "", err
+	}
+
+	startDate, endDate, err := getAdminEventDates(r)
+	if err != nil {
+		return "", err
+	}
+
+	err = runInTx(func(tx *sql.Tx) error {
+		return writeEventLocationData(tx, gameEventPeriodId, eventType, eventLocation.Title, eventLocation.TitleJP, eventLocation.Depth, eventLocation.MinDepth, exp, eventLocation.MapIds, startDate, endDate)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("created %s location %s (type %d, %d exp) from %s to %s", gameId, eventLocation.Title, eventType, exp, startDate.Format("2006-01-02"), endDate.Format("2006-01-02")), nil
+}
+
+func adminCreateEventVm(r *http.Request) (details string, err error) {
+	mapId, err := getAdminEventIntParam(r, "mapId")
+	if err != nil {
+		return "", err
+	}
+
+	eventId, err := getAdminEventIntParam(r, "eventId")
+	if err != nil {
+		return "", err
+	}
+
+	var exp int
+	if r.URL.Query().Get("exp") != "" {
+		exp, err = getAdminEventIntParam(r, "exp")
+		if err != nil {
+			return "", err
+		}
+	} else if eventSchedule.Vms != nil {
+		exp = eventSchedule.Vms.Exp
+	} else {
+		return "", errors.New("exp not specified and no vm schedule")
+	}
+
+	startDate, endDate, err := getAdminEventDates(r)
+	if err != nil {
+		return "", err
+	}
+
+	err = writeEventVmData(db, mapId, eventId, exp, startDate, endDate)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("created vm %04d/%04d (%d exp) from %s to %s", mapId, eventId, exp, startDate.Format("2006-01-02"), endDate.Format("2006-01-02")), nil
+}
+
+// adminReplaceEventLocation changes the location of an event location,
+// clearing its completions if the location changes unless keepCompletions is
+// set
+func adminReplaceEventLocation(r *http.Request) (details string, err error) {
+	id, err := getAdminEventIntParam(r, "id")
+	if err != nil {
+		return "", err
+	}
+
+	var gameEventPeriodId int
+	err = db.QueryRow("SELECT el.gamePeriodId FROM eventLocations el JOIN gameEventPeriods gep ON gep.id = el.gamePeriodId WHERE el.id = ? AND gep.periodId = ?", id, currentEventPeriodId).Scan(&gameEventPeriodId)
+	if err != nil {
+		return "", errors.New("event location not found")
+	}
+
+	eventLocation, err := getAdminEventLocationParams(r)
+	if err != nil {
+		return "", err
+	}
+
+	keepCompletions := getAdminKeepCompletions(r)
+
+	err = runInTx(func(tx *sql.Tx) error {
+		locationId, err := getOrWriteLocationIdForEventLocation(tx, gameEventPeriodId, eventLocation.Title, eventLocation.TitleJP, eventLocation.Depth, eventLocation.MinDepth, eventLocation.MapIds)
+		if err != nil {
+			return err
+		}
+
+		return updateEventLocationLocation(tx, id, locationId, gameEventPeriodId, keepCompletions)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("replaced location of event location %d with %s%s", id, eventLocation.Title, getKeptCompletionsDetails(keepCompletions)), nil
+}
+
+// adminReplaceEventVm changes the vending machine of an event vm, clearing its
+// completions if it changes unless keepCompletions is set
+func adminReplaceEventVm(r *http.Request) (details string, err error) {
+	id, err := getAdminEventIntParam(r, "id")
+	if err != nil {
+		return "", err
+	}
+
+	mapId, err := getAdminEventIntParam(r, "mapId")
+	if err != nil {
+		return "", err
+	}
+
+	eventId, err := getAdminEventIntParam(r, "eventId")
+	if err != nil {
+		return "", err
+	}
+
+	keepCompletions := getAdminKeepCompletions(r)
+
+	err = runInTx(func(tx *sql.Tx) error {
+		var currentMapId, currentEventId int
+		err := tx.QueryRow("SELECT ev.mapId, ev.eventId FROM eventVms ev JOIN gameEventPeriods gep ON gep.id = ev.gamePeriodId WHERE ev.id = ? AND gep.periodId = ? FOR UPDATE", id, currentEventPeriodId).Scan(&currentMapId, &currentEventId)
+		if err != nil {
+			return errors.New("event vm not found")
+		}
+
+		if mapId == currentMapId && eventId == currentEventId {
+			return nil
+		}
+
+		_, err = tx.Exec("UPDATE eventVms SET mapId = ?, eventId = ? WHERE id = ?", mapId, eventId, id)
+		if err != nil {
+			return err
+		}
+
+		if keepCompletions {
+			return nil
+		}
+
+		return clearEventCompletions(tx, 2, id)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("replaced event vm %d with %04d/%04d%s", id, mapId, eventId, getKeptCompletionsDetails(keepCompletions)), nil
+}
+
+func adminExtendEvent(r *http.Request, vm bool) (details string, err error) {
+	id, err := getAdminEventIntParam(r, "id")
+	if err != nil {
+		return "", err
+	}
+
+	days, err := getAdminEventIntParam(r, "days")
+	if err != nil || days <= 0 {
+		return "", errors.New("invalid days value")
+	}
+
+	table := "eventLocations"
+	if vm {
+		table = "eventVms"
+	}
+
+	err = runInTx(func(tx *sql.Tx) error {
+		result, err := tx.Exec("UPDATE "+table+" e JOIN gameEventPeriods gep ON gep.id = e.gamePeriodId SET e.endDate = DATE_ADD(e.endDate, INTERVAL ? DAY) WHERE e.id = ? AND gep.periodId = ?", days, id, currentEventPeriodId)
+		if err != nil {
+			return err
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			return errors.New("event not found")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("extended %s %d by %d days", table, id, days), nil
+}
+
+func adminDeleteEvent(r *http.Request, vm bool) (details string, err error) {
+	id, err := getAdminEventIntParam(r, "id")
+	if err != nil {
+		return "", err
+	}
+
+	table := "eventLocations"
+	completionType := 0
+	if vm {
+		table = "eventVms"
+		completionType = 2
+	}
+
+	err = runInTx(func(tx *sql.Tx) error {
+		return deleteEvent(tx, table, completionType, id)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("deleted %s %d", table, id), nil
+}
+
+// adminRegenerateEvent replaces the events of the current occurrence of a
+// schedule slot with newly generated ones, reusing the existing events and
+// clearing the completions of those whose location changes unless
+// keepCompletions is set
+func adminRegenerateEvent(r *http.Request) (details string, err error) {
+	if !isHostServer {
+		return "", errors.New("events can only be regenerated on the host server")
+	}
+
+	slotParam := r.URL.Query().Get("slot")
+	keepCompletions := getAdminKeepCompletions(r)
+	now := time.Now().UTC()
+
+	if slotParam == "vm" {
+		if eventSchedule.Vms == nil {
+			return "", errors.New("no vm schedule")
+		}
+
+		startDate, endDate, err := getEventScheduleDates(eventSchedule.Vms.schedule, eventSchedule.Vms.Days, now)
+		if err != nil {
+			return "", err
+		}
+
+		ids, err := getScheduledEventVmIds(startDate)
+		if err != nil {
+			return "", err
+		}
+
+		mapId, eventId, ok := getRandomEventVm(rand.New(rand.NewSource(time.Now().UnixNano())))
+		if !ok {
+			return "", errors.New("no event vms available")
+		}
+
+		err = runInTx(func(tx *sql.Tx) error {
+			if len(ids) == 0 {
+				return writeEventVmData(tx, mapId, eventId, eventSchedule.Vms.Exp, startDate, endDate)
+			}
+
+			var currentMapId, currentEventId int
+			err := tx.QueryRow("SELECT mapId, eventId FROM eventVms WHERE id = ? FOR UPDATE", ids[0]).Scan(&currentMapId, &currentEventId)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec("UPDATE eventVms SET mapId = ?, eventId = ? WHERE id = ?", mapId, eventId, ids[0])
+			if err != nil {
+				return err
+			}
+
+			if !keepCompletions && (mapId != currentMapId || eventId != currentEventId) {
+				err = clearEventCompletions(tx, 2, ids[0])
+				if err != nil {
+					return err
+				}
+			}
+
+			return deleteExtraRegeneratedEvents(tx, "eventVms", ids[1:])
+		})
+		if err != nil {
+			return "", err
+		}
+
+		currentEventVmMapId = mapId
+		currentEventVmEventId = eventId
+
+		return fmt.Sprintf("regenerated vm slot starting %s with %04d/%04d%s", startDate.Format("2006-01-02"), mapId, eventId, getKeptCompletionsDetails(keepCompletions)), nil
+	}
+
+	for _, locationSchedule := range eventSchedule.Locations {
+		if locationSchedule.Id != slotParam {
+			continue
+		}
+
+		startDate, endDate, err := getEventScheduleDates(locationSchedule.schedule, locationSchedule.Days, now)
+		if err != nil {
+			return "", err
+		}
+
+		ids, err := getScheduledEventLocationIds(locationSchedule, startDate)
+		if err != nil {
+			return "", err
+		}
+
+		gameId, eventLocations, err := generateScheduledEventLocations(locationSchedule)
+		if err != nil {
+			return "", err
+		}
+
+		gameEventPeriodId := getGameEventPeriodId(gameId)
+		exp := locationSchedule.getExp(gameId)
+
+		err = runInTx(func(tx *sql.Tx) error {
+			for i, eventLocation := range eventLocations {
+				if i >= len(ids) {
+					err := writeEventLocationData(tx, gameEventPeriodId, locationSchedule.Type, eventLocation.Title, eventLocation.TitleJP, eventLocation.Depth, eventLocation.MinDepth, exp, eventLocation.MapIds, startDate, endDate)
+					if err != nil {
+						return err
+					}
+					continue
+				}
+
+				locationId, err := getOrWriteLocationIdForEventLocation(tx, gameEventPeriodId, eventLocation.Title, eventLocation.TitleJP, eventLocation.Depth, eventLocation.MinDepth, eventLocation.MapIds)
+				if err != nil {
+					return err
+				}
+
+				_, err = tx.Exec("UPDATE eventLocations SET exp = ? WHERE id = ?", exp, ids[i])
+				if err != nil {
+					return err
+				}
+
+				err = updateEventLocationLocation(tx, ids[i], locationId, gameEventPeriodId, keepCompletions)
+				if err != nil {
+					return err
+				}
+			}
+
+			if len(ids) > len(eventLocations) {
+				return deleteExtraRegeneratedEvents(tx, "eventLocations", ids[len(eventLocations):])
+			}
+
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("regenerated %s slot starting %s with %s%s", locationSchedule.Id, startDate.Format("2006-01-02"), gameId, getKeptCompletionsDetails(keepCompletions)), nil
+	}
+
+	return "", errors.New("invalid slot")
+}
+
+// getAdminKeepCompletions gets whether completions should be kept when an
+// event is given a different location
+func getAdminKeepCompletions(r *http.Request) bool {
+	return r.URL.Query().Get("keepCompletions") == "1"
+}
+
+func getKeptCompletionsDetails(keepCompletions bool) string {
+	if keepCompletions {
+		return ", keeping completions"
+	}
+
+	return ""
+}
+
+// updateEventLocationLocation sets the location of an event location, clearing
+// its completions if the location changes unless keepCompletions is set
+func updateEventLocationLocation(tx *sql.Tx, id int, locationId int, gameEventPeriodId int, keepCompletions bool) error {
+	var currentLocationId, currentGameEventPeriodId int
+	err := tx.QueryRow("SELECT locationId, gamePeriodId FROM eventLocations WHERE id = ? FOR UPDATE", id).Scan(&currentLocationId, &currentGameEventPeriodId)
+	if err != nil {
+		return err
+	}
+
+	if locationId == currentLocationId && gameEventPeriodId == currentGameEventPeriodId {
+		return nil
+	}
+
+	_, err = tx.Exec("UPDATE eventLocations SET locationId = ?, gamePeriodId = ? WHERE id = ?", locationId, gameEventPeriodId, id)
+	if err != nil {
+		return err
+	}
+
+	if keepCompletions {
+		return nil
+	}
+
+	return clearEventCompletions(tx, 0, id)
+}
+
+func clearEventCompletions(tx *sql.Tx, completionType int, id int) error {
+	_, err := tx.Exec("DELETE FROM eventCompletions WHERE eventId = ? AND type = ?", id, completionType)
+
+	return err
+}
+
+// deleteExtraRegeneratedEvents removes events left over when a slot is
+// regenerated with fewer events than before, leaving their completions
+func deleteExtraRegeneratedEvents(tx *sql.Tx, table string, ids []int) error {
+	for _, id := range ids {
+		_, err := tx.Exec("DELETE FROM "+table+" WHERE id = ?", id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func getAdminEventLocations() (eventLocations []*AdminEventLocation, err error) {
+	results, err := db.Query("SELECT el.id, el.type, gep.game, l.title, l.titleJP, l.depth, l.minDepth, l.mapIds, el.exp, el.startDate, el.endDate, (SELECT COUNT(*) FROM eventCompletions ec WHERE ec.eventId = el.id AND ec.type = 0) FROM eventLocations el JOIN gameLocations l ON l.id = el.locationId JOIN gameEventPeriods gep ON gep.id = el.gamePeriodId WHERE gep.periodId = ? ORDER BY el.startDate, el.type, el.id", currentEventPeriodId)
+	if err != nil {
+		return eventLocations, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		eventLocation := &AdminEventLocation{}
+
+		var mapIdsJson string
+
+		err := results.Scan(&eventLocation.Id, &eventLocation.Type, &eventLocation.Game, &eventLocation.Title, &eventLocation.TitleJP, &eventLocation.Depth, &eventLocation.MinDepth, &mapIdsJson, &eventLocation.Exp, &eventLocation.StartDate, &eventLocation.EndDate, &eventLocation.Completions)
+		if err != nil {
+			return eventLocations, err
+		}
+
+		err = json.Unmarshal([]byte(mapIdsJson), &eventLocation.MapIds)
+		if err != nil {
+			return eventLocations, err
+		}
+
+		eventLocations = append(eventLocations, eventLocation)
+	}
+
+	return eventLocations, nil
+}
+
+func getAdminEventVms() (eventVms []*AdminEventVm, err error) {
+	results, err := db.Query("SELECT ev.id, gep.game, ev.mapId, ev.eventId, ev.exp, ev.startDate, ev.endDate, (SELECT COUNT(*) FROM eventCompletions ec WHERE ec.eventId = ev.id AND ec.type = 2) FROM eventVms ev JOIN gameEventPeriods gep ON gep.id = ev.gamePeriodId WHERE gep.periodId = ? ORDER BY ev.startDate, ev.id", currentEventPeriodId)
+	if err != nil {
+		return eventVms, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		eventVm := &AdminEventVm{}
+
+		err := results.Scan(&eventVm.Id, &eventVm.Game, &eventVm.MapId, &eventVm.EventId, &eventVm.Exp, &eventVm.StartDate, &eventVm.EndDate, &eventVm.Completions)
+		if err != nil {
+			return eventVms, err
+		}
+
+		eventVms = append(eventVms, eventVm)
+	}
+
+	return eventVms, nil
+}
+
+// deleteEvent deletes an event of the current period along with its completions
+func deleteEvent(tx *sql.Tx, table string, completionType int, id int) error {
+	result, err := tx.Exec("DELETE e FROM "+table+" e JOIN gameEventPeriods gep ON gep.id = e.gamePeriodId WHERE e.id = ? AND gep.periodId = ?", id, currentEventPeriodId)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errors.New("event not found")
+	}
+
+	return clearEventCompletions(tx, completionType, id)
+}
+
+type AdminEventPeriod struct {
+	Id            int       `json:"id"`
+	PeriodOrdinal int       `json:"periodOrdinal"`
+	StartDate     time.Time `json:"startDate"`
+	EndDate       time.Time `json:"endDate"`
+	Games         []string  `json:"games"`
+	EnableVms     []string  `json:"enableVms"`
+}
+
+func adminEventPeriods(w http.ResponseWriter, r *http.Request) {
+	uuid := getAdminActor(r).Uuid
+
+	commandParam := r.URL.Query().Get("command")
+	if commandParam == "" {
+		handleError(w, r, "command not specified")
+		return
+	}
+
+	var details string
+
+	switch commandParam {
+	case "list":
+		eventPeriods, err := getAdminEventPeriods()
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		responseJson, err := json.Marshal(eventPeriods)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		w.Write(responseJson)
+		return
+	case "create":
+		startDate, err := time.Parse("2006-01-02", r.URL.Query().Get("startDate"))
+		if err != nil {
+			handleError(w, r, "invalid startDate value")
+			return
+		}
+
+		endDate, err := time.Parse("2006-01-02", r.URL.Query().Get("endDate"))
+		if err != nil || !endDate.After(startDate) {
+			handleError(w, r, "invalid endDate value")
+			return
+		}
+
+		if startDate.Before(truncateToDate(time.Now().UTC())) {
+			handleError(w, r, "startDate is in the past")
+			return
+		}
+
+		gamesParam := r.URL.Query().Get("games")
+		if gamesParam == "" {
+			handleError(w, r, "games not specified")
+			return
+		}
+		games := strings.Split(gamesParam, ",")
+
+		var enableVms []string
+		if enableVmsParam := r.URL.Query().Get("enableVms"); enableVmsParam != "" {
+			enableVms = strings.Split(enableVmsParam, ",")
+		}
+
+		periodOrdinal, err := createEventPeriod(startDate, endDate, games, enableVms)
+		if err != nil {
+			handleError(w, r, err.Error())
+			return
+		}
+
+		details = fmt.Sprintf("created period %d from %s to %s for %s", periodOrdinal, startDate.Format("2006-01-02"), endDate.Format("2006-01-02"), gamesParam)
+	case "delete":
+		id, err := getAdminEventIntParam(r, "id")
+		if err != nil {
+			handleError(w, r, err.Error())
+			return
+		}
+
+		err = deleteFutureEventPeriod(id)
+		if err != nil {
+			handleError(w, r, err.Error())
+			return
+		}
+
+		details = fmt.Sprintf("deleted period %d", id)
+	default:
+		handleError(w, r, "unknown command")
+		return
+	}
+
+	err := writeAuditLog(uuid, "eventperiods/"+commandParam, details)
+	if err != nil {
+		writeErrLog(uuid, r.URL.Path, err.Error())
+	}
+
+	w.Write([]byte("ok"))
+}
+
+func getAdminEventPeriods() (eventPeriods []*AdminEventPeriod, err error) {
+	results, err := db.Query("SELECT ep.id, ep.periodOrdinal, ep.startDate, ep.endDate, gep.game, gep.enableVms FROM eventPeriods ep JOIN gameEventPeriods gep ON gep.periodId = ep.id ORDER BY ep.periodOrdinal, gep.game")
+	if err != nil {
+		return eventPeriods, err
+	}
+
+	defer results.Close()
+
+	var eventPeriod *AdminEventPeriod
+
+	for results.Next() {
+		var id, periodOrdinal int
+		var startDate, endDate time.Time
+		var gameId string
+		var enableVms bool
+
+		err := results.Scan(&id, &periodOrdinal, &startDate, &endDate, &gameId, &enableVms)
+		if err != nil {
+			return eventPeriods, err
+		}
+
+		if eventPeriod == nil || eventPeriod.Id != id {
+			eventPeriod = &AdminEventPeriod{
+				Id:            id,
+				PeriodOrdinal: periodOrdinal,
+				StartDate:     startDate,
+				EndDate:       endDate,
+			}
+			eventPeriods = append(eventPeriods, eventPeriod)
+		}
+
+		eventPeriod.Games = append(eventPeriod.Games, gameId)
+		if enableVms {
+			eventPeriod.EnableVms = append(eventPeriod.EnableVms, gameId)
+		}
+	}
+
+	return eventPeriods, nil
+}
+
+// createEventPeriod schedules a period following the latest one, which takes
+// effect when its start date is reached
+func createEventPeriod(startDate time.Time, endDate time.Time, games []string, enableVms []string) (periodOrdinal int, err error) {
+	err = runInTx(func(tx *sql.Tx) error {
+		var overlapCount int
+		err := tx.QueryRow("SELECT COUNT(*) FROM eventPeriods WHERE startDate < ? AND endDate > ? FOR UPDATE", endDate, startDate).Scan(&overlapCount)
+		if err != nil {
+			return err
+		}
+		if overlapCount > 0 {
+			return errors.New("period overlaps an existing period")
+		}
+
+		err = tx.QueryRow("SELECT COALESCE(MAX(periodOrdinal), 0) + 1 FROM eventPeriods FOR UPDATE").Scan(&periodOrdinal)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.Exec("INSERT INTO eventPeriods (periodOrdinal, startDate, endDate) VALUES (?, ?, ?)", periodOrdinal, startDate, endDate)
+		if err != nil {
+			return err
+		}
+
+		periodId, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		for _, gameId := range games {
+			var gameEnableVms bool
+			for _, enableVmsGameId := range enableVms {
+				if enableVmsGameId == gameId {
+					gameEnableVms = true
+					break
+				}
+			}
+
+			_, err = tx.Exec("INSERT INTO gameEventPeriods (periodId, game, enableVms) VALUES (?, ?, ?)", periodId, gameId, gameEnableVms)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return periodOrdinal, err
+}
+
+func deleteFutureEventPeriod(id int) error {
+	var startDate time.Time
+	err := db.QueryRow("SELECT startDate FROM eventPeriods WHERE id = ?", id).Scan(&startDate)
+	if err != nil {
+		return errors.New("period not found")
+	}
+	if !startDate.After(time.Now().UTC()) {
+		return errors.New("only periods that have not started can be deleted")
+	}
+
+	return runInTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM gameEventPeriods WHERE periodId = ?", id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("DELETE FROM eventPeriods WHERE id = ?", id)
+
+		return err
+	})
+}
@@ -43,20 +43,31 @@ type PlayerInfo struct {
 }
 
 func initApi() {
-	http.HandleFunc("/admin/getplayers", adminGetPlayers)
-	http.HandleFunc("/admin/getbans", adminGetBans)
-	http.HandleFunc("/admin/getmutes", adminGetMutes)
-	http.HandleFunc("/admin/ban", adminBan)
-	http.HandleFunc("/admin/mute", adminMute)
-	http.HandleFunc("/admin/unban", adminUnban)
-	http.HandleFunc("/admin/unmute", adminUnmute)
-	http.HandleFunc("/admin/changeusername", adminChangeUsername)
-
-	http.HandleFunc("/api/admin", handleAdmin)
+	http.HandleFunc("/admin/getplayers", adminHandler("", adminGetPlayers))
+	http.HandleFunc("/admin/getbans", adminHandler(permissionBan, adminGetBans))
+	http.HandleFunc("/admin/getmutes", adminHandler(permissionMute, adminGetMutes))
+	http.HandleFunc("/admin/ban", adminHandler(permissionBan, adminBan))
+	http.HandleFunc("/admin/mute", adminHandler(permissionMute, adminMute))
+	http.HandleFunc("/admin/unban", adminHandler(permissionBan, adminUnban))
+	http.HandleFunc("/admin/unmute", adminHandler(permissionMute, adminUnmute))
+	http.HandleFunc("/admin/changeusername", adminHandler(permissionRename, adminChangeUsername))
+	http.HandleFunc("/admin/history", adminHandler(permissionViewModeration, adminModerationHistory))
+	http.HandleFunc("/admin/events", adminHandler(permissionManageEvents, adminEvents))
+	http.HandleFunc("/admin/eventperiods", adminHandler(permissionManageEvents, adminEventPeriods))
+	http.HandleFunc("/admin/chatfilterlog", adminHandler(permissionMute, adminChatFilterLog))
+	http.HandleFunc("/admin/roles", adminHandler("", adminRoles))
+	http.HandleFunc("/admin/reports", adminHandler(permissionReports, adminReports))
+	http.HandleFunc("/admin/sessions", adminHandler(permissionViewSessions, adminSessions))
+	http.HandleFunc("/admin/actions", adminHandler("", adminActions))
+
+	http.HandleFunc("/api/admin", adminHandler("", handleAdmin))
 	http.HandleFunc("/api/party", handleParty)
 	http.HandleFunc("/api/saveSync", handleSaveSync)
 	http.HandleFunc("/api/vm", handleVm)
 	http.HandleFunc("/api/badge", handleBadge)
+	http.HandleFunc("/api/leaderboard", handleLeaderboard)
+	http.HandleFunc("/api/timetrial", handleTimeTrial)
+	http.HandleFunc("/api/locations", handleLocations)
 
 	http.HandleFunc("/api/register", handleRegister)
 	http.HandleFunc("/api/login", handleLogin)
@@ -65,74 +76,10 @@ func initApi() {
 
 	http.HandleFunc("/api/chathistory", handleChatHistory)
 	http.HandleFunc("/api/clearchathistory", handleClearChatHistory)
+	http.HandleFunc("/api/block", handleBlock)
+	http.HandleFunc("/api/report", handleReport)
 
-	http.HandleFunc("/api/2kki", func(w http.ResponseWriter, r *http.Request) {
-		if config.gameName != "2kki" {
-			handleError(w, r, "endpoint not supported")
-			return
-		}
-
-		actionParam := r.URL.Query().Get("action")
-		if actionParam == "" {
-			handleError(w, r, "action not specified")
-			return
-		}
-
-		query := r.URL.Query()
-		query.Del("action")
-
-		queryString := query.Encode()
-
-		var response string
-
-		err := db.QueryRow("SELECT response FROM 2kkiApiQueries WHERE action = ? AND query = ? AND CURRENT_TIMESTAMP() < timestampExpired", actionParam, queryString).Scan(&response)
-		if err != nil {
-			if err != sql.ErrNoRows {
-				handleInternalError(w, r, err)
-				return
-			}
-
-			url := "https://2kki.app/" + actionParam
-			if queryString != "" {
-				url += "?" + queryString
-			}
-
-			resp, err := http.Get(url)
-			if err != nil {
-				handleInternalError(w, r, err)
-				return
-			}
-
-			defer resp.Body.Close()
-
-			body, err := io.ReadAll(resp.Body)
-			if err != nil {
-				handleInternalError(w, r, err)
-				return
-			}
-
-			if strings.HasPrefix(string(body), "{\"error\"") || strings.HasPrefix(string(body), "<!DOCTYPE html>") {
-				writeErrLog(getIp(r), r.URL.Path, "received error response from Yume 2kki Explorer API: "+string(body))
-			} else {
-				var interval string
-				// Shorter expiration for map queries returning unknown location in case of new maps that haven't yet been added to the wiki
-				if actionParam == "getMapLocationNames" && response == "[]" {
-					interval = "1 HOUR"
-				} else {
-					interval = "7 DAY"
-				}
-				_, err = db.Exec("INSERT INTO 2kkiApiQueries (action, query, response, timestampExpired) VALUES (?, ?, ?, DATE_ADD(CURRENT_TIMESTAMP(), INTERVAL "+interval+")) ON DUPLICATE KEY UPDATE response = ?, timestampExpired = DATE_ADD(CURRENT_TIMESTAMP(), INTERVAL "+interval+")", actionParam, queryString, string(body), string(body))
-				if err != nil {
-					writeErrLog(getIp(r), r.URL.Path, err.Error())
-				}
-			}
-
-			w.Write(body)
-			return
-		}
-
-		w.Write([]byte(response))
-	})
+	initGamePluginApis()
 
 	http.HandleFunc("/api/info", func(w http.ResponseWriter, r *http.Request) {
 		var uuid string
@@ -180,11 +127,7 @@ func initApi() {
 }
 
 func handleAdmin(w http.ResponseWriter, r *http.Request) {
-	_, _, rank, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
-	if rank == 0 {
-		handleError(w, r, "access denied")
-		return
-	}
+	actor := getAdminActor(r)
 
 	commandParam := r.URL.Query().Get("command")
 	if commandParam == "" {
@@ -194,23 +137,19 @@ func handleAdmin(w http.ResponseWriter, r *http.Request) {
 
 	switch commandParam {
 	case "grantbadge", "revokebadge":
-		uuidParam := r.URL.Query().Get("uuid")
-		if uuidParam == "" {
-			userParam := r.URL.Query().Get("user")
-			if userParam == "" {
-				handleError(w, r, "uuid or user not specified")
-				return
-			}
-			var err error
-			uuidParam, err = getUuidFromName(userParam)
-			if err != nil {
-				handleInternalError(w, r, err)
-				return
-			}
-			if uuidParam == "" {
-				handleError(w, r, "invalid user specified")
-				return
-			}
+		if !actor.hasPermission(permissionGrantBadge) {
+			handleError(w, r, "access denied")
+			return
+		}
+
+		uuidParam, ok := getAdminTarget(w, r)
+		if !ok {
+			return
+		}
+
+		if !actor.canActOn(uuidParam) && actor.Uuid != uuidParam {
+			handleError(w, r, "insufficient rank")
+			return
 		}
 
 		idParam := r.URL.Query().Get("id")
@@ -240,35 +179,31 @@ func handleAdmin(w http.ResponseWriter, r *http.Request) {
 
 		var err error
 		if commandParam == "grantbadge" {
-			err = unlockPlayerBadge(uuidParam, idParam)
+			err = adminUnlockPlayerBadge(uuidParam, idParam)
 		} else {
-			err = removePlayerBadge(uuidParam, idParam)
+			err = adminRemovePlayerBadge(uuidParam, idParam)
 		}
 		if err != nil {
 			handleInternalError(w, r, err)
 			return
 		}
 	case "resetpw":
-		uuidParam := r.URL.Query().Get("uuid")
-		if uuidParam == "" {
-			userParam := r.URL.Query().Get("user")
-			if userParam == "" {
-				handleError(w, r, "uuid or user not specified")
-				return
-			}
-			var err error
-			uuidParam, err = getUuidFromName(userParam)
-			if err != nil {
-				handleInternalError(w, r, err)
-				return
-			}
-			if uuidParam == "" {
-				handleError(w, r, "invalid user specified")
-				return
-			}
+		if !actor.hasPermission(permissionResetPassword) {
+			handleError(w, r, "access denied")
+			return
+		}
+
+		uuidParam, ok := getAdminTarget(w, r)
+		if !ok {
+			return
+		}
+
+		if !actor.canActOn(uuidParam) {
+			handleError(w, r, "insufficient rank")
+			return
 		}
 
-		newPw, err := handleResetPw(uuidParam)
+		newPw, err := adminResetPlayerPassword(uuidParam)
 		if err != nil {
 			handleInternalError(w, r, err)
 			return
@@ -276,6 +211,13 @@ func handleAdmin(w http.ResponseWriter, r *http.Request) {
 
 		w.Write([]byte(newPw))
 		return
+	case "reloadminigames":
+		if !actor.hasPermission(permissionManageEvents) {
+			handleError(w, r, "access denied")
+			return
+		}
+
+		reloadMinigames()
 	default:
 		handleError(w, r, "unknown command")
 		return
@@ -286,6 +228,7 @@ func handleAdmin(w http.ResponseWriter, r *http.Request) {
 
 func handleParty(w http.ResponseWriter, r *http.Request) {
 	var uuid string
+	var name string
 	var rank int
 	var banned bool
 
@@ -293,7 +236,7 @@ func handleParty(w http.ResponseWriter, r *http.Request) {
 	if token == "" {
 		uuid, banned, _ = getOrCreatePlayerData(getIp(r))
 	} else {
-		uuid, _, rank, _, banned, _ = getPlayerDataFromToken(token)
+		uuid, name, rank, _, banned, _ = getPlayerDataFromToken(token)
 		if uuid == "" {
 			handleError(w, r, "invalid token")
 			return
@@ -321,12 +264,7 @@ func handleParty(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(strconv.Itoa(partyId)))
 		return
 	case "list":
-		partyListData, err := getAllPartyData()
-		if err != nil {
-			handleInternalError(w, r, err)
-			return
-		}
-		partyListDataJson, err := json.Marshal(partyListData)
+		partyListDataJson, err := getAllPartyDataJson()
 		if err != nil {
 			handleInternalError(w, r, err)
 			return
@@ -344,11 +282,12 @@ func handleParty(w http.ResponseWriter, r *http.Request) {
 			handleError(w, r, "invalid partyId value")
 			return
 		}
-		party, ok := parties[partyId]
-		if !ok {
-			handleInternalError(w, r, errors.New("party id not in cache"))
+		description, err := getPartyDescription(partyId)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
 		}
-		w.Write([]byte(party.Description))
+		w.Write([]byte(description))
 		return
 	case "create", "update":
 		partyId, err := getPlayerPartyId(uuid)
@@ -403,7 +342,7 @@ func handleParty(w http.ResponseWriter, r *http.Request) {
 		if !public {
 			passParam := r.URL.Query().Get("pass")
 			if passParam != "" {
-				if len(passParam) > 255 {
+				if len(passParam) > 72 { // bcrypt limit
 					handleError(w, r, "pass too long")
 					return
 				}
@@ -449,36 +388,388 @@ func handleParty(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if rank == 0 {
-			party, ok := parties[partyId]
-			if !ok {
-				handleInternalError(w, r, errors.New("party id not in cache"))
+			public, err := isPartyPublic(partyId)
+			if err != nil {
+				handleInternalError(w, r, err)
 				return
 			}
-			if !party.Public {
+			if !public {
 				passParam := r.URL.Query().Get("pass")
 				if passParam == "" {
 					handleError(w, r, "pass not specified")
 					return
 				}
-				if party.Pass != "" && passParam != party.Pass {
+				validPass, err := checkPartyPass(partyId, passParam)
+				if err != nil {
+					handleInternalError(w, r, err)
+					return
+				}
+				if !validPass {
 					http.Error(w, "401 - Unauthorized", http.StatusUnauthorized)
 					return
 				}
 			}
 		}
+		full, err := isPartyFull(partyId)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if full {
+			handleError(w, r, "party is full")
+			return
+		}
+		playerPartyId, err := getPlayerPartyId(uuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if playerPartyId != 0 {
+			err = handlePartyMemberLeave(playerPartyId, uuid)
+			if err != nil {
+				handleInternalError(w, r, err)
+				return
+			}
+		}
+		err = joinPlayerParty(partyId, uuid)
+		if err == errPartyFull {
+			handleError(w, r, err.Error())
+			return
+		}
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+	case "invite":
+		partyId, err := getPlayerPartyId(uuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if partyId == 0 {
+			handleError(w, r, "player not in a party")
+			return
+		}
+		ownerUuid, err := getPartyOwnerUuid(partyId)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if ownerUuid != uuid {
+			officer, err := isPartyOfficer(partyId, uuid)
+			if err != nil {
+				handleInternalError(w, r, err)
+				return
+			}
+			if !officer {
+				handleError(w, r, "attempted party invite from non-owner or officer")
+				return
+			}
+		}
+		playerParam := r.URL.Query().Get("player")
+		if playerParam == "" {
+			handleError(w, r, "player not specified")
+			return
+		}
+		exists, err := playerExists(playerParam)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if !exists {
+			handleError(w, r, "specified player not found")
+			return
+		}
+		playerPartyId, err := getPlayerPartyId(playerParam)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if playerPartyId == partyId {
+			handleError(w, r, "specified player already in party")
+			return
+		}
+		partyName, err := getPartyName(partyId)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		full, err := isPartyFull(partyId)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if full {
+			handleError(w, r, "party is full")
+			return
+		}
+		err = createPartyInvite(partyId, playerParam, uuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		sendPartyInvite(&PartyInvite{
+			PartyId:     partyId,
+			PartyName:   partyName,
+			Uuid:        playerParam,
+			Name:        getNameFromUuid(playerParam),
+			InviterUuid: uuid,
+			InviterName: name,
+			Expiration:  time.Now().UTC().Add(time.Duration(config.party.inviteExpiryHours) * time.Hour),
+		})
+	case "invites":
+		partyInvites, err := getPlayerPartyInvites(uuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		partyInvitesJson, err := json.Marshal(partyInvites)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		w.Write(partyInvitesJson)
+		return
+	case "acceptInvite", "declineInvite", "request":
+		partyIdParam := r.URL.Query().Get("partyId")
+		if partyIdParam == "" {
+			handleError(w, r, "partyId not specified")
+			return
+		}
+		partyId, err := strconv.Atoi(partyIdParam)
+		if err != nil {
+			handleError(w, r, "invalid partyId value")
+			return
+		}
+		if commandParam == "declineInvite" {
+			err = deletePartyInvite(partyId, uuid)
+			if err != nil {
+				handleInternalError(w, r, err)
+				return
+			}
+			break
+		}
+		full, err := isPartyFull(partyId)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if full {
+			handleError(w, r, "party is full")
+			return
+		}
+		if commandParam == "request" {
+			if _, err := getPartyName(partyId); err != nil {
+				if err == sql.ErrNoRows {
+					handleError(w, r, "invalid partyId value")
+					return
+				}
+				handleInternalError(w, r, err)
+				return
+			}
+			playerPartyId, err := getPlayerPartyId(uuid)
+			if err != nil {
+				handleInternalError(w, r, err)
+				return
+			}
+			if playerPartyId == partyId {
+				handleError(w, r, "player already in party")
+				return
+			}
+			err = createPartyJoinRequest(partyId, uuid)
+			if err != nil {
+				handleInternalError(w, r, err)
+				return
+			}
+			sendPartyJoinRequest(&PartyJoinRequest{
+				PartyId:    partyId,
+				Uuid:       uuid,
+				Name:       getNameFromUuid(uuid),
+				Expiration: time.Now().UTC().Add(time.Duration(config.party.inviteExpiryHours) * time.Hour),
+			})
+			break
+		}
+		invited, err := hasPartyInvite(partyId, uuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if !invited {
+			handleError(w, r, "no invite for specified party")
+			return
+		}
 		playerPartyId, err := getPlayerPartyId(uuid)
 		if err != nil {
 			handleInternalError(w, r, err)
 			return
 		}
 		if playerPartyId != 0 {
-			err = handlePartyMemberLeave(partyId, uuid)
+			err = handlePartyMemberLeave(playerPartyId, uuid)
 			if err != nil {
 				handleInternalError(w, r, err)
 				return
 			}
 		}
 		err = joinPlayerParty(partyId, uuid)
+		if err == errPartyFull {
+			handleError(w, r, err.Error())
+			return
+		}
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+	case "requests":
+		partyId, err := getPlayerPartyId(uuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if partyId == 0 {
+			handleError(w, r, "player not in a party")
+			return
+		}
+		ownerUuid, err := getPartyOwnerUuid(partyId)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if ownerUuid != uuid {
+			officer, err := isPartyOfficer(partyId, uuid)
+			if err != nil {
+				handleInternalError(w, r, err)
+				return
+			}
+			if !officer {
+				handleError(w, r, "attempted to list join requests from non-owner or officer")
+				return
+			}
+		}
+		partyJoinRequests, err := getPartyJoinRequests(partyId)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		partyJoinRequestsJson, err := json.Marshal(partyJoinRequests)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		w.Write(partyJoinRequestsJson)
+		return
+	case "approve", "deny":
+		partyId, err := getPlayerPartyId(uuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if partyId == 0 {
+			handleError(w, r, "player not in a party")
+			return
+		}
+		ownerUuid, err := getPartyOwnerUuid(partyId)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if ownerUuid != uuid {
+			handleError(w, r, "attempted join request response from non-owner")
+			return
+		}
+		playerParam := r.URL.Query().Get("player")
+		if playerParam == "" {
+			handleError(w, r, "player not specified")
+			return
+		}
+		requested, err := hasPartyJoinRequest(partyId, playerParam)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if !requested {
+			handleError(w, r, "no join request from specified player")
+			return
+		}
+		approve := commandParam == "approve"
+		if approve {
+			full, err := isPartyFull(partyId)
+			if err != nil {
+				handleInternalError(w, r, err)
+				return
+			}
+			if full {
+				handleError(w, r, "party is full")
+				return
+			}
+			playerPartyId, err := getPlayerPartyId(playerParam)
+			if err != nil {
+				handleInternalError(w, r, err)
+				return
+			}
+			if playerPartyId != 0 {
+				err = handlePartyMemberLeave(playerPartyId, playerParam)
+				if err != nil {
+					handleInternalError(w, r, err)
+					return
+				}
+			}
+			err = joinPlayerParty(partyId, playerParam)
+		} else {
+			err = deletePartyJoinRequest(partyId, playerParam)
+		}
+		if err == errPartyFull {
+			handleError(w, r, err.Error())
+			return
+		}
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if client, ok := clients.Load(playerParam); ok {
+			select {
+			case client.send <- buildMsg("pjrr", partyId, approve):
+			default:
+				writeErrLog(client.uuid, "sess", "send channel is full")
+			}
+		}
+	case "promote", "demote":
+		partyId, err := getPlayerPartyId(uuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if partyId == 0 {
+			handleError(w, r, "player not in a party")
+			return
+		}
+		ownerUuid, err := getPartyOwnerUuid(partyId)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if ownerUuid != uuid {
+			handleError(w, r, "attempted officer change from non-owner")
+			return
+		}
+		playerParam := r.URL.Query().Get("player")
+		if playerParam == "" {
+			handleError(w, r, "player not specified")
+			return
+		}
+		if playerParam == ownerUuid {
+			handleError(w, r, "owner cannot be an officer")
+			return
+		}
+		playerPartyId, err := getPlayerPartyId(playerParam)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if playerPartyId != partyId {
+			handleError(w, r, "specified player not in same party")
+			return
+		}
+		err = setPartyOfficer(partyId, playerParam, commandParam == "promote")
 		if err != nil {
 			handleInternalError(w, r, err)
 			return
@@ -514,7 +805,15 @@ func handleParty(w http.ResponseWriter, r *http.Request) {
 			handleInternalError(w, r, err)
 			return
 		}
-		if ownerUuid != uuid {
+		var officer bool
+		if ownerUuid != uuid && kick {
+			officer, err = isPartyOfficer(partyId, uuid)
+			if err != nil {
+				handleInternalError(w, r, err)
+				return
+			}
+		}
+		if ownerUuid != uuid && !officer {
 			if kick {
 				handleError(w, r, "attempted party kick non-owner")
 			} else {
@@ -527,6 +826,18 @@ func handleParty(w http.ResponseWriter, r *http.Request) {
 			handleError(w, r, "player not specified")
 			return
 		}
+		if officer {
+			// officers can only kick regular members
+			targetOfficer, err := isPartyOfficer(partyId, playerParam)
+			if err != nil {
+				handleInternalError(w, r, err)
+				return
+			}
+			if playerParam == ownerUuid || targetOfficer {
+				handleError(w, r, "attempted party kick of owner or officer from officer")
+				return
+			}
+		}
 		playerPartyId, err := getPlayerPartyId(playerParam)
 		if err != nil {
 			handleInternalError(w, r, err)
@@ -1035,13 +1346,13 @@ func handleChangePw(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, loginUser, rank, _, _, _ := getPlayerInfoFromToken(token)
+	loginUuid, loginUser, rank, _, _, _ := getPlayerInfoFromToken(token)
 
 	// GET params user, new password
 	user, newPassword := r.URL.Query().Get("user"), r.URL.Query().Get("newPassword")
 
 	var username string
-	if rank < 1 || user == "" {
+	if user == "" || user == loginUser {
 		username = loginUser
 
 		// GET param password
@@ -1065,6 +1376,31 @@ func handleChangePw(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// setting another player's password requires the permission and a higher rank
+		loginPermissions, err := getPlayerPermissions(loginUuid, rank)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if loginUuid == "" || !loginPermissions[permissionResetPassword] {
+			handleError(w, r, "access denied")
+			return
+		}
+
+		userUuid, err := getUuidFromName(user)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if userUuid == "" {
+			handleError(w, r, "invalid user specified")
+			return
+		}
+		if rank <= getPlayerRank(userUuid) {
+			handleError(w, r, "insufficient rank")
+			return
+		}
+
 		username = user
 	}
 
@@ -1156,12 +1492,48 @@ func handleChatHistory(w http.ResponseWriter, r *http.Request) {
 		partyMsgLimit = 250
 	}
 
+	directMsgLimitParam := r.URL.Query().Get("directMsgLimit")
+	if directMsgLimitParam == "" {
+		directMsgLimitParam = "100"
+	}
+
+	directMsgLimit, err := strconv.Atoi(directMsgLimitParam)
+	if err != nil {
+		handleError(w, r, "invalid directMsgLimit value")
+		return
+	}
+
+	if directMsgLimit <= 0 || directMsgLimit > 100 {
+		directMsgLimit = 100
+	}
+
 	chatHistory, err := getChatMessageHistory(uuid, globalMsgLimit, partyMsgLimit, lastMsgId)
 	if err != nil {
 		handleInternalError(w, r, err)
 		return
 	}
 
+	directMessageHistory, err := getDirectMessageHistory(uuid, directMsgLimit)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	chatHistory.DirectMessages = directMessageHistory.DirectMessages
+
+	for _, directMessagePlayer := range directMessageHistory.Players {
+		var found bool
+		for _, chatPlayer := range chatHistory.Players {
+			if chatPlayer.Uuid == directMessagePlayer.Uuid {
+				found = true
+				break
+			}
+		}
+		if !found {
+			chatHistory.Players = append(chatHistory.Players, directMessagePlayer)
+		}
+	}
+
 	chatHistoryJson, err := json.Marshal(chatHistory)
 	if err != nil {
 		handleInternalError(w, r, err)
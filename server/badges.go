@@ -193,8 +193,9 @@ type PlayerBadge struct {
 }
 
 type TimeTrialRecord struct {
-	MapId   int `json:"mapId"`
-	Seconds int `json:"seconds"`
+	Game    string `json:"-"`
+	MapId   int    `json:"mapId"`
+	Seconds int    `json:"seconds"`
 }
 
 func initBadges() {
@@ -288,7 +289,7 @@ func (c *RoomClient) checkRoomConditions(trigger string, value string) {
 	}
 
 	for _, condition := range c.room.conditions {
-		c.checkCondition(condition, c.room.id, c.room.minigames, trigger, value)
+		c.checkCondition(condition, c.room.id, c.room.getMinigames(), trigger, value)
 	}
 }
 
@@ -353,8 +354,7 @@ func (c *RoomClient) checkCondition(condition *Condition, roomId int, minigames
 			}
 			c.send <- buildMsg("sv", varId, varSyncType)
 		} else if c.checkConditionCoords(condition) {
-			timeTrial := condition.TimeTrial && config.gameName == "2kki"
-			if !timeTrial {
+			if !condition.TimeTrial || !c.startTimeTrial() {
 				success, err := tryWritePlayerTag(c.sClient.uuid, condition.ConditionId)
 				if err != nil {
 					writeErrLog(c.sClient.uuid, c.mapId, err.Error())
@@ -362,8 +362,6 @@ func (c *RoomClient) checkCondition(condition *Condition, roomId int, minigames
 				if success {
 					c.send <- buildMsg("b")
 				}
-			} else {
-				c.send <- buildMsg("ss", 1430, 0)
 			}
 		}
 	} else if trigger == "" {
@@ -430,6 +428,7 @@ func getPlayerBadgeData(playerUuid string, playerRank int, playerTags []string,
 	var playerEventVmCount int
 	var playerBadgeCount int
 	var timeTrialRecords []*TimeTrialRecord
+	var minigameBadgeIds map[string]bool
 	var medalCounts [5]int
 
 	if account {
@@ -453,6 +452,11 @@ func getPlayerBadgeData(playerUuid string, playerRank int, playerTags []string,
 		if err != nil {
 			return playerBadges, err
 		}
+		minigameScores, err := getPlayerMinigameScores(playerUuid)
+		if err != nil {
+			return playerBadges, err
+		}
+		minigameBadgeIds = getMinigameBadgeIds(minigameScores)
 		medalCounts = getPlayerMedals(playerUuid)
 	}
 
@@ -540,7 +544,7 @@ func getPlayerBadgeData(playerUuid string, playerRank int, playerTags []string,
 				case "timeTrial":
 					playerBadge.Seconds = gameBadge.ReqInt
 					for _, record := range timeTrialRecords {
-						if record.MapId == gameBadge.Map {
+						if record.Game == game && record.MapId == gameBadge.Map {
 							playerBadge.Unlocked = record.Seconds < gameBadge.ReqInt
 						}
 					}
@@ -556,6 +560,10 @@ func getPlayerBadgeData(playerUuid string, playerRank int, playerTags []string,
 					}
 				}
 
+				if !playerBadge.Unlocked && minigameBadgeIds[badgeId] {
+					playerBadge.Unlocked = true
+				}
+
 				if !playerBadge.Unlocked {
 					if playerBadge.GoalsTotal > 0 && playerBadge.Goals >= playerBadge.GoalsTotal {
 						playerBadge.Unlocked = true
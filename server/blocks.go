@@ -0,0 +1,270 @@
+/*
+	Copyright (C) 2021-2023  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type PlayerBlock struct {
+	Uuid         string    `json:"uuid"`
+	Name         string    `json:"name"`
+	HidePresence bool      `json:"hidePresence"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// loadBlocks caches the players a client has blocked, mapped to whether their
+// room presence is hidden
+func (c *SessionClient) loadBlocks() {
+	blocks := make(map[string]bool)
+
+	playerBlocks, err := getPlayerBlocks(c.uuid)
+	if err != nil {
+		writeErrLog(c.uuid, "sess", err.Error())
+	}
+
+	for _, playerBlock := range playerBlocks {
+		blocks[playerBlock.Uuid] = playerBlock.HidePresence
+	}
+
+	c.blocksMtx.Lock()
+	c.blocks = blocks
+	c.blocksMtx.Unlock()
+}
+
+// isBlocking checks whether a client has blocked a player
+func (c *SessionClient) isBlocking(uuid string) bool {
+	c.blocksMtx.RLock()
+	defer c.blocksMtx.RUnlock()
+
+	_, ok := c.blocks[uuid]
+	return ok
+}
+
+// isHidingPresence checks whether a client has blocked a player and hidden
+// them from rooms
+func (c *SessionClient) isHidingPresence(uuid string) bool {
+	c.blocksMtx.RLock()
+	defer c.blocksMtx.RUnlock()
+
+	return c.blocks[uuid]
+}
+
+// setBlock updates a client's cached block of a player, and has the room
+// client show or hide the player if they share a room
+func (c *SessionClient) setBlock(uuid string, blocked, hidePresence bool) {
+	wasHiding := c.isHidingPresence(uuid)
+
+	c.blocksMtx.Lock()
+	if blocked {
+		c.blocks[uuid] = hidePresence
+	} else {
+		delete(c.blocks, uuid)
+	}
+	c.blocksMtx.Unlock()
+
+	hiding := blocked && hidePresence
+	if hiding == wasHiding {
+		return
+	}
+
+	rClient := c.rClient
+	if rClient == nil {
+		return
+	}
+
+	// room state is only touched by the room client's processor
+	select {
+	case rClient.presenceUpdates <- uuid:
+	default:
+		writeErrLog(c.uuid, "sess", "presence update channel is full")
+	}
+}
+
+// updatePresence shows or hides a player sharing the room depending on
+// whether the client is hiding their presence
+func (c *RoomClient) updatePresence(uuid string) {
+	if c.room == nil {
+		return
+	}
+
+	hiding := c.sClient.isHidingPresence(uuid)
+
+	for _, otherClient := range c.room.clients {
+		if otherClient.sClient.uuid != uuid {
+			continue
+		}
+
+		if hiding {
+			c.send <- buildMsg("d", otherClient.sClient.id)
+		} else {
+			c.sendPlayerData(otherClient)
+		}
+	}
+}
+
+func handleBlock(w http.ResponseWriter, r *http.Request) {
+	var uuid string
+	var banned bool
+
+	token := r.Header.Get("Authorization")
+	if token == "" {
+		uuid, banned, _ = getOrCreatePlayerData(getIp(r))
+	} else {
+		uuid, _, _, _, banned, _ = getPlayerDataFromToken(token)
+		if uuid == "" {
+			handleError(w, r, "invalid token")
+			return
+		}
+	}
+
+	if banned {
+		handleError(w, r, "player is banned")
+		return
+	}
+
+	commandParam := r.URL.Query().Get("command")
+	if commandParam == "" {
+		handleError(w, r, "command not specified")
+		return
+	}
+
+	switch commandParam {
+	case "list":
+		playerBlocks, err := getPlayerBlocks(uuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		if playerBlocks == nil {
+			playerBlocks = []*PlayerBlock{}
+		}
+
+		playerBlocksJson, err := json.Marshal(playerBlocks)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		w.Write(playerBlocksJson)
+		return
+	case "block", "unblock":
+		targetUuid := r.URL.Query().Get("uuid")
+		if targetUuid == "" {
+			handleError(w, r, "uuid not specified")
+			return
+		}
+
+		if targetUuid == uuid {
+			handleError(w, r, "cannot block self")
+			return
+		}
+
+		if commandParam == "block" {
+			exists, err := playerExists(targetUuid)
+			if err != nil {
+				handleInternalError(w, r, err)
+				return
+			}
+			if !exists {
+				handleError(w, r, "player not found")
+				return
+			}
+
+			hidePresence := r.URL.Query().Get("hidePresence") == "1"
+
+			err = writePlayerBlock(uuid, targetUuid, hidePresence)
+			if err != nil {
+				handleInternalError(w, r, err)
+				return
+			}
+
+			if client, ok := clients.Load(uuid); ok {
+				client.setBlock(targetUuid, true, hidePresence)
+			}
+		} else {
+			err := deletePlayerBlock(uuid, targetUuid)
+			if err != nil {
+				handleInternalError(w, r, err)
+				return
+			}
+
+			if client, ok := clients.Load(uuid); ok {
+				client.setBlock(targetUuid, false, false)
+			}
+		}
+	default:
+		handleError(w, r, "unknown command")
+		return
+	}
+
+	w.Write([]byte("ok"))
+}
+
+func getPlayerBlocks(uuid string) (playerBlocks []*PlayerBlock, err error) {
+	results, err := db.Query("SELECT pb.targetUuid, COALESCE(a.user, pgd.name, ''), pb.hidePresence, pb.timestamp FROM playerBlocks pb LEFT JOIN accounts a ON a.uuid = pb.targetUuid LEFT JOIN playerGameData pgd ON pgd.uuid = pb.targetUuid AND pgd.game = ? WHERE pb.uuid = ? ORDER BY pb.timestamp", config.gameName, uuid)
+	if err != nil {
+		return playerBlocks, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		playerBlock := &PlayerBlock{}
+
+		err := results.Scan(&playerBlock.Uuid, &playerBlock.Name, &playerBlock.HidePresence, &playerBlock.Timestamp)
+		if err != nil {
+			return playerBlocks, err
+		}
+
+		playerBlocks = append(playerBlocks, playerBlock)
+	}
+
+	return playerBlocks, nil
+}
+
+func writePlayerBlock(uuid, targetUuid string, hidePresence bool) error {
+	_, err := db.Exec("INSERT INTO playerBlocks (uuid, targetUuid, hidePresence, timestamp) VALUES (?, ?, ?, UTC_TIMESTAMP()) ON DUPLICATE KEY UPDATE hidePresence = ?", uuid, targetUuid, hidePresence, hidePresence)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func deletePlayerBlock(uuid, targetUuid string) error {
+	_, err := db.Exec("DELETE FROM playerBlocks WHERE uuid = ? AND targetUuid = ?", uuid, targetUuid)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// isPlayerBlockedEither checks whether either of two players has blocked the other
+func isPlayerBlockedEither(uuid, targetUuid string) (blocked bool, err error) {
+	err = db.QueryRow("SELECT EXISTS (SELECT * FROM playerBlocks WHERE (uuid = ? AND targetUuid = ?) OR (uuid = ? AND targetUuid = ?))", uuid, targetUuid, targetUuid, uuid).Scan(&blocked)
+	if err != nil {
+		return false, err
+	}
+
+	return blocked, nil
+}
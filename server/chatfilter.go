@@ -0,0 +1,496 @@
+/*
+	Copyright (C) 2021-2023  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	chatFilterActionReplace = "replace"
+	chatFilterActionBlock   = "block"
+	chatFilterActionMute    = "mute"
+)
+
+var (
+	// lookalike characters folded into their ASCII equivalents before matching
+	chatConfusables = map[rune]rune{
+		'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'і': 'i', 'ї': 'i', 'ј': 'j', 'ѕ': 's', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w', 'ɡ': 'g',
+		'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x', 'ω': 'w',
+		'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '@': 'a', '$': 's', '!': 'i', '|': 'l',
+	}
+
+	chatLinkRegex = regexp.MustCompile(`(?i)(?:https?://|www\.)[^\s/]+\S*|\b[a-z0-9-]+(?:\.[a-z0-9-]+)*\.(?:com|net|org|gg|io|xyz|ru|co|me|ly|tk|info|link|app|dev|site|top)\b\S*`)
+
+	// the filters applied to each chat message in order
+	chatFilters = []ChatFilter{
+		filterChatFlood,
+		filterChatRepeat,
+		filterChatWords,
+		filterChatLinks,
+	}
+)
+
+type ChatFilterRule struct {
+	expr   string
+	regex  *regexp.Regexp
+	action string
+}
+
+type ChatFilterConfig struct {
+	rules []*ChatFilterRule
+
+	linkAction         string
+	allowedLinkDomains []string
+
+	floodBurst         int
+	floodRefillSeconds float64
+	repeatLimit        int
+
+	offenceLimit         int
+	offenceWindowMinutes int
+	muteMinutes          []int
+}
+
+// ChatFilterState holds the chat history of a client used by the filters
+type ChatFilterState struct {
+	mtx sync.Mutex
+
+	tokens        float64
+	tokensUpdated time.Time
+
+	lastMsg     string
+	repeatCount int
+
+	offences       []time.Time
+	muteExpiration time.Time
+}
+
+// ChatFilter checks a message, returning the contents to send and the action
+// taken along with a reason if the message was changed or stopped
+type ChatFilter func(c *SessionClient, contents string) (filtered string, action string, reason string)
+
+type ChatFilterLogEntry struct {
+	Uuid        string    `json:"uuid"`
+	Name        string    `json:"name"`
+	Game        string    `json:"game"`
+	Scope       string    `json:"scope"`
+	Action      string    `json:"action"`
+	Reason      string    `json:"reason"`
+	Contents    string    `json:"contents"`
+	MuteMinutes int       `json:"muteMinutes"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// getChatFilterWordExpr gets the expression matching a plain word only as a
+// whole word, leaving out boundaries next to characters that aren't ASCII word
+// characters since those never border one
+func getChatFilterWordExpr(word string) string {
+	expr := regexp.QuoteMeta(word)
+
+	if r, _ := utf8.DecodeRuneInString(word); isAsciiWordChar(r) {
+		expr = `\b` + expr
+	}
+	if r, _ := utf8.DecodeLastRuneInString(word); isAsciiWordChar(r) {
+		expr += `\b`
+	}
+
+	return expr
+}
+
+func isAsciiWordChar(r rune) bool {
+	return r == '_' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+func newChatFilterRule(expr string, action string) *ChatFilterRule {
+	switch action {
+	case "":
+		action = chatFilterActionBlock
+	case chatFilterActionReplace, chatFilterActionBlock:
+	default:
+		panic("invalid chat filter action: " + action)
+	}
+
+	return &ChatFilterRule{
+		expr:   expr,
+		regex:  regexp.MustCompile("(?i)" + expr),
+		action: action,
+	}
+}
+
+// normalizeChatMsg lowercases a message, folds fullwidth forms and, if
+// foldConfusables is set, confusable characters, and drops invisible ones,
+// returning the normalized runes with the index of the original rune each
+// came from
+func normalizeChatMsg(contents string, foldConfusables bool) (normalized []rune, origIdxs []int) {
+	for i, r := range []rune(contents) {
+		if unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Cf, r) {
+			continue
+		}
+
+		// fullwidth forms
+		if r >= 0xFF01 && r <= 0xFF5E {
+			r -= 0xFEE0
+		}
+
+		r = unicode.ToLower(r)
+		if folded, ok := chatConfusables[r]; ok && foldConfusables {
+			r = folded
+		}
+
+		normalized = append(normalized, r)
+		origIdxs = append(origIdxs, i)
+	}
+
+	return normalized, origIdxs
+}
+
+// findChatMatches finds the ranges of original runes in a message matching a
+// regex after normalization
+func findChatMatches(contents string, regex *regexp.Regexp, foldConfusables bool) (ranges [][2]int) {
+	normalized, origIdxs := normalizeChatMsg(contents, foldConfusables)
+	normalizedStr := string(normalized)
+
+	for _, match := range regex.FindAllStringIndex(normalizedStr, -1) {
+		if match[0] == match[1] {
+			continue
+		}
+
+		start := utf8.RuneCountInString(normalizedStr[:match[0]])
+		end := start + utf8.RuneCountInString(normalizedStr[match[0]:match[1]])
+
+		ranges = append(ranges, [2]int{origIdxs[start], origIdxs[end-1] + 1})
+	}
+
+	return ranges
+}
+
+// censorChatMatches replaces the runes in the given ranges of a message with
+// asterisks
+func censorChatMatches(contents string, ranges [][2]int) string {
+	runes := []rune(contents)
+	for _, r := range ranges {
+		for i := r[0]; i < r[1]; i++ {
+			if !unicode.IsSpace(runes[i]) {
+				runes[i] = '*'
+			}
+		}
+	}
+
+	return string(runes)
+}
+
+func filterChatFlood(c *SessionClient, contents string) (string, string, string) {
+	state := &c.chatFilter
+	now := time.Now()
+
+	if state.tokensUpdated.IsZero() {
+		state.tokens = float64(config.chatFilter.floodBurst)
+	} else {
+		state.tokens += now.Sub(state.tokensUpdated).Seconds() / config.chatFilter.floodRefillSeconds
+		if state.tokens > float64(config.chatFilter.floodBurst) {
+			state.tokens = float64(config.chatFilter.floodBurst)
+		}
+	}
+	state.tokensUpdated = now
+
+	if state.tokens < 1 {
+		return contents, chatFilterActionBlock, "flood"
+	}
+
+	state.tokens--
+
+	return contents, "", ""
+}
+
+func filterChatRepeat(c *SessionClient, contents string) (string, string, string) {
+	state := &c.chatFilter
+
+	normalized, _ := normalizeChatMsg(contents, true)
+	normalizedStr := strings.Join(strings.Fields(string(normalized)), " ")
+
+	if normalizedStr == state.lastMsg {
+		state.repeatCount++
+	} else {
+		state.lastMsg = normalizedStr
+		state.repeatCount = 1
+	}
+
+	if state.repeatCount > config.chatFilter.repeatLimit {
+		return contents, chatFilterActionBlock, "repeat"
+	}
+
+	return contents, "", ""
+}
+
+func filterChatWords(c *SessionClient, contents string) (string, string, string) {
+	var action, reason string
+
+	for _, rule := range config.chatFilter.rules {
+		ranges := findChatMatches(contents, rule.regex, true)
+		if len(ranges) == 0 {
+			continue
+		}
+
+		if rule.action == chatFilterActionBlock {
+			return contents, chatFilterActionBlock, "word: " + rule.expr
+		}
+
+		contents = censorChatMatches(contents, ranges)
+		action = chatFilterActionReplace
+		reason = "word: " + rule.expr
+	}
+
+	return contents, action, reason
+}
+
+func filterChatLinks(c *SessionClient, contents string) (string, string, string) {
+	if config.chatFilter.linkAction == "" {
+		return contents, "", ""
+	}
+
+	var ranges [][2]int
+
+	// confusables are left alone as folding digits and symbols would mangle
+	// domains and paths
+	for _, r := range findChatMatches(contents, chatLinkRegex, false) {
+		if isAllowedChatLink(string([]rune(contents)[r[0]:r[1]])) {
+			continue
+		}
+		ranges = append(ranges, r)
+	}
+
+	if len(ranges) == 0 {
+		return contents, "", ""
+	}
+
+	if config.chatFilter.linkAction == chatFilterActionBlock {
+		return contents, chatFilterActionBlock, "link"
+	}
+
+	return censorChatMatches(contents, ranges), chatFilterActionReplace, "link"
+}
+
+func isAllowedChatLink(link string) bool {
+	normalized, _ := normalizeChatMsg(link, false)
+	link = string(normalized)
+	link = strings.TrimPrefix(link, "https://")
+	link = strings.TrimPrefix(link, "http://")
+	link = strings.TrimPrefix(link, "www.")
+
+	host, _, _ := strings.Cut(link, "/")
+
+	for _, domain := range config.chatFilter.allowedLinkDomains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loadChatFilterState restores an automatic mute still in effect when a
+// client connects
+func (c *SessionClient) loadChatFilterState() {
+	muteExpiration, err := getChatFilterMuteExpiration(c.uuid)
+	if err != nil {
+		writeErrLog(c.uuid, "sess", err.Error())
+		return
+	}
+
+	c.chatFilter.muteExpiration = muteExpiration
+}
+
+// filterChatMsg runs a message through the chat filters, returning the
+// contents to send or an error if the message was stopped
+func (c *SessionClient) filterChatMsg(scope string, contents string) (string, error) {
+	c.chatFilter.mtx.Lock()
+	defer c.chatFilter.mtx.Unlock()
+
+	if time.Now().Before(c.chatFilter.muteExpiration) {
+		return "", errors.New("player is muted by chat filter")
+	}
+
+	original := contents
+
+	for _, filter := range chatFilters {
+		var action, reason string
+		contents, action, reason = filter(c, contents)
+
+		switch action {
+		case chatFilterActionReplace:
+			c.logChatFilterAction(scope, action, reason, original, 0)
+		case chatFilterActionBlock:
+			c.logChatFilterAction(scope, action, reason, original, 0)
+			c.send <- buildMsg("cfb", scope, reason)
+
+			c.addChatOffence(scope, original)
+
+			return "", errors.New("message blocked by chat filter: " + reason)
+		}
+	}
+
+	return contents, nil
+}
+
+// addChatOffence counts a blocked message against a client, muting them once
+// they pass the offence limit with a duration that grows with each mute
+func (c *SessionClient) addChatOffence(scope string, contents string) {
+	state := &c.chatFilter
+	now := time.Now()
+	windowStart := now.Add(-time.Duration(config.chatFilter.offenceWindowMinutes) * time.Minute)
+
+	offences := state.offences[:0]
+	for _, offence := range state.offences {
+		if offence.After(windowStart) {
+			offences = append(offences, offence)
+		}
+	}
+	state.offences = append(offences, now)
+
+	if len(state.offences) < config.chatFilter.offenceLimit || len(config.chatFilter.muteMinutes) == 0 {
+		return
+	}
+
+	state.offences = nil
+
+	muteCount, err := getRecentChatFilterMuteCount(c.uuid)
+	if err != nil {
+		writeErrLog(c.uuid, "sess", err.Error())
+	}
+
+	if muteCount >= len(config.chatFilter.muteMinutes) {
+		muteCount = len(config.chatFilter.muteMinutes) - 1
+	}
+	muteMinutes := config.chatFilter.muteMinutes[muteCount]
+
+	state.muteExpiration = now.Add(time.Duration(muteMinutes) * time.Minute)
+
+	c.logChatFilterAction(scope, chatFilterActionMute, "offence limit", contents, muteMinutes)
+	c.send <- buildMsg("cfm", muteMinutes)
+}
+
+func (c *SessionClient) logChatFilterAction(scope string, action string, reason string, contents string, muteMinutes int) {
+	writeLog(c.uuid, "chatfilter", scope+" "+action+" ("+reason+"): "+contents, 200)
+
+	err := writeChatFilterLog(c.uuid, scope, action, reason, contents, muteMinutes)
+	if err != nil {
+		writeErrLog(c.uuid, "chatfilter", err.Error())
+	}
+}
+
+func adminChatFilterLog(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit <= 0 || limit > 500 {
+			handleError(w, r, "invalid limit value")
+			return
+		}
+	}
+
+	entries, err := getChatFilterLog(r.URL.Query().Get("uuid"), limit)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	if entries == nil {
+		entries = []*ChatFilterLogEntry{}
+	}
+
+	entriesJson, err := json.Marshal(entries)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	w.Write(entriesJson)
+}
+
+func writeChatFilterLog(uuid string, scope string, action string, reason string, contents string, muteMinutes int) error {
+	_, err := db.Exec("INSERT INTO chatFilterLog (uuid, game, scope, action, reason, contents, muteMinutes, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, UTC_TIMESTAMP())", uuid, config.gameName, scope, action, reason, contents, muteMinutes)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// getRecentChatFilterMuteCount gets how many times a player was muted by the
+// chat filter in the last 30 days
+func getRecentChatFilterMuteCount(uuid string) (count int, err error) {
+	err = db.QueryRow("SELECT COUNT(*) FROM chatFilterLog WHERE uuid = ? AND action = ? AND timestamp > DATE_ADD(UTC_TIMESTAMP(), INTERVAL -30 DAY)", uuid, chatFilterActionMute).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func getChatFilterMuteExpiration(uuid string) (expiration time.Time, err error) {
+	err = db.QueryRow("SELECT COALESCE(MAX(DATE_ADD(timestamp, INTERVAL muteMinutes MINUTE)), UTC_TIMESTAMP()) FROM chatFilterLog WHERE uuid = ? AND action = ?", uuid, chatFilterActionMute).Scan(&expiration)
+	if err != nil {
+		return expiration, err
+	}
+
+	return expiration, nil
+}
+
+func getChatFilterLog(uuid string, limit int) (entries []*ChatFilterLogEntry, err error) {
+	query := "SELECT cfl.uuid, COALESCE(a.user, pgd.name, ''), cfl.game, cfl.scope, cfl.action, cfl.reason, cfl.contents, cfl.muteMinutes, cfl.timestamp FROM chatFilterLog cfl LEFT JOIN accounts a ON a.uuid = cfl.uuid LEFT JOIN playerGameData pgd ON pgd.uuid = cfl.uuid AND pgd.game = cfl.game"
+
+	var args []any
+	if uuid != "" {
+		query += " WHERE cfl.uuid = ?"
+		args = append(args, uuid)
+	}
+
+	query += " ORDER BY cfl.timestamp DESC LIMIT ?"
+	args = append(args, limit)
+
+	results, err := db.Query(query, args...)
+	if err != nil {
+		return entries, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		entry := &ChatFilterLogEntry{}
+
+		err := results.Scan(&entry.Uuid, &entry.Name, &entry.Game, &entry.Scope, &entry.Action, &entry.Reason, &entry.Contents, &entry.MuteMinutes, &entry.Timestamp)
+		if err != nil {
+			return entries, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
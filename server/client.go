@@ -20,7 +20,9 @@ package server
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 )
@@ -30,6 +32,11 @@ const (
 	pongWait       = 60 * time.Second
 	pingPeriod     = (pongWait * 9) / 10
 	maxMessageSize = 4096
+
+	closeCodeDefault = 1028
+	closeCodeKicked  = 4002
+	closeCodeBanned  = 4003
+	closeCodeRemoved = 4004
 )
 
 type Picture struct {
@@ -57,6 +64,9 @@ type SessionClient struct {
 
 	dcOnce sync.Once
 
+	closeCode   int
+	closeReason string
+
 	writerEnd chan bool
 	writerWg  sync.WaitGroup
 
@@ -71,12 +81,25 @@ type SessionClient struct {
 	badge   string
 	medals  [5]int
 
-	muted bool
+	// muted is also set by moderation actions from the scheduler
+	muted atomic.Bool
 
 	spriteName  string
 	spriteIndex int
 
 	systemName string
+
+	partyId int
+
+	freeEventLocationMapIds    map[string][]int
+	freeEventLocationMapIdsMtx sync.RWMutex
+
+	blocks    map[string]bool
+	blocksMtx sync.RWMutex
+
+	chatFilter ChatFilterState
+
+	stats *ClientStats
 }
 
 func (c *SessionClient) msgReader() {
@@ -113,7 +136,7 @@ func (c *SessionClient) msgWriter() {
 		select {
 		case <-c.writerEnd:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(1028, ""))
+			c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(c.getCloseCode(), c.closeReason))
 
 			return
 		case message := <-c.send:
@@ -139,9 +162,12 @@ func (c *SessionClient) msgProcessor() {
 			return
 		}
 
+		c.stats.addSessionMsg()
+
 		err := c.processMsg(message)
 		if err != nil {
 			writeErrLog(c.uuid, "sess", err.Error())
+			c.stats.addError("sess", err)
 		}
 	}
 }
@@ -162,6 +188,8 @@ func (c *SessionClient) disconnect() {
 
 		c.updatePlayerGameData()
 
+		c.sendPartyMemberUpdate()
+
 		writeLog(c.uuid, "sess", "disconnect", 200)
 
 		// disconnect rClient if connected
@@ -171,6 +199,36 @@ func (c *SessionClient) disconnect() {
 	})
 }
 
+// kick disconnects a client and its room client with a close code and reason
+// for the client to show
+func (c *SessionClient) kick(closeCode int, closeReason string) {
+	// close reasons are limited to 123 bytes
+	if len(closeReason) > 123 {
+		closeReason = closeReason[:123]
+		for !utf8.ValidString(closeReason) {
+			closeReason = closeReason[:len(closeReason)-1]
+		}
+	}
+
+	if c.rClient != nil {
+		c.rClient.closeCode = closeCode
+		c.rClient.closeReason = closeReason
+	}
+
+	c.closeCode = closeCode
+	c.closeReason = closeReason
+
+	c.disconnect()
+}
+
+func (c *SessionClient) getCloseCode() int {
+	if c.closeCode == 0 {
+		return closeCodeDefault
+	}
+
+	return c.closeCode
+}
+
 // RoomClient
 type RoomClient struct {
 	room    *Room
@@ -180,11 +238,18 @@ type RoomClient struct {
 
 	dcOnce sync.Once
 
+	closeCode   int
+	closeReason string
+
 	writerEnd chan bool
 	writerWg  sync.WaitGroup
 
 	send, receive chan []byte
 
+	// presenceUpdates receives the uuids of players the session client
+	// changed the presence block of
+	presenceUpdates chan string
+
 	key, counter uint32
 
 	x, y, facing, speed int
@@ -202,7 +267,13 @@ type RoomClient struct {
 
 	syncCoords bool
 
-	minigameScores []int
+	minigameScores map[string]int
+
+	timeTrialSplits map[string][]*TimeTrialSplit
+
+	lastPartyMoveUpdate    time.Time
+	partyMoveUpdatePending bool
+	partyMoveUpdateMtx     sync.Mutex
 
 	switchCache map[int]bool
 	varCache    map[int]int
@@ -242,7 +313,7 @@ func (c *RoomClient) msgWriter() {
 		select {
 		case <-c.writerEnd:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(1028, ""))
+			c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(c.getCloseCode(), c.closeReason))
 
 			return
 		case message := <-c.send:
@@ -272,16 +343,23 @@ func (c *RoomClient) msgWriter() {
 
 func (c *RoomClient) msgProcessor() {
 	for {
-		message, ok := <-c.receive
-		if !ok {
-			return
-		}
+		select {
+		case message, ok := <-c.receive:
+			if !ok {
+				return
+			}
 
-		errs := c.processMsgs(message)
-		if len(errs) != 0 {
-			for _, err := range errs {
-				writeErrLog(c.sClient.uuid, c.mapId, err.Error())
+			c.sClient.stats.addRoomMsg()
+
+			errs := c.processMsgs(message)
+			if len(errs) != 0 {
+				for _, err := range errs {
+					writeErrLog(c.sClient.uuid, c.mapId, err.Error())
+					c.sClient.stats.addError(c.mapId, err)
+				}
 			}
+		case uuid := <-c.presenceUpdates:
+			c.updatePresence(uuid)
 		}
 	}
 }
@@ -307,6 +385,31 @@ func (c *RoomClient) disconnect() {
 	})
 }
 
+// kick disconnects a room client with a close code and reason for the client
+// to show, leaving its session connected
+func (c *RoomClient) kick(closeCode int, closeReason string) {
+	// close reasons are limited to 123 bytes
+	if len(closeReason) > 123 {
+		closeReason = closeReason[:123]
+		for !utf8.ValidString(closeReason) {
+			closeReason = closeReason[:len(closeReason)-1]
+		}
+	}
+
+	c.closeCode = closeCode
+	c.closeReason = closeReason
+
+	c.disconnect()
+}
+
+func (c *RoomClient) getCloseCode() int {
+	if c.closeCode == 0 {
+		return closeCodeDefault
+	}
+
+	return c.closeCode
+}
+
 func (c *RoomClient) reset() {
 	c.x = 0
 	c.y = 0
@@ -326,9 +429,14 @@ func (c *RoomClient) reset() {
 
 	// don't clear tags
 
+	// don't clear time trial splits, they carry over between rooms
+	if c.timeTrialSplits == nil {
+		c.timeTrialSplits = make(map[string][]*TimeTrialSplit)
+	}
+
 	c.syncCoords = false
 
-	c.minigameScores = []int{}
+	c.minigameScores = make(map[string]int)
 
 	c.switchCache = make(map[int]bool)
 	c.varCache = make(map[int]int)
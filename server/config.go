@@ -18,6 +18,7 @@
 package server
 
 import (
+	"fmt"
 	"os"
 	"strconv"
 	"strings"
@@ -35,6 +36,18 @@ type Config struct {
 	picturePrefixes []string
 	battleAnimIds   map[int]bool
 
+	spritePolicy *SpritePolicy
+
+	chatFilter *ChatFilterConfig
+
+	roles map[string][]string
+
+	party struct {
+		maxMembers            int
+		inviteExpiryHours     int
+		waypointExpiryMinutes int
+	}
+
 	signKey  []byte
 	ipHubKey string
 
@@ -55,6 +68,40 @@ type ConfigFile struct {
 	PicturePrefixes string `yaml:"picture_prefixes"`
 	BattleAnimIds   string `yaml:"battle_anim_ids"`
 
+	SpritePolicy struct {
+		Names      []string `yaml:"names"`
+		Substrings []string `yaml:"substrings"`
+		Regexes    []string `yaml:"regexes"`
+		Rooms      []struct {
+			Substring string `yaml:"substring"`
+			RoomIds   string `yaml:"room_ids"`
+		} `yaml:"rooms"`
+	} `yaml:"sprite_policy"`
+
+	ChatFilter struct {
+		Words []struct {
+			Match  string `yaml:"match"`
+			Regex  bool   `yaml:"regex"`
+			Action string `yaml:"action"`
+		} `yaml:"words"`
+		LinkAction           string   `yaml:"link_action"`
+		AllowedLinkDomains   []string `yaml:"allowed_link_domains"`
+		FloodBurst           int      `yaml:"flood_burst"`
+		FloodRefillSeconds   float64  `yaml:"flood_refill_seconds"`
+		RepeatLimit          int      `yaml:"repeat_limit"`
+		OffenceLimit         int      `yaml:"offence_limit"`
+		OffenceWindowMinutes int      `yaml:"offence_window_minutes"`
+		MuteMinutes          []int    `yaml:"mute_minutes"`
+	} `yaml:"chat_filter"`
+
+	Roles map[string][]string `yaml:"roles"`
+
+	Party struct {
+		MaxMembers            int `yaml:"max_members"`
+		InviteExpiryHours     int `yaml:"invite_expiry_hours"`
+		WaypointExpiryMinutes int `yaml:"waypoint_expiry_minutes"`
+	} `yaml:"party"`
+
 	SignKey  string `yaml:"sign_key"`
 	IpHubKey string `yaml:"iphub_key"`
 
@@ -65,7 +112,7 @@ type ConfigFile struct {
 	} `yaml:"logging"`
 }
 
-func parseConfigFile(filename string) (config *Config) {
+func parseConfigFile(filename string) (config *Config, err error) {
 	yamlFile, err := os.ReadFile(filename)
 	if err != nil {
 		panic(err)
@@ -124,6 +171,91 @@ func parseConfigFile(filename string) (config *Config) {
 		}
 	}
 
+	config.spritePolicy, err = newSpritePolicy(configFile.SpritePolicy.Names, configFile.SpritePolicy.Substrings, configFile.SpritePolicy.Regexes)
+	if err != nil {
+		return nil, err
+	}
+	for _, room := range configFile.SpritePolicy.Rooms {
+		roomIds, err := parseSpriteRoomIds(room.RoomIds)
+		if err != nil {
+			return nil, fmt.Errorf("%w for substring %q", err, room.Substring)
+		}
+
+		config.spritePolicy.addRoomRestriction(room.Substring, roomIds)
+	}
+
+	config.chatFilter = &ChatFilterConfig{
+		allowedLinkDomains: configFile.ChatFilter.AllowedLinkDomains,
+		muteMinutes:        configFile.ChatFilter.MuteMinutes,
+	}
+	for _, word := range configFile.ChatFilter.Words {
+		expr := word.Match
+		if !word.Regex {
+			expr = getChatFilterWordExpr(expr)
+		}
+		config.chatFilter.rules = append(config.chatFilter.rules, newChatFilterRule(expr, word.Action))
+	}
+	switch configFile.ChatFilter.LinkAction {
+	case "", "allow":
+	case chatFilterActionReplace, chatFilterActionBlock:
+		config.chatFilter.linkAction = configFile.ChatFilter.LinkAction
+	default:
+		panic("invalid chat filter link action: " + configFile.ChatFilter.LinkAction)
+	}
+	if configFile.ChatFilter.FloodBurst != 0 {
+		config.chatFilter.floodBurst = configFile.ChatFilter.FloodBurst
+	} else {
+		config.chatFilter.floodBurst = 5
+	}
+	if configFile.ChatFilter.FloodRefillSeconds != 0 {
+		config.chatFilter.floodRefillSeconds = configFile.ChatFilter.FloodRefillSeconds
+	} else {
+		config.chatFilter.floodRefillSeconds = 2
+	}
+	if configFile.ChatFilter.RepeatLimit != 0 {
+		config.chatFilter.repeatLimit = configFile.ChatFilter.RepeatLimit
+	} else {
+		config.chatFilter.repeatLimit = 3
+	}
+	if configFile.ChatFilter.OffenceLimit != 0 {
+		config.chatFilter.offenceLimit = configFile.ChatFilter.OffenceLimit
+	} else {
+		config.chatFilter.offenceLimit = 3
+	}
+	if configFile.ChatFilter.OffenceWindowMinutes != 0 {
+		config.chatFilter.offenceWindowMinutes = configFile.ChatFilter.OffenceWindowMinutes
+	} else {
+		config.chatFilter.offenceWindowMinutes = 10
+	}
+	if configFile.ChatFilter.MuteMinutes == nil {
+		config.chatFilter.muteMinutes = []int{5, 30, 240, 1440}
+	}
+
+	if len(configFile.Roles) != 0 {
+		config.roles = configFile.Roles
+	} else {
+		config.roles = getDefaultRoles()
+	}
+	for role, rolePermissions := range config.roles {
+		for _, permission := range rolePermissions {
+			if !isValidPermission(permission) {
+				panic("invalid permission for role " + role + ": " + permission)
+			}
+		}
+	}
+
+	config.party.maxMembers = configFile.Party.MaxMembers
+	if configFile.Party.InviteExpiryHours != 0 {
+		config.party.inviteExpiryHours = configFile.Party.InviteExpiryHours
+	} else {
+		config.party.inviteExpiryHours = 24
+	}
+	if configFile.Party.WaypointExpiryMinutes != 0 {
+		config.party.waypointExpiryMinutes = configFile.Party.WaypointExpiryMinutes
+	} else {
+		config.party.waypointExpiryMinutes = 60
+	}
+
 	config.signKey = []byte(configFile.SignKey)
 	config.ipHubKey = configFile.IpHubKey
 
@@ -143,5 +275,5 @@ func parseConfigFile(filename string) (config *Config) {
 		config.logging.maxAge = 28 // Days
 	}
 
-	return config
+	return config, nil
 }
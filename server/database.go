@@ -22,8 +22,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"math"
-	"math/rand"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -40,6 +38,32 @@ func getDatabaseConn() *sql.DB {
 	return conn
 }
 
+// dbQueryer is implemented by both *sql.DB and *sql.Tx so that queries can
+// run either on their own or as part of a transaction
+type dbQueryer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// runInTx runs queries in a transaction, which is committed if fn returns no
+// error and rolled back otherwise
+func runInTx(fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
 func getOrCreatePlayerData(ip string) (uuid string, banned bool, muted bool) {
 	err := db.QueryRow("SELECT uuid, banned, muted FROM players WHERE ip = ?", ip).Scan(&uuid, &banned, &muted)
 	if err != nil {
@@ -83,7 +107,7 @@ func getPlayerRank(uuid string) (rank int) {
 	return rank
 }
 
-func tryBanPlayer(senderUuid string, recipientUuid string) error { // called by api only
+func tryBanPlayer(senderUuid string, recipientUuid string, reason string, duration time.Duration) error { // called by api only
 	if getPlayerRank(senderUuid) <= getPlayerRank(recipientUuid) {
 		return errors.New("insufficient rank")
 	}
@@ -97,18 +121,20 @@ func tryBanPlayer(senderUuid string, recipientUuid string) error { // called by
 		return err
 	}
 
-	if client, ok := clients.Load(recipientUuid); ok {
-		if client.rClient != nil {
-			client.rClient.disconnect()
-		}
+	err = writeModerationAction(senderUuid, recipientUuid, moderationActionBan, reason, duration)
+	if err != nil {
+		return err
+	}
 
-		client.disconnect()
+	err = notifyModerationAction(recipientUuid, moderationActionBan, reason)
+	if err != nil {
+		return err
 	}
 
 	return nil
 }
 
-func tryUnbanPlayer(senderUuid string, recipientUuid string) error { // called by api only
+func tryUnbanPlayer(senderUuid string, recipientUuid string, reason string) error { // called by api only
 	if getPlayerRank(senderUuid) <= getPlayerRank(recipientUuid) {
 		return errors.New("insufficient rank")
 	}
@@ -122,10 +148,15 @@ func tryUnbanPlayer(senderUuid string, recipientUuid string) error { // called b
 		return err
 	}
 
+	err = writeModerationAction(senderUuid, recipientUuid, moderationActionUnban, reason, 0)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
-func tryMutePlayer(senderUuid string, recipientUuid string) error { // called by api only
+func tryMutePlayer(senderUuid string, recipientUuid string, reason string, duration time.Duration) error { // called by api only
 	if getPlayerRank(senderUuid) <= getPlayerRank(recipientUuid) {
 		return errors.New("insufficient rank")
 	}
@@ -139,14 +170,20 @@ func tryMutePlayer(senderUuid string, recipientUuid string) error { // called by
 		return err
 	}
 
-	if client, ok := clients.Load(recipientUuid); ok { // mute client if they're connected
-		client.muted = true
+	err = writeModerationAction(senderUuid, recipientUuid, moderationActionMute, reason, duration)
+	if err != nil {
+		return err
+	}
+
+	err = notifyModerationAction(recipientUuid, moderationActionMute, reason)
+	if err != nil {
+		return err
 	}
 
 	return nil
 }
 
-func tryUnmutePlayer(senderUuid string, recipientUuid string) error { // called by api only
+func tryUnmutePlayer(senderUuid string, recipientUuid string, reason string) error { // called by api only
 	if getPlayerRank(senderUuid) <= getPlayerRank(recipientUuid) {
 		return errors.New("insufficient rank")
 	}
@@ -160,8 +197,14 @@ func tryUnmutePlayer(senderUuid string, recipientUuid string) error { // called
 		return err
 	}
 
-	if client, ok := clients.Load(recipientUuid); ok { // unmute client if they're connected
-		client.muted = false
+	err = writeModerationAction(senderUuid, recipientUuid, moderationActionUnmute, reason, 0)
+	if err != nil {
+		return err
+	}
+
+	err = notifyModerationAction(recipientUuid, moderationActionUnmute, reason)
+	if err != nil {
+		return err
 	}
 
 	return nil
@@ -478,7 +521,7 @@ func getChatMessageHistory(uuid string, globalMsgLimit, partyMsgLimit int, lastM
 
 	fromClause := " FROM chatMessages cm JOIN players pd ON pd.uuid = cm.uuid JOIN playerGameData pgd ON pgd.uuid = pd.uuid AND pgd.game = cm.game "
 
-	whereClause := "WHERE cm.game = ? AND pd.banned = 0"
+	whereClause := "WHERE cm.game = ? AND pd.banned = 0 AND NOT EXISTS (SELECT * FROM playerBlocks pb WHERE pb.uuid = ? AND pb.targetUuid = cm.uuid)"
 
 	if lastMsgId != "" {
 		whereClause += " AND cm.timestamp > (SELECT cm2.timestamp FROM chatMessages cm2 WHERE cm2.msgId = ?)"
@@ -489,7 +532,7 @@ func getChatMessageHistory(uuid string, globalMsgLimit, partyMsgLimit int, lastM
 
 	var messageQueryArgs []interface{}
 
-	messageQueryArgs = append(messageQueryArgs, config.gameName)
+	messageQueryArgs = append(messageQueryArgs, config.gameName, uuid)
 
 	if lastMsgId != "" {
 		messageQueryArgs = append(messageQueryArgs, lastMsgId)
@@ -502,7 +545,7 @@ func getChatMessageHistory(uuid string, globalMsgLimit, partyMsgLimit int, lastM
 	if partyId == 0 {
 		query += globalSelectClause + fromClause + globalWhereClause + " LIMIT ?"
 	} else {
-		messageQueryArgs = append(messageQueryArgs, config.gameName)
+		messageQueryArgs = append(messageQueryArgs, config.gameName, uuid)
 
 		if lastMsgId != "" {
 			messageQueryArgs = append(messageQueryArgs, lastMsgId)
@@ -667,71 +710,58 @@ func setCurrentGameEventPeriodId() error {
 	return nil
 }
 
-func getRandomGameForEventLocation(pool map[string][]*EventLocationData, eventLocationCountThreshold int) (gameId string, err error) {
+// getGamePlayerCounts returns the average player count of each game in the
+// current event period
+func getGamePlayerCounts() (gamePlayerCounts map[string]int, err error) {
+	gamePlayerCounts = make(map[string]int)
+
 	results, err := db.Query("SELECT CEIL(AVG(gpc.playerCount)), gpc.game FROM gamePlayerCounts gpc JOIN gameEventPeriods gep ON gep.periodId = ? AND gep.game = gpc.game GROUP BY gpc.game", currentEventPeriodId)
 	if err != nil {
-		return "", err
+		return gamePlayerCounts, err
 	}
 
 	defer results.Close()
 
-	var playerCounts []int
-	var gameIds []string
-	totalPlayerCount := 0
-
 	for results.Next() {
-		var currentPlayerCount int
-		var currentGameId string
+		var playerCount int
+		var gameId string
 
-		err = results.Scan(&currentPlayerCount, &currentGameId)
+		err = results.Scan(&playerCount, &gameId)
 		if err != nil {
-			return "", err
-		}
-
-		// Ignore games with no event locations in the current pool
-		if eventLocations, ok := pool[currentGameId]; currentGameId != "2kki" && (!ok || len(eventLocations) < eventLocationCountThreshold) {
-			continue
+			return gamePlayerCounts, err
 		}
 
-		if currentPlayerCount == 0 {
-			currentPlayerCount = 1
-		}
-
-		totalPlayerCount += currentPlayerCount
-
-		playerCounts = append(playerCounts, currentPlayerCount)
-		gameIds = append(gameIds, currentGameId)
+		gamePlayerCounts[gameId] = playerCount
 	}
 
-	avgPlayerCount := int(math.Ceil(float64(totalPlayerCount) / float64(len(gameIds))))
-
-	var poolThresholds []int
-	gamePool := make(map[int]string)
-	totalPoolValue := 0
-
-	poolCommonValue := int(math.Ceil(float64(avgPlayerCount) * gameEventShareFactor))
-
-	for i, count := range playerCounts {
-		poolValue := int(math.Floor(float64(count)*(1-gameEventShareFactor))) + poolCommonValue
-		poolThreshold := poolValue + totalPoolValue
+	return gamePlayerCounts, nil
+}
 
-		gamePool[poolThreshold] = gameIds[i]
-		poolThresholds = append(poolThresholds, poolThreshold)
+// getAverageGamePlayerCounts gets the average recorded player count of every
+// game regardless of the current event period
+func getAverageGamePlayerCounts() (gamePlayerCounts map[string]int, err error) {
+	gamePlayerCounts = make(map[string]int)
 
-		totalPoolValue += poolValue
+	results, err := db.Query("SELECT CEIL(AVG(playerCount)), game FROM gamePlayerCounts GROUP BY game")
+	if err != nil {
+		return gamePlayerCounts, err
 	}
 
-	rand.Seed(time.Now().Unix())
-	randValue := rand.Intn(totalPoolValue)
+	defer results.Close()
 
-	for _, value := range poolThresholds {
-		if randValue < value {
-			gameId = gamePool[value]
-			break
+	for results.Next() {
+		var playerCount int
+		var gameId string
+
+		err = results.Scan(&playerCount, &gameId)
+		if err != nil {
+			return gamePlayerCounts, err
 		}
+
+		gamePlayerCounts[gameId] = playerCount
 	}
 
-	return gameId, nil
+	return gamePlayerCounts, nil
 }
 
 func getPlayerEventExpData(playerUuid string) (eventExp EventExp, err error) {
@@ -810,18 +840,18 @@ func getPlayerEventLocationCompletion(playerUuid string) (eventLocationCompletio
 	return eventLocationCompletion, nil
 }
 
-func getOrWriteLocationIdForEventLocation(gameEventPeriodId int, title string, titleJP string, depth int, minDepth int, mapIds []string) (locationId int, err error) {
+func getOrWriteLocationIdForEventLocation(q dbQueryer, gameEventPeriodId int, title string, titleJP string, depth int, minDepth int, mapIds []string) (locationId int, err error) {
 	mapIdsJson, err := json.Marshal(mapIds)
 	if err != nil {
 		return locationId, err
 	}
 
-	_, err = db.Exec("INSERT INTO gameLocations (game, title, titleJP, depth, minDepth, mapIds) VALUES (?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE titleJP = titleJP, depth = depth, minDepth = minDepth, mapIds = mapIds", config.gameName, title, titleJP, depth, minDepth, mapIdsJson)
+	_, err = q.Exec("INSERT INTO gameLocations (game, title, titleJP, depth, minDepth, mapIds) SELECT gep.game, ?, ?, ?, ?, ? FROM gameEventPeriods gep WHERE gep.id = ? ON DUPLICATE KEY UPDATE titleJP = titleJP, depth = depth, minDepth = minDepth, mapIds = mapIds", title, titleJP, depth, minDepth, mapIdsJson, gameEventPeriodId)
 	if err != nil {
 		return locationId, err
 	}
 
-	db.QueryRow("SELECT l.id FROM gameLocations l JOIN gameEventPeriods gep ON gep.game = l.game WHERE gep.id = ? AND l.title = ?", gameEventPeriodId, title).Scan(&locationId)
+	q.QueryRow("SELECT l.id FROM gameLocations l JOIN gameEventPeriods gep ON gep.game = l.game WHERE gep.id = ? AND l.title = ?", gameEventPeriodId, title).Scan(&locationId)
 
 	return locationId, nil
 }
@@ -841,7 +871,7 @@ func getOrWriteLocationIdForPlayerEventLocation(gameEventPeriodId int, playerUui
 		}
 	}
 
-	locationId, err = getOrWriteLocationIdForEventLocation(gameEventPeriodId, title, titleJP, depth, minDepth, mapIds)
+	locationId, err = getOrWriteLocationIdForEventLocation(db, gameEventPeriodId, title, titleJP, depth, minDepth, mapIds)
 	if err != nil {
 		return locationId, err
 	}
@@ -854,33 +884,13 @@ func getOrWriteLocationIdForPlayerEventLocation(gameEventPeriodId int, playerUui
 	return locationId, nil
 }
 
-func writeEventLocationData(gameEventPeriodId int, eventType int, title string, titleJP string, depth int, minDepth int, exp int, mapIds []string) error {
-	var days int
-	var offsetDays int
-	weekday := time.Now().UTC().Weekday()
-	switch eventType {
-	case 0:
-		days = 1
-	case 1:
-		days = 7
-		offsetDays = int(weekday)
-	default:
-		if weekday == time.Friday || weekday == time.Saturday {
-			days = 2
-			offsetDays = int(weekday - time.Friday)
-		} else {
-			return nil
-		}
-	}
-
-	days -= offsetDays
-
-	locationId, err := getOrWriteLocationIdForEventLocation(gameEventPeriodId, title, titleJP, depth, minDepth, mapIds)
+func writeEventLocationData(q dbQueryer, gameEventPeriodId int, eventType int, title string, titleJP string, depth int, minDepth int, exp int, mapIds []string, startDate time.Time, endDate time.Time) error {
+	locationId, err := getOrWriteLocationIdForEventLocation(q, gameEventPeriodId, title, titleJP, depth, minDepth, mapIds)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec("INSERT INTO eventLocations (locationId, gamePeriodId, type, exp, startDate, endDate) VALUES (?, ?, ?, ?, DATE_SUB(UTC_DATE(), INTERVAL ? DAY), DATE_ADD(UTC_DATE(), INTERVAL ? DAY))", locationId, gameEventPeriodId, eventType, exp, offsetDays, days)
+	_, err = q.Exec("INSERT INTO eventLocations (locationId, gamePeriodId, type, exp, startDate, endDate) VALUES (?, ?, ?, ?, ?, ?)", locationId, gameEventPeriodId, eventType, exp, startDate, endDate)
 	if err != nil {
 		return err
 	}
@@ -977,7 +987,7 @@ func tryCompleteEventLocation(playerUuid string, location string) (exp int, err
 		}
 
 		for results.Next() {
-			var eventId string
+			var eventId int
 			var eventType int
 			var eventExp int
 			var mapIdsJson string
@@ -997,14 +1007,10 @@ func tryCompleteEventLocation(playerUuid string, location string) (exp int, err
 				if client.rClient.mapId != mapId {
 					continue
 				}
-				if weekEventExp >= weeklyExpCap {
-					eventExp = 0
-				} else if weekEventExp+eventExp > weeklyExpCap {
-					eventExp = weeklyExpCap - weekEventExp
-				}
+				eventExp = eventSchedule.capExp(weekEventExp, eventExp)
 
-				_, err = db.Exec("INSERT INTO eventCompletions (eventId, uuid, type, timestampCompleted, exp) VALUES (?, ?, 0, ?, ?)", eventId, playerUuid, time.Now(), eventExp)
-				if err != nil {
+				completed, err := writeEventLocationCompletion(eventId, playerUuid, eventExp)
+				if err != nil || !completed {
 					break
 				}
 
@@ -1038,7 +1044,7 @@ func tryCompletePlayerEventLocation(playerUuid string, location string) (success
 		defer results.Close()
 
 		for results.Next() {
-			var eventId string
+			var eventId int
 			var mapIdsJson string
 
 			err := results.Scan(&eventId, &mapIdsJson)
@@ -1057,12 +1063,10 @@ func tryCompletePlayerEventLocation(playerUuid string, location string) (success
 					continue
 				}
 
-				_, err = db.Exec("INSERT INTO eventCompletions (eventId, uuid, type, timestampCompleted, exp) VALUES (?, ?, 1, ?, 0)", eventId, playerUuid, time.Now())
-				if err != nil {
-					break
+				completed, err := writePlayerEventLocationCompletion(eventId, playerUuid)
+				if err == nil && completed {
+					success = true
 				}
-
-				success = true
 				break
 			}
 		}
@@ -1073,6 +1077,107 @@ func tryCompletePlayerEventLocation(playerUuid string, location string) (success
 	return false, err
 }
 
+// writeEventLocationCompletion completes an expedition for a player unless
+// they have already completed it
+func writeEventLocationCompletion(eventId int, playerUuid string, exp int) (completed bool, err error) {
+	result, err := db.Exec("INSERT IGNORE INTO eventCompletions (eventId, uuid, type, timestampCompleted, exp) VALUES (?, ?, 0, ?, ?)", eventId, playerUuid, time.Now(), exp)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows > 0, nil
+}
+
+func writePlayerEventLocationCompletion(eventId int, playerUuid string) (completed bool, err error) {
+	result, err := db.Exec("INSERT IGNORE INTO eventCompletions (eventId, uuid, type, timestampCompleted, exp) VALUES (?, ?, 1, ?, 0)", eventId, playerUuid, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows > 0, nil
+}
+
+// getCurrentEventLocationMapIndex returns the active expeditions of the
+// current game by map ID
+func getCurrentEventLocationMapIndex() (mapIndex map[string][]*EventLocationTarget, err error) {
+	mapIndex = make(map[string][]*EventLocationTarget)
+
+	results, err := db.Query("SELECT el.id, el.exp, l.mapIds FROM eventLocations el JOIN gameLocations l ON l.id = el.locationId WHERE el.gamePeriodId = ? AND UTC_DATE() >= el.startDate AND UTC_DATE() < el.endDate", currentGameEventPeriodId)
+	if err != nil {
+		return mapIndex, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		target := &EventLocationTarget{}
+
+		var mapIdsJson string
+
+		err := results.Scan(&target.Id, &target.Exp, &mapIdsJson)
+		if err != nil {
+			return mapIndex, err
+		}
+
+		var mapIds []string
+		err = json.Unmarshal([]byte(mapIdsJson), &mapIds)
+		if err != nil {
+			return mapIndex, err
+		}
+
+		for _, mapId := range mapIds {
+			mapIndex[mapId] = append(mapIndex[mapId], target)
+		}
+	}
+
+	return mapIndex, nil
+}
+
+// getPlayerFreeEventLocationMapIndex returns the IDs of the player's
+// incomplete free expeditions by map ID
+func getPlayerFreeEventLocationMapIndex(playerUuid string) (mapIndex map[string][]int, err error) {
+	mapIndex = make(map[string][]int)
+
+	results, err := db.Query("SELECT pel.id, pl.mapIds FROM playerEventLocations pel JOIN gameLocations pl ON pl.id = pel.locationId LEFT JOIN eventCompletions ec ON ec.eventId = pel.id AND ec.type = 1 AND ec.uuid = pel.uuid WHERE pel.gamePeriodId = ? AND pel.uuid = ? AND ec.uuid IS NULL AND UTC_DATE() >= pel.startDate AND UTC_DATE() < pel.endDate", currentGameEventPeriodId, playerUuid)
+	if err != nil {
+		return mapIndex, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		var eventId int
+		var mapIdsJson string
+
+		err := results.Scan(&eventId, &mapIdsJson)
+		if err != nil {
+			return mapIndex, err
+		}
+
+		var mapIds []string
+		err = json.Unmarshal([]byte(mapIdsJson), &mapIds)
+		if err != nil {
+			return mapIndex, err
+		}
+
+		for _, mapId := range mapIds {
+			mapIndex[mapId] = append(mapIndex[mapId], eventId)
+		}
+	}
+
+	return mapIndex, nil
+}
+
 func getPlayerEventVmCount(playerUuid string) (eventVmCount int, err error) {
 	err = db.QueryRow("SELECT COUNT(eventId) FROM eventCompletions WHERE uuid = ? AND type = 2", playerUuid).Scan(&eventVmCount)
 	if err != nil {
@@ -1119,26 +1224,8 @@ func getEventVmInfo(id int) (mapId int, eventId int, err error) {
 	return mapId, eventId, nil
 }
 
-func writeEventVmData(mapId int, eventId int, exp int) error {
-	var days int
-	var offsetDays int
-	weekday := time.Now().UTC().Weekday()
-
-	switch weekday {
-	case time.Sunday, time.Monday:
-		days = 2
-		offsetDays = int(weekday)
-	case time.Tuesday, time.Wednesday, time.Thursday:
-		days = 3
-		offsetDays = int(weekday - time.Tuesday)
-	case time.Friday, time.Saturday:
-		days = 2
-		offsetDays = int(weekday - time.Friday)
-	}
-
-	days -= offsetDays
-
-	_, err := db.Exec("INSERT INTO eventVms (gamePeriodId, mapId, eventId, exp, startDate, endDate) VALUES (?, ?, ?, ?, DATE_SUB(UTC_DATE(), INTERVAL ? DAY), DATE_ADD(UTC_DATE(), INTERVAL ? DAY))", currentGameEventPeriodId, mapId, eventId, exp, offsetDays, days)
+func writeEventVmData(q dbQueryer, mapId int, eventId int, exp int, startDate time.Time, endDate time.Time) error {
+	_, err := q.Exec("INSERT INTO eventVms (gamePeriodId, mapId, eventId, exp, startDate, endDate) VALUES (?, ?, ?, ?, ?, ?)", currentGameEventPeriodId, mapId, eventId, exp, startDate, endDate)
 	if err != nil {
 		return err
 	}
@@ -1192,11 +1279,7 @@ func tryCompleteEventVm(playerUuid string, mapId int, eventId int) (exp int, err
 			if client.rClient.mapId != fmt.Sprintf("%04d", eventMapId) {
 				continue
 			}
-			if weekEventExp >= weeklyExpCap {
-				eventExp = 0
-			} else if weekEventExp+eventExp > weeklyExpCap {
-				eventExp = weeklyExpCap - weekEventExp
-			}
+			eventExp = eventSchedule.capExp(weekEventExp, eventExp)
 
 			_, err = db.Exec("INSERT INTO eventCompletions (eventId, uuid, type, timestampCompleted, exp) VALUES (?, ?, 2, ?, ?)", eventId, playerUuid, time.Now(), eventExp)
 			if err != nil {
@@ -1368,7 +1451,7 @@ func tryWritePlayerTag(playerUuid string, name string) (success bool, err error)
 }
 
 func getPlayerTimeTrialRecords(playerUuid string) (timeTrialRecords []*TimeTrialRecord, err error) {
-	results, err := db.Query("SELECT mapId, MIN(seconds) FROM playerTimeTrials WHERE uuid = ? GROUP BY mapId", playerUuid)
+	results, err := db.Query("SELECT game, mapId, MIN(seconds) FROM playerTimeTrialRuns WHERE uuid = ? GROUP BY game, mapId", playerUuid)
 	if err != nil {
 		return timeTrialRecords, err
 	}
@@ -1378,7 +1461,7 @@ func getPlayerTimeTrialRecords(playerUuid string) (timeTrialRecords []*TimeTrial
 	for results.Next() {
 		timeTrialRecord := &TimeTrialRecord{}
 
-		err := results.Scan(&timeTrialRecord.MapId, &timeTrialRecord.Seconds)
+		err := results.Scan(&timeTrialRecord.Game, &timeTrialRecord.MapId, &timeTrialRecord.Seconds)
 		if err != nil {
 			return timeTrialRecords, err
 		}
@@ -1389,31 +1472,6 @@ func getPlayerTimeTrialRecords(playerUuid string) (timeTrialRecords []*TimeTrial
 	return timeTrialRecords, nil
 }
 
-func tryWritePlayerTimeTrial(playerUuid string, mapId int, seconds int) (success bool, err error) {
-	var prevSeconds int
-	err = db.QueryRow("SELECT seconds FROM playerTimeTrials WHERE uuid = ? AND mapId = ?", playerUuid, mapId).Scan(&prevSeconds)
-	if err != nil {
-		if err != sql.ErrNoRows {
-			return false, err
-		}
-	} else if seconds >= prevSeconds {
-		return false, nil
-	} else {
-		_, err = db.Exec("UPDATE playerTimeTrials SET seconds = ?, timestampCompleted = ? WHERE uuid = ? AND mapId = ?", seconds, time.Now(), playerUuid, mapId)
-		if err != nil {
-			return false, err
-		}
-		return true, nil
-	}
-
-	_, err = db.Exec("INSERT INTO playerTimeTrials (uuid, mapId, seconds, timestampCompleted) VALUES (?, ?, ?, ?)", playerUuid, mapId, seconds, time.Now())
-	if err != nil {
-		return false, err
-	}
-
-	return true, nil
-}
-
 /*func getGameMinigameIds() (minigameIds []string, err error) {
 	results, err := db.Query("SELECT DISTINCT minigameId FROM playerMinigameScores WHERE game = ? ORDER BY minigameId", serverConfig.GameName)
 	if err != nil {
@@ -1447,25 +1505,53 @@ func getPlayerMinigameScore(playerUuid string, minigameId string) (score int, er
 	return score, nil
 }
 
-func tryWritePlayerMinigameScore(playerUuid string, minigameId string, score int) (success bool, err error) {
-	if score <= 0 {
+func getPlayerMinigameScores(playerUuid string) (minigameScores map[string]map[string]int, err error) {
+	minigameScores = make(map[string]map[string]int)
+
+	results, err := db.Query("SELECT game, minigameId, score FROM playerMinigameScores WHERE uuid = ?", playerUuid)
+	if err != nil {
+		return minigameScores, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		var game, minigameId string
+		var score int
+
+		err := results.Scan(&game, &minigameId, &score)
+		if err != nil {
+			return minigameScores, err
+		}
+
+		if _, ok := minigameScores[game]; !ok {
+			minigameScores[game] = make(map[string]int)
+		}
+		minigameScores[game][minigameId] = score
+	}
+
+	return minigameScores, nil
+}
+
+func tryWritePlayerMinigameScore(playerUuid string, minigame *Minigame, score int) (success bool, err error) {
+	if !minigame.isValidScore(score) {
 		return false, nil
 	}
 
-	prevScore, err := getPlayerMinigameScore(playerUuid, minigameId)
+	prevScore, err := getPlayerMinigameScore(playerUuid, minigame.Id)
 	if err != nil {
 		return false, err
-	} else if score <= prevScore {
+	} else if !minigame.isBetterScore(prevScore, score) {
 		return false, nil
 	} else if prevScore > 0 {
-		_, err = db.Exec("UPDATE playerMinigameScores SET score = ?, timestampCompleted = ? WHERE uuid = ? AND game = ? AND minigameId = ?", score, time.Now(), playerUuid, config.gameName, minigameId)
+		_, err = db.Exec("UPDATE playerMinigameScores SET score = ?, timestampCompleted = ? WHERE uuid = ? AND game = ? AND minigameId = ?", score, time.Now(), playerUuid, config.gameName, minigame.Id)
 		if err != nil {
 			return false, err
 		}
 		return true, nil
 	}
 
-	_, err = db.Exec("INSERT INTO playerMinigameScores (uuid, game, minigameId, score, timestampCompleted) VALUES (?, ?, ?, ?, ?)", playerUuid, config.gameName, minigameId, score, time.Now())
+	_, err = db.Exec("INSERT INTO playerMinigameScores (uuid, game, minigameId, score, timestampCompleted) VALUES (?, ?, ?, ?, ?)", playerUuid, config.gameName, minigame.Id, score, time.Now())
 	if err != nil {
 		return false, err
 	}
@@ -1473,16 +1559,19 @@ func tryWritePlayerMinigameScore(playerUuid string, minigameId string, score int
 	return true, nil
 }
 
-func getModeratedPlayers(action int) (players []PlayerInfo) {
+func getModeratedPlayers(action int) (players []ModeratedPlayer) {
 	var actionStr string
+	var moderationAction string
 
 	if action == 0 {
 		actionStr = "banned"
+		moderationAction = moderationActionBan
 	} else {
 		actionStr = "muted"
+		moderationAction = moderationActionMute
 	}
 
-	results, err := db.Query("SELECT uuid, rank FROM players WHERE " + actionStr + " = 1")
+	results, err := db.Query("SELECT pd.uuid, pd.rank, COALESCE(ma.reason, ''), ma.timestampExpired IS NOT NULL, COALESCE(ma.timestampExpired, UTC_TIMESTAMP()) FROM players pd LEFT JOIN moderationActions ma ON ma.targetUuid = pd.uuid AND ma.action = ? AND ma.expired = 0 WHERE pd."+actionStr+" = 1", moderationAction)
 	if err != nil {
 		return players
 	}
@@ -1492,17 +1581,26 @@ func getModeratedPlayers(action int) (players []PlayerInfo) {
 	for results.Next() {
 		var uuid string
 		var rank int
+		var reason string
+		var hasExpiration bool
+		var expiration time.Time
 
-		err := results.Scan(&uuid, &rank)
+		err := results.Scan(&uuid, &rank, &reason, &hasExpiration, &expiration)
 		if err != nil {
 			return players
 		}
 
-		players = append(players, PlayerInfo{
-			Uuid: uuid,
-			Name: getNameFromUuid(uuid),
-			Rank: rank,
-		})
+		player := ModeratedPlayer{
+			Uuid:   uuid,
+			Name:   getNameFromUuid(uuid),
+			Rank:   rank,
+			Reason: reason,
+		}
+		if hasExpiration {
+			player.Expiration = &expiration
+		}
+
+		players = append(players, player)
 	}
 
 	return players
@@ -1520,6 +1618,27 @@ func getUuidFromName(name string) (uuid string, err error) {
 	return uuid, nil
 }
 
+func getUuidFromMsgId(msgId string) (uuid string, err error) {
+	err = db.QueryRow("(SELECT uuid FROM chatMessages WHERE msgId = ?) UNION ALL (SELECT uuid FROM chatMessagesArchive WHERE msgId = ?) LIMIT 1", msgId, msgId).Scan(&uuid)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return uuid, nil
+}
+
+func playerExists(uuid string) (exists bool, err error) {
+	err = db.QueryRow("SELECT EXISTS (SELECT * FROM players WHERE uuid = ?)", uuid).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
 func getNameFromUuid(uuid string) (name string) {
 	// get name from sessionClients if they're connected
 	if client, ok := clients.Load(uuid); ok {
@@ -1621,6 +1740,23 @@ func doCleanupQueries() error {
 		return err
 	}
 
+	// Remove moderation notifications that every server has processed
+	_, err = db.Exec("DELETE FROM moderationNotifications WHERE timestamp < DATE_ADD(UTC_TIMESTAMP(), INTERVAL -1 DAY)")
+	if err != nil {
+		return err
+	}
+
+	// Remove party invites and join requests that have expired
+	_, err = db.Exec("DELETE FROM partyInvites WHERE timestampExpired < UTC_TIMESTAMP()")
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("DELETE FROM partyJoinRequests WHERE timestampExpired < UTC_TIMESTAMP()")
+	if err != nil {
+		return err
+	}
+
 	// Remove Yume 2kki Explorer API query cache records that have expired
 	_, err = db.Exec("DELETE FROM 2kkiApiQueries WHERE timestampExpired < CURRENT_TIMESTAMP()")
 	if err != nil {
@@ -1629,3 +1765,111 @@ func doCleanupQueries() error {
 
 	return nil
 }
+
+func writeAuditLog(uuid string, action string, details string) error {
+	_, err := db.Exec("INSERT INTO adminAuditLog (uuid, action, details, timestamp) VALUES (?, ?, ?, UTC_TIMESTAMP())", uuid, action, details)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// getLatestEventPeriodEndDate gets the end date of the latest period, or the
+// zero time if there are no periods
+func getLatestEventPeriodEndDate() (endDate time.Time, err error) {
+	var latestEndDate sql.NullTime
+
+	err = db.QueryRow("SELECT MAX(endDate) FROM eventPeriods").Scan(&latestEndDate)
+	if err != nil {
+		return endDate, err
+	}
+
+	return latestEndDate.Time, nil
+}
+
+// getUnarchivedEventPeriodIds returns the IDs of recently ended event periods
+// without archived standings
+func getUnarchivedEventPeriodIds() (periodIds []int, err error) {
+	results, err := db.Query("SELECT ep.id FROM eventPeriods ep WHERE ep.endDate <= UTC_DATE() AND ep.endDate > DATE_SUB(UTC_DATE(), INTERVAL 7 DAY) AND NOT EXISTS (SELECT * FROM eventPeriodStandings eps WHERE eps.periodId = ep.id)")
+	if err != nil {
+		return periodIds, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		var periodId int
+		err := results.Scan(&periodId)
+		if err != nil {
+			return periodIds, err
+		}
+
+		periodIds = append(periodIds, periodId)
+	}
+
+	return periodIds, nil
+}
+
+// archiveEventPeriodStandings writes the final exp, rank and expedition
+// completions of every player who earned exp in a period
+func archiveEventPeriodStandings(periodId int) error {
+	_, err := db.Exec("INSERT IGNORE INTO eventPeriodStandings (periodId, uuid, exp, rank, completions) SELECT ?, pe.uuid, pe.exp, RANK() OVER (ORDER BY pe.exp DESC), pe.completions FROM (SELECT ec.uuid, SUM(ec.exp) exp, SUM(CASE WHEN ec.type = 2 THEN 0 ELSE 1 END) completions FROM eventCompletions ec LEFT JOIN eventLocations el ON el.id = ec.eventId AND ec.type = 0 LEFT JOIN playerEventLocations pel ON pel.id = ec.eventId AND ec.type = 1 LEFT JOIN eventVms ev ON ev.id = ec.eventId AND ec.type = 2 JOIN gameEventPeriods gep ON gep.id = COALESCE(el.gamePeriodId, pel.gamePeriodId, ev.gamePeriodId) WHERE gep.periodId = ? GROUP BY ec.uuid HAVING SUM(ec.exp) > 0) pe", periodId, periodId)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func getRecentUndeliveredEventPeriodSummaryUuids() (uuids []string, err error) {
+	results, err := db.Query("SELECT DISTINCT eps.uuid FROM eventPeriodStandings eps JOIN eventPeriods ep ON ep.id = eps.periodId WHERE eps.timestampDelivered IS NULL AND ep.endDate > DATE_SUB(UTC_DATE(), INTERVAL 7 DAY)")
+	if err != nil {
+		return uuids, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		var uuid string
+		err := results.Scan(&uuid)
+		if err != nil {
+			return uuids, err
+		}
+
+		uuids = append(uuids, uuid)
+	}
+
+	return uuids, nil
+}
+
+func getUndeliveredEventPeriodSummaries(playerUuid string) (summaries []*EventPeriodSummary, err error) {
+	results, err := db.Query("SELECT ep.periodOrdinal, eps.exp, eps.rank, (SELECT COUNT(*) FROM eventPeriodStandings epsc WHERE epsc.periodId = eps.periodId), eps.completions FROM eventPeriodStandings eps JOIN eventPeriods ep ON ep.id = eps.periodId WHERE eps.uuid = ? AND eps.timestampDelivered IS NULL ORDER BY ep.periodOrdinal", playerUuid)
+	if err != nil {
+		return summaries, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		summary := &EventPeriodSummary{}
+
+		err := results.Scan(&summary.PeriodOrdinal, &summary.Exp, &summary.Rank, &summary.PlayerCount, &summary.Completions)
+		if err != nil {
+			return summaries, err
+		}
+
+		summaries = append(summaries, summary)
+	}
+
+	return summaries, nil
+}
+
+func setEventPeriodSummariesDelivered(playerUuid string) error {
+	_, err := db.Exec("UPDATE eventPeriodStandings SET timestampDelivered = UTC_TIMESTAMP() WHERE uuid = ? AND timestampDelivered IS NULL", playerUuid)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,214 @@
+/*
+	Copyright (C) 2021-2023  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+type DirectMessage struct {
+	MsgId         string    `json:"msgId"`
+	Uuid          string    `json:"uuid"`
+	RecipientUuid string    `json:"recipientUuid"`
+	Contents      string    `json:"contents"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+func (c *SessionClient) handleDm(msg []string) error {
+	if c.muted.Load() {
+		return errors.New("player is muted")
+	}
+
+	if len(msg) != 3 {
+		return errors.New("segment count mismatch")
+	}
+
+	if c.name == "" || c.systemName == "" {
+		return errors.New("no name or system graphic set")
+	}
+
+	recipientUuid := msg[1]
+	if recipientUuid == c.uuid {
+		return errors.New("cannot message self")
+	}
+
+	msgContents := strings.TrimSpace(msg[2])
+	if msgContents == "" || len(msgContents) > 150 {
+		return errors.New("invalid message")
+	}
+
+	exists, err := playerExists(recipientUuid)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("recipient not found")
+	}
+
+	blocked, err := isPlayerBlockedEither(c.uuid, recipientUuid)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return errors.New("player blocked")
+	}
+
+	msgContents, err = c.filterChatMsg("dm", msgContents)
+	if err != nil {
+		return err
+	}
+
+	msgId := randString(12)
+
+	// messages that can't be sent right away are left undelivered so that the
+	// recipient gets them with the rest of their offline messages
+	var delivered bool
+	if recipient, ok := clients.Load(recipientUuid); ok {
+		select {
+		case recipient.send <- buildMsg("p", c.uuid, c.name, c.systemName, c.rank, c.account, c.badge, c.medals[:]):
+			select {
+			case recipient.send <- buildMsg("dm", c.uuid, msgContents, msgId):
+				delivered = true
+			default:
+			}
+		default:
+		}
+
+		if !delivered {
+			writeErrLog(recipient.uuid, "sess", "send channel is full")
+		}
+	}
+
+	err = writeDirectMessage(msgId, c.uuid, recipientUuid, msgContents, delivered)
+	if err != nil {
+		return err
+	}
+
+	c.send <- buildMsg("dms", recipientUuid, msgContents, msgId)
+
+	return nil
+}
+
+// sendDirectMessages sends a player the direct messages they received while
+// offline
+func (c *SessionClient) sendDirectMessages() {
+	chatHistory, err := getUndeliveredDirectMessages(c.uuid)
+	if err != nil {
+		writeErrLog(c.uuid, "sess", err.Error())
+		return
+	}
+
+	if len(chatHistory.DirectMessages) == 0 {
+		return
+	}
+
+	for _, chatPlayer := range chatHistory.Players {
+		c.send <- buildMsg("p", chatPlayer.Uuid, chatPlayer.Name, chatPlayer.SystemName, chatPlayer.Rank, chatPlayer.Account, chatPlayer.Badge, chatPlayer.Medals[:])
+	}
+
+	for _, directMessage := range chatHistory.DirectMessages {
+		c.send <- buildMsg("dm", directMessage.Uuid, directMessage.Contents, directMessage.MsgId)
+	}
+
+	err = setDirectMessagesDelivered(c.uuid, chatHistory.DirectMessages[len(chatHistory.DirectMessages)-1].Timestamp)
+	if err != nil {
+		writeErrLog(c.uuid, "sess", err.Error())
+	}
+}
+
+func writeDirectMessage(msgId, uuid, recipientUuid, contents string, delivered bool) error {
+	_, err := db.Exec("INSERT INTO directMessages (msgId, game, uuid, recipientUuid, contents, delivered, timestamp) VALUES (?, ?, ?, ?, ?, ?, UTC_TIMESTAMP())", msgId, config.gameName, uuid, recipientUuid, contents, delivered)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func getUndeliveredDirectMessages(uuid string) (chatHistory *ChatHistory, err error) {
+	return queryDirectMessages(uuid, "dm.recipientUuid = ? AND dm.delivered = 0", 0, uuid)
+}
+
+func setDirectMessagesDelivered(uuid string, lastTimestamp time.Time) error {
+	_, err := db.Exec("UPDATE directMessages SET delivered = 1 WHERE recipientUuid = ? AND delivered = 0 AND timestamp <= ?", uuid, lastTimestamp)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func getDirectMessageHistory(uuid string, limit int) (chatHistory *ChatHistory, err error) {
+	return queryDirectMessages(uuid, "(dm.uuid = ? OR dm.recipientUuid = ?)", limit, uuid, uuid)
+}
+
+// queryDirectMessages gets the direct messages matching a condition, oldest
+// first, along with the players who sent them, leaving out messages between
+// players where either has blocked the other
+func queryDirectMessages(uuid string, condition string, limit int, args ...any) (chatHistory *ChatHistory, err error) {
+	chatHistory = &ChatHistory{}
+
+	query := "SELECT dm.msgId, dm.uuid, dm.recipientUuid, dm.contents, dm.timestamp FROM directMessages dm JOIN players pd ON pd.uuid = dm.uuid WHERE " + condition + " AND pd.banned = 0 AND NOT EXISTS (SELECT * FROM playerBlocks pb WHERE (pb.uuid = dm.uuid AND pb.targetUuid = dm.recipientUuid) OR (pb.uuid = dm.recipientUuid AND pb.targetUuid = dm.uuid)) ORDER BY dm.timestamp DESC"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	results, err := db.Query(query, args...)
+	if err != nil {
+		return chatHistory, err
+	}
+
+	defer results.Close()
+
+	playerUuids := make(map[string]bool)
+
+	for results.Next() {
+		directMessage := &DirectMessage{}
+		err := results.Scan(&directMessage.MsgId, &directMessage.Uuid, &directMessage.RecipientUuid, &directMessage.Contents, &directMessage.Timestamp)
+		if err != nil {
+			return chatHistory, err
+		}
+
+		// prepend to keep the oldest message first
+		chatHistory.DirectMessages = append([]*DirectMessage{directMessage}, chatHistory.DirectMessages...)
+
+		playerUuids[directMessage.Uuid] = true
+		playerUuids[directMessage.RecipientUuid] = true
+	}
+
+	delete(playerUuids, uuid)
+
+	for playerUuid := range playerUuids {
+		chatPlayer := &ChatPlayer{}
+		err := db.QueryRow("SELECT pd.uuid, COALESCE(a.user, pgd.name), pd.rank, CASE WHEN a.user IS NULL THEN 0 ELSE 1 END, COALESCE(a.badge, ''), pgd.systemName, pgd.medalCountBronze, pgd.medalCountSilver, pgd.medalCountGold, pgd.medalCountPlatinum, pgd.medalCountDiamond FROM players pd JOIN playerGameData pgd ON pgd.uuid = pd.uuid LEFT JOIN accounts a ON a.uuid = pd.uuid WHERE pd.uuid = ? AND pgd.game = ?", playerUuid, config.gameName).Scan(&chatPlayer.Uuid, &chatPlayer.Name, &chatPlayer.Rank, &chatPlayer.Account, &chatPlayer.Badge, &chatPlayer.SystemName, &chatPlayer.Medals[0], &chatPlayer.Medals[1], &chatPlayer.Medals[2], &chatPlayer.Medals[3], &chatPlayer.Medals[4])
+		if err != nil {
+			if err == sql.ErrNoRows {
+				// the player has not played this game
+				continue
+			}
+			return chatHistory, err
+		}
+		chatHistory.Players = append(chatHistory.Players, chatPlayer)
+	}
+
+	return chatHistory, nil
+}
@@ -0,0 +1,149 @@
+/*
+	Copyright (C) 2021-2023  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import "sync"
+
+var (
+	// map ID -> active expeditions of the current game that include the map
+	eventLocationMapIndex    map[string][]*EventLocationTarget
+	eventLocationMapIndexMtx sync.RWMutex
+)
+
+type EventLocationTarget struct {
+	Id  int
+	Exp int
+}
+
+func initEventLocationMapIndex() {
+	updateEventLocationMapIndex()
+
+	// events may be added by the host server or the admin API at any time
+	scheduler.Every(1).Minute().Do(updateEventLocationMapIndex)
+}
+
+func updateEventLocationMapIndex() {
+	var mapIndex map[string][]*EventLocationTarget
+
+	if currentGameEventPeriodId > 0 {
+		var err error
+		mapIndex, err = getCurrentEventLocationMapIndex()
+		if err != nil {
+			writeErrLog("SERVER", "eventcompletion", err.Error())
+			return
+		}
+	}
+
+	eventLocationMapIndexMtx.Lock()
+	eventLocationMapIndex = mapIndex
+	eventLocationMapIndexMtx.Unlock()
+}
+
+func getEventLocationTargets(mapId string) []*EventLocationTarget {
+	eventLocationMapIndexMtx.RLock()
+	defer eventLocationMapIndexMtx.RUnlock()
+
+	return eventLocationMapIndex[mapId]
+}
+
+// updateFreeEventLocationMapIds indexes the player's incomplete free
+// expeditions by map ID
+func (c *SessionClient) updateFreeEventLocationMapIds() {
+	mapIds, err := getPlayerFreeEventLocationMapIndex(c.uuid)
+	if err != nil {
+		writeErrLog(c.uuid, "eventcompletion", err.Error())
+		return
+	}
+
+	c.freeEventLocationMapIdsMtx.Lock()
+	c.freeEventLocationMapIds = mapIds
+	c.freeEventLocationMapIdsMtx.Unlock()
+}
+
+func (c *SessionClient) getFreeEventLocationIds(mapId string) []int {
+	c.freeEventLocationMapIdsMtx.RLock()
+	defer c.freeEventLocationMapIdsMtx.RUnlock()
+
+	return c.freeEventLocationMapIds[mapId]
+}
+
+// checkEventLocationCompletion completes any expeditions that include the
+// client's current map, so that completion doesn't depend on the client
+// sending eec
+func (c *RoomClient) checkEventLocationCompletion() {
+	if currentGameEventPeriodId <= 0 {
+		return
+	}
+
+	targets := getEventLocationTargets(c.mapId)
+	freeEventIds := c.sClient.getFreeEventLocationIds(c.mapId)
+	if len(targets) == 0 && len(freeEventIds) == 0 {
+		return
+	}
+
+	exp := -1
+
+	if len(targets) != 0 {
+		weekEventExp, err := getPlayerWeekEventExp(c.sClient.uuid)
+		if err != nil {
+			writeErrLog(c.sClient.uuid, c.mapId, err.Error())
+			return
+		}
+
+		for _, target := range targets {
+			eventExp := eventSchedule.capExp(weekEventExp, target.Exp)
+
+			completed, err := writeEventLocationCompletion(target.Id, c.sClient.uuid, eventExp)
+			if err != nil {
+				writeErrLog(c.sClient.uuid, c.mapId, err.Error())
+				continue
+			}
+			if !completed {
+				continue
+			}
+
+			if exp < 0 {
+				exp = 0
+			}
+			exp += eventExp
+			weekEventExp += eventExp
+		}
+	}
+
+	for _, eventId := range freeEventIds {
+		completed, err := writePlayerEventLocationCompletion(eventId, c.sClient.uuid)
+		if err != nil {
+			writeErrLog(c.sClient.uuid, c.mapId, err.Error())
+			continue
+		}
+		if completed && exp < 0 {
+			exp = 0
+		}
+	}
+
+	if exp < 0 {
+		return
+	}
+
+	c.sClient.send <- buildMsg("eec", exp, true)
+
+	err := c.sClient.handleE()
+	if err != nil {
+		writeErrLog(c.sClient.uuid, c.mapId, err.Error())
+	}
+}
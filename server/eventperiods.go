@@ -0,0 +1,166 @@
+/*
+	Copyright (C) 2021-2023  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+type EventPeriodSummary struct {
+	PeriodOrdinal int `json:"periodOrdinal"`
+	Exp           int `json:"exp"`
+	Rank          int `json:"rank"`
+	PlayerCount   int `json:"playerCount"`
+	Completions   int `json:"completions"`
+}
+
+func initEventPeriods() {
+	// periods are rolled over at midnight UTC by the event jobs, and
+	// summaries are archived by the host server, so check for summaries to
+	// deliver to players connected to other servers
+	scheduler.Every(5).Minutes().Do(sendEventPeriodSummaries)
+
+	if isHostServer {
+		createScheduledEventPeriod()
+		archiveEndedEventPeriods()
+	}
+}
+
+// rolloverEventPeriods refreshes the current event period on every server,
+// archives ended periods on the host server and returns whether the period
+// changed; it must be called with eventsMtx held
+func rolloverEventPeriods() (changed bool, err error) {
+	lastEventPeriodId := currentEventPeriodId
+
+	if isHostServer {
+		createScheduledEventPeriod()
+	}
+
+	err = loadEvents()
+
+	if isHostServer {
+		archiveEndedEventPeriods()
+	}
+
+	if currentEventPeriodId == lastEventPeriodId {
+		return false, err
+	}
+
+	for _, client := range clients.Get() {
+		if client.account {
+			client.handleEp()
+		}
+	}
+
+	sendEventPeriodSummaries()
+
+	return true, err
+}
+
+// createScheduledEventPeriod creates the period following the latest one from
+// the period schedule once the latest period is within its lead time of
+// ending, starting today if there is no current or upcoming period
+func createScheduledEventPeriod() {
+	if eventSchedule.Periods == nil {
+		return
+	}
+
+	latestEndDate, err := getLatestEventPeriodEndDate()
+	if err != nil {
+		writeErrLog("SERVER", "eventperiods", err.Error())
+		return
+	}
+
+	today := truncateToDate(time.Now().UTC())
+
+	if latestEndDate.After(today.AddDate(0, 0, eventSchedule.Periods.LeadDays)) {
+		return
+	}
+
+	startDate := today
+	if latestEndDate.After(today) {
+		startDate = latestEndDate
+	}
+	endDate := startDate.AddDate(0, 0, eventSchedule.Periods.Days)
+
+	periodOrdinal, err := createEventPeriod(startDate, endDate, eventSchedule.Periods.Games, eventSchedule.Periods.EnableVms)
+	if err != nil {
+		writeErrLog("SERVER", "eventperiods", err.Error())
+		return
+	}
+
+	writeLog("SERVER", "eventperiods", fmt.Sprintf("created period %d from %s to %s", periodOrdinal, startDate.Format("2006-01-02"), endDate.Format("2006-01-02")), 200)
+}
+
+func archiveEndedEventPeriods() {
+	periodIds, err := getUnarchivedEventPeriodIds()
+	if err != nil {
+		writeErrLog("SERVER", "eventperiods", err.Error())
+		return
+	}
+
+	for _, periodId := range periodIds {
+		err := archiveEventPeriodStandings(periodId)
+		if err != nil {
+			writeErrLog("SERVER", "eventperiods", err.Error())
+		}
+	}
+}
+
+func sendEventPeriodSummaries() {
+	uuids, err := getRecentUndeliveredEventPeriodSummaryUuids()
+	if err != nil {
+		writeErrLog("SERVER", "eventperiods", err.Error())
+		return
+	}
+
+	for _, uuid := range uuids {
+		if client, ok := clients.Load(uuid); ok {
+			client.sendEventPeriodSummary()
+		}
+	}
+}
+
+// sendEventPeriodSummary sends the summaries of ended periods the player has
+// not seen yet
+func (c *SessionClient) sendEventPeriodSummary() {
+	summaries, err := getUndeliveredEventPeriodSummaries(c.uuid)
+	if err != nil {
+		writeErrLog(c.uuid, "eventperiods", err.Error())
+		return
+	}
+
+	for _, summary := range summaries {
+		summaryJson, err := json.Marshal(summary)
+		if err != nil {
+			writeErrLog(c.uuid, "eventperiods", err.Error())
+			return
+		}
+
+		c.send <- buildMsg("eps", summaryJson)
+	}
+
+	if len(summaries) != 0 {
+		err := setEventPeriodSummariesDelivered(c.uuid)
+		if err != nil {
+			writeErrLog(c.uuid, "eventperiods", err.Error())
+		}
+	}
+}
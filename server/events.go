@@ -18,14 +18,16 @@
 package server
 
 import (
+	"database/sql"
 	"encoding/json"
-	"io"
+	"errors"
 	"math"
 	"math/rand"
-	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -79,191 +81,301 @@ type EventLocationData struct {
 	Ignored  bool     `json:"ignored"`
 }
 
-const (
-	dailyEventLocationMinDepth = 2
-	dailyEventLocationMaxDepth = 3
-	dailyEventLocationExp      = 1
-
-	dailyEventLocation2MinDepth = 4
-	dailyEventLocation2MaxDepth = 6
-	dailyEventLocation2Exp      = 3
-
-	weeklyEventLocationMinDepth = 7
-	weeklyEventLocationMaxDepth = 10
-	weeklyEventLocationExp      = 10
-
-	weekendEventLocationMinDepth = 6
-	weekendEventLocationMaxDepth = 9
-	weekendEventLocationExp      = 5
-
-	eventLocationCountDailyThreshold   = 8
-	eventLocationCountWeeklyThreshold  = 3
-	eventLocationCountWeekendThreshold = 5
+var (
+	currentEventPeriodId     = -1
+	currentGameEventPeriodId = -1
+	currentEventVmMapId      int
+	currentEventVmEventId    int
+	eventsCount              int
 
-	freeEventLocationMinDepth = 2
+	gameCurrentEventPeriods map[string]*EventPeriod
+	// schedule ID -> game ID -> event locations
+	gameEventLocationPools map[string]map[string][]*EventLocationData
+	freeEventLocationPool  []*EventLocationData
+	eventVms               map[int][]int
 
-	eventVmExp = 4
+	gameLocationColors map[string][]string
 
-	weeklyExpCap = 50
+	// eventsMtx serializes scheduled event jobs, which replace the current
+	// event periods and add events
+	eventsMtx sync.Mutex
 
-	gameEventShareFactor = 0.25
+	// eventsBackfilled is set once events missed while the server was down
+	// have been added, which waits until there is a current event period
+	eventsBackfilled bool
 )
 
-const (
-	daily2kkiEventLocationMinDepth = 3
-	daily2kkiEventLocationMaxDepth = 5
+func initEvents() {
+	eventsMtx.Lock()
+	err := loadEvents()
+	if err != nil {
+		// runEventJobs keeps trying to load the events until it succeeds
+		writeErrLog("SERVER", "events", err.Error())
+	} else {
+		backfillEventsOnce()
+	}
+	eventsMtx.Unlock()
 
-	daily2kkiEventLocation2MinDepth = 5
-	daily2kkiEventLocation2MaxDepth = 9
+	// a single job runs the period rollover and every due schedule so that
+	// jobs due at the same time share one refresh of the event periods and
+	// never run concurrently
+	scheduler.Cron("* * * * *").Do(runEventJobs)
 
-	weekly2kkiEventLocationMinDepth = 11
-	weekly2kkiEventLocationMaxDepth = -1
+	if !isHostServer {
+		return
+	}
 
-	weekend2kkiEventLocationMinDepth = 9
-	weekend2kkiEventLocationMaxDepth = 14
-)
+	db.QueryRow("SELECT COUNT(*) FROM eventLocations el").Scan(&eventsCount)
 
-var (
-	currentEventPeriodId     = -1
-	currentGameEventPeriodId = -1
-	currentEventVmMapId      int
-	currentEventVmEventId    int
-	eventsCount              int
+	scheduler.Every(5).Minutes().Do(func() {
+		eventsMtx.Lock()
+		defer eventsMtx.Unlock()
 
-	gameCurrentEventPeriods       map[string]*EventPeriod
-	gameDailyEventLocationPools   map[string][]*EventLocationData
-	gameDailyEventLocation2Pools  map[string][]*EventLocationData
-	gameWeeklyEventLocationPools  map[string][]*EventLocationData
-	gameWeekendEventLocationPools map[string][]*EventLocationData
-	freeEventLocationPool         []*EventLocationData
-	eventVms                      map[int][]int
+		if currentGameEventPeriodId == 0 {
+			return
+		}
 
-	gameLocationColors map[string][]string
-)
+		var newEventLocationsCount int
+		db.QueryRow("SELECT COUNT(*) FROM eventLocations").Scan(&newEventLocationsCount)
+		if newEventLocationsCount != eventsCount {
+			eventsCount = newEventLocationsCount
+			sendEventsUpdate()
+		}
+	})
+}
 
-func initEvents() {
+// loadEvents sets the current event periods along with the event location
+// pools of their games
+func loadEvents() error {
 	err := setCurrentEventPeriodId()
 	if err != nil {
-		return
+		return err
 	}
 
 	err = setCurrentGameEventPeriodId()
 	if err != nil {
-		return
+		return err
 	}
 
 	if currentGameEventPeriodId == 0 {
-		return
+		return errors.New("no current event period")
 	}
 
 	if isHostServer {
 		gameCurrentEventPeriods, err = getGameCurrentEventPeriodsData()
 		if err != nil {
-			return
+			return err
 		}
 	}
 
 	setGameEventLocationPoolsAndLocationColors()
 
-	if !isHostServer {
+	return nil
+}
+
+// runEventJobs rolls event periods over at midnight UTC and adds the events
+// of every schedule due at the current minute
+func runEventJobs() {
+	now := time.Now().UTC().Truncate(time.Minute)
+
+	rollover := now.Hour() == 0 && now.Minute() == 0
+
+	var dueLocationSchedules []*EventLocationSchedule
+	var addVm bool
+	if isHostServer {
+		for _, locationSchedule := range eventSchedule.Locations {
+			if isEventScheduleDue(locationSchedule.schedule, now) {
+				dueLocationSchedules = append(dueLocationSchedules, locationSchedule)
+			}
+		}
+		addVm = eventSchedule.Vms != nil && isEventScheduleDue(eventSchedule.Vms.schedule, now)
+	}
+
+	eventsMtx.Lock()
+	defer eventsMtx.Unlock()
+
+	// the events failed to load, such as when there was no current period
+	loaded := currentGameEventPeriodId != 0
+
+	if loaded && !rollover && len(dueLocationSchedules) == 0 && !addVm {
 		return
 	}
 
-	db.QueryRow("SELECT COUNT(*) FROM eventLocations el").Scan(&eventsCount)
+	var updated bool
+	var err error
 
-	scheduler.Every(1).Day().At("00:00").Do(func() {
-		err := setCurrentEventPeriodId()
-		if err != nil {
-			return
+	if rollover {
+		updated, err = rolloverEventPeriods()
+	} else if !loaded {
+		err = loadEvents()
+		updated = err == nil
+	} else {
+		err = updateEventPeriods()
+	}
+	if err != nil {
+		// players are still told if the period ended without a new one
+		if updated {
+			sendEventsUpdate()
 		}
+		return
+	}
 
-		err = setCurrentGameEventPeriodId()
+	for _, locationSchedule := range dueLocationSchedules {
+		startDate, endDate, err := getEventScheduleDates(locationSchedule.schedule, locationSchedule.Days, now)
 		if err != nil {
-			return
+			handleInternalEventError(locationSchedule.Type, err)
+			continue
 		}
+		addScheduledEventLocation(locationSchedule, startDate, endDate)
+		eventsCount++
+		updated = true
+	}
 
-		gameCurrentEventPeriods, err = getGameCurrentEventPeriodsData()
+	if addVm {
+		startDate, endDate, err := getEventScheduleDates(eventSchedule.Vms.schedule, eventSchedule.Vms.Days, now)
 		if err != nil {
-			return
+			writeErrLog("SERVER", "VM", err.Error())
+		} else {
+			addEventVm(startDate, endDate)
+			updated = true
 		}
+	}
 
-		addDailyEventLocation(false)
-		addDailyEventLocation(true)
-		eventsCount += 2
-
-		switch time.Now().UTC().Weekday() {
-		case time.Sunday:
-			addWeeklyEventLocation()
-			addEventVm()
-			eventsCount += 2
-		case time.Tuesday:
-			addEventVm()
-			eventsCount++
-		case time.Friday:
-			addWeekendEventLocation()
-			addEventVm()
-			eventsCount += 2
-		}
+	if backfillEventsOnce() {
+		updated = true
+	}
 
+	if updated {
 		sendEventsUpdate()
-	})
+	}
+}
 
-	scheduler.Every(5).Minutes().Do(func() {
-		var newEventLocationsCount int
-		db.QueryRow("SELECT COUNT(*) FROM eventLocations").Scan(&newEventLocationsCount)
-		if newEventLocationsCount != eventsCount {
-			eventsCount = newEventLocationsCount
-			sendEventsUpdate()
+func updateEventPeriods() (err error) {
+	err = setCurrentEventPeriodId()
+	if err != nil {
+		return err
+	}
+
+	err = setCurrentGameEventPeriodId()
+	if err != nil {
+		return err
+	}
+
+	gameCurrentEventPeriods, err = getGameCurrentEventPeriodsData()
+
+	return err
+}
+
+// backfillEventsOnce backfills events on the host server the first time the
+// events are loaded and returns whether it did; eventsMtx must be held
+func backfillEventsOnce() bool {
+	if !isHostServer || eventsBackfilled || currentGameEventPeriodId == 0 {
+		return false
+	}
+
+	backfillEvents()
+	eventsBackfilled = true
+
+	return true
+}
+
+// backfillEvents adds any scheduled events missing for the current
+// occurrence of each schedule, such as when the server was down at the time
+func backfillEvents() {
+	now := time.Now().UTC()
+
+	for _, locationSchedule := range eventSchedule.Locations {
+		startDate, endDate, err := getEventScheduleDates(locationSchedule.schedule, locationSchedule.Days, now)
+		if err != nil {
+			handleInternalEventError(locationSchedule.Type, err)
+			continue
+		}
+		if !now.Before(endDate) {
+			continue
 		}
-	})
 
-	var count int
+		ids, err := getScheduledEventLocationIds(locationSchedule, startDate)
+		if err != nil {
+			handleInternalEventError(locationSchedule.Type, err)
+			continue
+		}
+		if len(ids) == 0 {
+			addScheduledEventLocation(locationSchedule, startDate, endDate)
+		}
+	}
+
+	if eventSchedule.Vms == nil {
+		return
+	}
 
-	// daily easy expedition
-	db.QueryRow("SELECT COUNT(el.id) FROM eventLocations el JOIN gameEventPeriods gep ON gep.id = el.gamePeriodId JOIN eventPeriods ep ON ep.id = gep.periodId WHERE el.type = 0 AND ep.id = ? AND el.startDate = UTC_DATE() AND el.exp = 1", currentEventPeriodId).Scan(&count)
-	if count == 0 {
-		addDailyEventLocation(false)
+	startDate, endDate, err := getEventScheduleDates(eventSchedule.Vms.schedule, eventSchedule.Vms.Days, now)
+	if err != nil {
+		writeErrLog("SERVER", "VM", err.Error())
+		return
 	}
 
-	// daily deeper expedition
-	db.QueryRow("SELECT COUNT(el.id) FROM eventLocations el JOIN gameEventPeriods gep ON gep.id = el.gamePeriodId JOIN eventPeriods ep ON ep.id = gep.periodId WHERE el.type = 0 AND ep.id = ? AND el.startDate = UTC_DATE() AND el.exp = 3", currentEventPeriodId).Scan(&count)
-	if count == 0 {
-		addDailyEventLocation(true)
+	db.QueryRow("SELECT ev.mapId, ev.eventId FROM eventVms ev JOIN gameEventPeriods gep ON gep.id = ev.gamePeriodId JOIN eventPeriods ep ON ep.id = gep.periodId WHERE ep.id = ? AND ev.startDate = ?", currentEventPeriodId, startDate).Scan(&currentEventVmMapId, &currentEventVmEventId)
+	if currentEventVmMapId == 0 && currentEventVmEventId == 0 && now.Before(endDate) {
+		addEventVm(startDate, endDate)
 	}
+}
 
-	weekday := time.Now().UTC().Weekday()
+// getScheduledEventLocationIds returns the IDs of the current period's event
+// locations generated by a schedule for the occurrence starting at startDate
+func getScheduledEventLocationIds(locationSchedule *EventLocationSchedule, startDate time.Time) (ids []int, err error) {
+	exps := locationSchedule.getExps()
 
-	// weekly expedition
-	db.QueryRow("SELECT COUNT(el.id) FROM eventLocations el JOIN gameEventPeriods gep ON gep.id = el.gamePeriodId JOIN eventPeriods ep ON ep.id = gep.periodId WHERE el.type = 1 AND ep.id = ? AND el.startDate = DATE_SUB(UTC_DATE(), INTERVAL ? DAY)", currentEventPeriodId, int(weekday)).Scan(&count)
-	if count == 0 {
-		addWeeklyEventLocation()
+	args := []any{locationSchedule.Type, currentEventPeriodId, startDate}
+	for _, exp := range exps {
+		args = append(args, exp)
 	}
 
-	var lastVmWeekday time.Weekday
+	results, err := db.Query("SELECT el.id FROM eventLocations el JOIN gameEventPeriods gep ON gep.id = el.gamePeriodId WHERE el.type = ? AND gep.periodId = ? AND el.startDate = ? AND el.exp IN (?"+strings.Repeat(", ?", len(exps)-1)+")", args...)
+	if err != nil {
+		return ids, err
+	}
 
-	switch weekday {
-	case time.Sunday, time.Monday:
-		lastVmWeekday = time.Sunday
-	case time.Tuesday, time.Wednesday, time.Thursday:
-		lastVmWeekday = time.Tuesday
-	case time.Friday, time.Saturday:
-		// weekend expedition
-		db.QueryRow("SELECT COUNT(el.id) FROM eventLocations el JOIN gameEventPeriods gep ON gep.id = el.gamePeriodId JOIN eventPeriods ep ON ep.id = gep.periodId WHERE el.type = 2 AND ep.id = ? AND el.startDate = DATE_SUB(UTC_DATE(), INTERVAL ? DAY)", currentEventPeriodId, int(weekday-time.Friday)).Scan(&count)
-		if count == 0 {
-			addWeekendEventLocation()
+	defer results.Close()
+
+	for results.Next() {
+		var id int
+		err := results.Scan(&id)
+		if err != nil {
+			return ids, err
 		}
 
-		lastVmWeekday = time.Friday
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// getScheduledEventVmIds returns the IDs of the current period's vending
+// machine events for the occurrence starting at startDate
+func getScheduledEventVmIds(startDate time.Time) (ids []int, err error) {
+	results, err := db.Query("SELECT ev.id FROM eventVms ev JOIN gameEventPeriods gep ON gep.id = ev.gamePeriodId WHERE gep.periodId = ? AND ev.startDate = ?", currentEventPeriodId, startDate)
+	if err != nil {
+		return ids, err
 	}
 
-	// vending machine expedition
-	db.QueryRow("SELECT ev.mapId, ev.eventId FROM eventVms ev JOIN gameEventPeriods gep ON gep.id = ev.gamePeriodId JOIN eventPeriods ep ON ep.id = gep.periodId WHERE ep.id = ? AND ev.startDate = DATE_SUB(UTC_DATE(), INTERVAL ? DAY)", currentEventPeriodId, int(weekday-lastVmWeekday)).Scan(&currentEventVmMapId, &currentEventVmEventId)
-	if currentEventVmMapId == 0 && currentEventVmEventId == 0 {
-		addEventVm()
+	defer results.Close()
+
+	for results.Next() {
+		var id int
+		err := results.Scan(&id)
+		if err != nil {
+			return ids, err
+		}
+
+		ids = append(ids, id)
 	}
+
+	return ids, nil
 }
 
 func sendEventsUpdate() {
+	updateEventLocationMapIndex()
+
 	for _, client := range clients.Get() {
 		if client.account {
 			client.handleE()
@@ -271,177 +383,180 @@ func sendEventsUpdate() {
 	}
 }
 
-func addDailyEventLocation(deeper bool) {
-	var pools map[string][]*EventLocationData
-	if !deeper {
-		pools = gameDailyEventLocationPools
-	} else {
-		pools = gameDailyEventLocation2Pools
-	}
-
-	gameId, err := getRandomGameForEventLocation(pools, eventLocationCountDailyThreshold)
+func addScheduledEventLocation(locationSchedule *EventLocationSchedule, startDate time.Time, endDate time.Time) {
+	gameId, eventLocations, err := generateScheduledEventLocations(locationSchedule)
 	if err != nil {
-		handleInternalEventError(0, err)
+		handleInternalEventError(locationSchedule.Type, err)
 		return
 	}
 
-	if gameId == "2kki" {
-		if !deeper {
-			add2kkiEventLocation(0, daily2kkiEventLocationMinDepth, daily2kkiEventLocationMaxDepth, dailyEventLocationExp)
-		} else {
-			add2kkiEventLocation(0, daily2kkiEventLocation2MinDepth, daily2kkiEventLocation2MaxDepth, dailyEventLocation2Exp)
-		}
-	} else {
-		if !deeper {
-			addEventLocation(gameId, 0, dailyEventLocationExp, pools)
-		} else {
-			addEventLocation(gameId, 0, dailyEventLocation2Exp, pools)
+	gameEventPeriodId := getGameEventPeriodId(gameId)
+	exp := locationSchedule.getExp(gameId)
+
+	err = runInTx(func(tx *sql.Tx) error {
+		for _, eventLocation := range eventLocations {
+			err := writeEventLocationData(tx, gameEventPeriodId, locationSchedule.Type, eventLocation.Title, eventLocation.TitleJP, eventLocation.Depth, eventLocation.MinDepth, exp, eventLocation.MapIds, startDate, endDate)
+			if err != nil {
+				return err
+			}
 		}
+
+		return nil
+	})
+	if err != nil {
+		handleInternalEventError(locationSchedule.Type, err)
 	}
 }
 
-func addWeeklyEventLocation() {
-	gameId, err := getRandomGameForEventLocation(gameWeeklyEventLocationPools, eventLocationCountWeeklyThreshold)
+// generateScheduledEventLocations picks a game for a location schedule and
+// the event locations to add for it
+func generateScheduledEventLocations(locationSchedule *EventLocationSchedule) (gameId string, eventLocations []*EventLocationData, err error) {
+	gamePlayerCounts, err := getGamePlayerCounts()
 	if err != nil {
-		handleInternalEventError(1, err)
-		return
+		return "", nil, err
 	}
 
-	if gameId == "2kki" {
-		add2kkiEventLocation(1, weekly2kkiEventLocationMinDepth, weekly2kkiEventLocationMaxDepth, weeklyEventLocationExp)
-	} else {
-		addEventLocation(gameId, 1, weeklyEventLocationExp, gameWeeklyEventLocationPools)
-	}
-}
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 
-func addWeekendEventLocation() {
-	gameId, err := getRandomGameForEventLocation(gameWeekendEventLocationPools, eventLocationCountWeekendThreshold)
+	gameId, err = getRandomGameForEventLocation(r, locationSchedule, gameEventLocationPools, gamePlayerCounts)
 	if err != nil {
-		handleInternalEventError(2, err)
-		return
+		return "", nil, err
 	}
 
-	if gameId == "2kki" {
-		add2kkiEventLocation(2, weekend2kkiEventLocationMinDepth, weekend2kkiEventLocationMaxDepth, weekendEventLocationExp)
-	} else {
-		addEventLocation(gameId, 2, weekendEventLocationExp, gameWeekendEventLocationPools)
+	eventLocations, err = getEventLocationsForGame(r, gameId, locationSchedule, gameEventLocationPools[locationSchedule.Id][gameId])
+	if err != nil {
+		return "", nil, err
 	}
-}
 
-func addEventLocation(gameId string, eventType int, exp int, pools map[string][]*EventLocationData) {
-	addPlayerEventLocation(gameId, eventType, exp, pools[gameId], "")
+	return gameId, eventLocations, nil
 }
 
-// eventType: 0 - daily, 1 - weekly, 2 - weekend, 3 - manual
-func addPlayerEventLocation(gameId string, eventType int, exp int, pool []*EventLocationData, playerUuid string) {
-	rand.Seed(time.Now().Unix())
-	eventLocation := pool[rand.Intn(len(pool))]
-
-	var gameEventPeriodId int
-	if gameId == config.gameName {
-		gameEventPeriodId = currentGameEventPeriodId
-	} else {
-		gameEventPeriodId = gameCurrentEventPeriods[gameId].Id
+// getEventLocationsForGame picks a random event location from the pool unless
+// the game has its own event location source
+func getEventLocationsForGame(r *rand.Rand, gameId string, locationSchedule *EventLocationSchedule, pool []*EventLocationData) ([]*EventLocationData, error) {
+	if plugin := getGamePlugin(gameId); plugin.HasEventLocationSource() {
+		minDepth, maxDepth := locationSchedule.getDepths(gameId)
+		return plugin.GetEventLocations(r, minDepth, maxDepth)
 	}
 
-	var err error
-	if playerUuid == "" {
-		err = writeEventLocationData(gameEventPeriodId, eventType, eventLocation.Title, eventLocation.TitleJP, eventLocation.Depth, eventLocation.MinDepth, exp, eventLocation.MapIds)
-	} else {
-		err = writePlayerEventLocationData(gameEventPeriodId, playerUuid, eventLocation.Title, eventLocation.TitleJP, eventLocation.Depth, eventLocation.MinDepth, eventLocation.MapIds)
+	if len(pool) == 0 {
+		return nil, errors.New("no event locations in pool for " + gameId)
 	}
-	if err != nil {
-		handleInternalEventError(eventType, err)
-	}
-}
 
-func add2kkiEventLocation(eventType int, minDepth int, maxDepth int, exp int) {
-	var gameEventPeriodId int
-	if config.gameName == "2kki" {
-		gameEventPeriodId = currentGameEventPeriodId
-	} else {
-		gameEventPeriodId = gameCurrentEventPeriods["2kki"].Id
-	}
-	addPlayer2kkiEventLocation(gameEventPeriodId, eventType, minDepth, maxDepth, exp, "")
+	return []*EventLocationData{pool[r.Intn(len(pool))]}, nil
 }
 
-// eventType: 0 - daily, 1 - weekly, 2 - weekend, 3 - manual
-func addPlayer2kkiEventLocation(gameEventPeriodId int, eventType int, minDepth int, maxDepth int, exp int, playerUuid string) {
-	url := "https://2kki.app/getRandomLocations?ignoreSecret=1&minDepth=" + strconv.Itoa(minDepth)
-	if maxDepth >= minDepth {
-		url += "&maxDepth=" + strconv.Itoa(maxDepth)
+// getRandomGameForEventLocation picks a game weighted by its player count,
+// with a share of the pool split evenly between games
+func getRandomGameForEventLocation(r *rand.Rand, locationSchedule *EventLocationSchedule, pools map[string]map[string][]*EventLocationData, gamePlayerCounts map[string]int) (gameId string, err error) {
+	var gameIds []string
+	for gameId := range gamePlayerCounts {
+		gameIds = append(gameIds, gameId)
 	}
+	sort.Strings(gameIds)
 
-	resp, err := http.Get(url)
-	if err != nil {
-		handleInternalEventError(eventType, err)
-		return
+	var playerCounts []int
+	var weights []float64
+	var poolGameIds []string
+	totalPlayerCount := 0
+
+	for _, currentGameId := range gameIds {
+		// Ignore games with no event locations in the current pool
+		if eventLocations, ok := pools[locationSchedule.Id][currentGameId]; !getGamePlugin(currentGameId).HasEventLocationSource() && (!ok || len(eventLocations) < locationSchedule.CountThreshold) {
+			continue
+		}
+
+		weight := locationSchedule.getWeight(currentGameId)
+		if weight <= 0 {
+			continue
+		}
+
+		currentPlayerCount := gamePlayerCounts[currentGameId]
+		if currentPlayerCount == 0 {
+			currentPlayerCount = 1
+		}
+
+		totalPlayerCount += currentPlayerCount
+
+		playerCounts = append(playerCounts, currentPlayerCount)
+		weights = append(weights, weight)
+		poolGameIds = append(poolGameIds, currentGameId)
 	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		handleInternalEventError(eventType, err)
-		return
+
+	if len(poolGameIds) == 0 {
+		return "", errors.New("no games available for event location")
 	}
 
-	if strings.HasPrefix(string(body), "{\"error\"") {
-		handleEventError(eventType, "Invalid event location data: "+string(body))
-		return
+	avgPlayerCount := int(math.Ceil(float64(totalPlayerCount) / float64(len(poolGameIds))))
+
+	var poolThresholds []int
+	totalPoolValue := 0
+
+	poolCommonValue := int(math.Ceil(float64(avgPlayerCount) * eventSchedule.GameShareFactor))
+
+	for i, count := range playerCounts {
+		poolValue := int(math.Floor(float64(count)*(1-eventSchedule.GameShareFactor))) + poolCommonValue
+		poolValue = int(math.Ceil(float64(poolValue) * weights[i]))
+
+		totalPoolValue += poolValue
+		poolThresholds = append(poolThresholds, totalPoolValue)
 	}
 
-	var eventLocations []EventLocationData
-	err = json.Unmarshal(body, &eventLocations)
-	if err != nil {
-		handleInternalEventError(eventType, err)
-		return
+	if totalPoolValue == 0 {
+		return "", errors.New("no games available for event location")
 	}
 
-	for _, eventLocation := range eventLocations {
-		adjustedDepth := (eventLocation.Depth / 3) * 2
-		if eventLocation.Depth%3 == 2 {
-			adjustedDepth++
-		}
-		if adjustedDepth > 10 {
-			adjustedDepth = 10
-		}
+	randValue := r.Intn(totalPoolValue)
 
-		var adjustedMinDepth int
-		if eventLocation.MinDepth == eventLocation.Depth {
-			adjustedMinDepth = adjustedDepth
-		} else {
-			adjustedMinDepth = (eventLocation.MinDepth / 3) * 2
-			if eventLocation.MinDepth%3 == 2 {
-				adjustedMinDepth++
-			}
-			if adjustedMinDepth > 10 {
-				adjustedMinDepth = 10
-			}
+	for i, threshold := range poolThresholds {
+		if randValue < threshold {
+			return poolGameIds[i], nil
 		}
-		if playerUuid == "" {
-			err = writeEventLocationData(gameEventPeriodId, eventType, eventLocation.Title, eventLocation.TitleJP, adjustedDepth, adjustedMinDepth, exp, eventLocation.MapIds)
-		} else {
-			err = writePlayerEventLocationData(gameEventPeriodId, playerUuid, eventLocation.Title, eventLocation.TitleJP, adjustedDepth, adjustedMinDepth, eventLocation.MapIds)
+	}
+
+	return "", nil
+}
+
+// addPlayerFreeEventLocation adds a free expedition for a player who has
+// completed all of their current event locations
+func addPlayerFreeEventLocation(playerUuid string) {
+	var eventLocations []*EventLocationData
+	var err error
+
+	if gamePlugin.HasEventLocationSource() {
+		eventLocations, err = gamePlugin.GetEventLocations(rand.New(rand.NewSource(time.Now().UnixNano())), eventSchedule.FreeLocationMinDepth, 0)
+		if err != nil {
+			handleInternalEventError(-1, err)
+			return
 		}
+	} else if len(freeEventLocationPool) > 0 {
+		rand.Seed(time.Now().Unix())
+		eventLocations = append(eventLocations, freeEventLocationPool[rand.Intn(len(freeEventLocationPool))])
+	}
+
+	for _, eventLocation := range eventLocations {
+		err = writePlayerEventLocationData(currentGameEventPeriodId, playerUuid, eventLocation.Title, eventLocation.TitleJP, eventLocation.Depth, eventLocation.MinDepth, eventLocation.MapIds)
 		if err != nil {
-			handleInternalEventError(eventType, err)
+			handleInternalEventError(-1, err)
 		}
 	}
 }
 
-func addEventVm() {
-	mapIds := make([]int, 0, len(eventVms))
-	for k := range eventVms {
-		mapIds = append(mapIds, k)
+func getGameEventPeriodId(gameId string) int {
+	if gameId == config.gameName {
+		return currentGameEventPeriodId
 	}
-	if len(mapIds) == 0 {
+
+	return gameCurrentEventPeriods[gameId].Id
+}
+
+func addEventVm(startDate time.Time, endDate time.Time) {
+	mapId, eventId, ok := getRandomEventVm(rand.New(rand.NewSource(time.Now().UnixNano())))
+	if !ok {
 		return
 	}
 
-	rand.Seed(time.Now().Unix())
-	mapId := mapIds[rand.Intn(len(mapIds))]
-	eventId := eventVms[mapId][rand.Intn(len(eventVms[mapId]))]
-
-	err := writeEventVmData(mapId, eventId, eventVmExp)
+	err := writeEventVmData(db, mapId, eventId, eventSchedule.Vms.Exp, startDate, endDate)
 	if err == nil {
 		currentEventVmMapId = mapId
 		currentEventVmEventId = eventId
@@ -450,6 +565,22 @@ func addEventVm() {
 	}
 }
 
+func getRandomEventVm(r *rand.Rand) (mapId int, eventId int, ok bool) {
+	mapIds := make([]int, 0, len(eventVms))
+	for k := range eventVms {
+		mapIds = append(mapIds, k)
+	}
+	if len(mapIds) == 0 {
+		return 0, 0, false
+	}
+	sort.Ints(mapIds)
+
+	mapId = mapIds[r.Intn(len(mapIds))]
+	eventId = eventVms[mapId][r.Intn(len(eventVms[mapId]))]
+
+	return mapId, eventId, true
+}
+
 func handleInternalEventError(eventType int, err error) {
 	handleEventError(eventType, err.Error())
 }
@@ -486,20 +617,6 @@ func setEventVms() {
 }
 
 func setGameEventLocationPoolsAndLocationColors() {
-	if isHostServer {
-		gameDailyEventLocationPools = make(map[string][]*EventLocationData)
-		gameDailyEventLocation2Pools = make(map[string][]*EventLocationData)
-		gameWeeklyEventLocationPools = make(map[string][]*EventLocationData)
-		gameWeekendEventLocationPools = make(map[string][]*EventLocationData)
-	}
-
-	gameLocationColors = make(map[string][]string)
-
-	gameEventLocations := make(map[string][]*EventLocationData)
-	gameMaxDepths := make(map[string]int)
-
-	configPath := "eventlocations/"
-
 	var gameIds []string
 	if isHostServer {
 		for gameId := range gameCurrentEventPeriods {
@@ -509,6 +626,36 @@ func setGameEventLocationPoolsAndLocationColors() {
 		gameIds = append(gameIds, config.gameName)
 	}
 
+	gameEventLocations := getGameEventLocations(gameIds)
+
+	// built before being assigned as they are read by client goroutines
+	locationColors := make(map[string][]string)
+	var freeLocationPool []*EventLocationData
+
+	for _, eventLocation := range gameEventLocations[config.gameName] {
+		locationColors[eventLocation.Title] = []string{eventLocation.FgColor, eventLocation.BgColor}
+
+		if !eventLocation.Ignored && eventLocation.Depth >= eventSchedule.FreeLocationMinDepth {
+			freeLocationPool = append(freeLocationPool, eventLocation)
+		}
+	}
+
+	gameLocationColors = locationColors
+	freeEventLocationPool = freeLocationPool
+
+	if isHostServer {
+		gameEventLocationPools = getGameEventLocationPools(gameEventLocations)
+	}
+}
+
+// getGameEventLocations reads the event locations of each game, scaling the
+// depths of games deeper than 10 down to a maximum of 10
+func getGameEventLocations(gameIds []string) map[string][]*EventLocationData {
+	gameEventLocations := make(map[string][]*EventLocationData)
+	gameMaxDepths := make(map[string]int)
+
+	configPath := "eventlocations/"
+
 	for _, gameId := range gameIds {
 		var eventLocations []*EventLocationData
 
@@ -541,40 +688,39 @@ func setGameEventLocationPoolsAndLocationColors() {
 		gameMaxDepth := math.Min(float64(gameMaxDepths[gameId]), 15)
 
 		for _, eventLocation := range eventLocations {
-			if gameId == config.gameName {
-				var locationColors []string
-				locationColors = append(locationColors, eventLocation.FgColor, eventLocation.BgColor)
-				gameLocationColors[eventLocation.Title] = locationColors
-			}
 			if eventLocation.Ignored {
 				continue
 			}
-			adjustedDepth := eventLocation.Depth
-			adjustedMinDepth := eventLocation.MinDepth
 			if gameMaxDepth > 10 {
-				adjustedDepth = int(math.Floor(float64(adjustedDepth) / gameMaxDepth * 10))
-				adjustedMinDepth = int(math.Floor(float64(adjustedMinDepth) / gameMaxDepth * 10))
+				eventLocation.Depth = int(math.Floor(float64(eventLocation.Depth) / gameMaxDepth * 10))
+				eventLocation.MinDepth = int(math.Floor(float64(eventLocation.MinDepth) / gameMaxDepth * 10))
 			}
-			eventLocation.Depth = adjustedDepth
-			eventLocation.MinDepth = adjustedMinDepth
+		}
+	}
 
-			if isHostServer {
-				if adjustedDepth >= dailyEventLocationMinDepth && adjustedDepth <= dailyEventLocationMaxDepth {
-					gameDailyEventLocationPools[gameId] = append(gameDailyEventLocationPools[gameId], eventLocation)
-				}
-				if adjustedDepth >= dailyEventLocation2MinDepth && adjustedDepth <= dailyEventLocation2MaxDepth {
-					gameDailyEventLocation2Pools[gameId] = append(gameDailyEventLocation2Pools[gameId], eventLocation)
-				}
-				if adjustedDepth >= weeklyEventLocationMinDepth && adjustedDepth <= weeklyEventLocationMaxDepth {
-					gameWeeklyEventLocationPools[gameId] = append(gameWeeklyEventLocationPools[gameId], eventLocation)
-				}
-				if adjustedDepth >= weekendEventLocationMinDepth && adjustedDepth <= weekendEventLocationMaxDepth {
-					gameWeekendEventLocationPools[gameId] = append(gameWeekendEventLocationPools[gameId], eventLocation)
-				}
+	return gameEventLocations
+}
+
+// getGameEventLocationPools sorts event locations into pools for each
+// location schedule by depth
+func getGameEventLocationPools(gameEventLocations map[string][]*EventLocationData) map[string]map[string][]*EventLocationData {
+	pools := make(map[string]map[string][]*EventLocationData)
+	for _, locationSchedule := range eventSchedule.Locations {
+		pools[locationSchedule.Id] = make(map[string][]*EventLocationData)
+	}
+
+	for gameId, eventLocations := range gameEventLocations {
+		for _, eventLocation := range eventLocations {
+			if eventLocation.Ignored {
+				continue
 			}
-			if gameId == config.gameName && adjustedDepth >= freeEventLocationMinDepth {
-				freeEventLocationPool = append(freeEventLocationPool, eventLocation)
+			for _, locationSchedule := range eventSchedule.Locations {
+				if locationSchedule.isInDepthRange(eventLocation.Depth) {
+					pools[locationSchedule.Id][gameId] = append(pools[locationSchedule.Id][gameId], eventLocation)
+				}
 			}
 		}
 	}
+
+	return pools
 }
@@ -0,0 +1,236 @@
+/*
+	Copyright (C) 2021-2023  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// eventScheduleLookbackDays is how far back to look for the current
+// occurrence of a schedule, which bounds the longest supported interval
+const eventScheduleLookbackDays = 35
+
+var eventSchedule = &EventSchedule{}
+
+type EventSchedule struct {
+	WeeklyExpCap         int     `json:"weeklyExpCap"` // 0 for no cap
+	GameShareFactor      float64 `json:"gameShareFactor"`
+	FreeLocationMinDepth int     `json:"freeLocationMinDepth"`
+
+	Locations []*EventLocationSchedule `json:"locations"`
+	Vms       *EventVmSchedule         `json:"vms"`
+	Periods   *EventPeriodSchedule     `json:"periods"`
+}
+
+type EventLocationSchedule struct {
+	Id             string `json:"id"`
+	Type           int    `json:"type"` // 0 - daily, 1 - weekly, 2 - weekend
+	Cron           string `json:"cron"`
+	Days           int    `json:"days"` // 0 to last until the next occurrence
+	MinDepth       int    `json:"minDepth"`
+	MaxDepth       int    `json:"maxDepth"`
+	Exp            int    `json:"exp"`
+	CountThreshold int    `json:"countThreshold"`
+
+	Games map[string]*EventLocationScheduleGame `json:"games"`
+
+	schedule cron.Schedule
+}
+
+// EventLocationScheduleGame overrides schedule values for a single game
+type EventLocationScheduleGame struct {
+	MinDepth *int     `json:"minDepth"`
+	MaxDepth *int     `json:"maxDepth"`
+	Exp      *int     `json:"exp"`
+	Weight   *float64 `json:"weight"` // 0 to exclude the game
+}
+
+type EventVmSchedule struct {
+	Cron string `json:"cron"`
+	Days int    `json:"days"` // 0 to last until the next occurrence
+	Exp  int    `json:"exp"`
+
+	schedule cron.Schedule
+}
+
+// EventPeriodSchedule describes the periods the host server creates by itself
+// when the latest period is about to end
+type EventPeriodSchedule struct {
+	Days      int      `json:"days"`
+	LeadDays  int      `json:"leadDays"` // how long before the latest period ends to create the next one
+	Games     []string `json:"games"`
+	EnableVms []string `json:"enableVms"`
+}
+
+// setEventSchedule loads the event schedule, logging the error and leaving
+// scheduled expeditions disabled if it is missing or invalid
+func setEventSchedule() {
+	schedule, err := loadEventSchedule("eventschedule.json")
+	if err != nil {
+		writeErrLog("SERVER", "events", "event scheduling disabled: "+err.Error())
+		schedule = &EventSchedule{}
+	}
+
+	eventSchedule = schedule
+}
+
+func loadEventSchedule(filename string) (*EventSchedule, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule := &EventSchedule{}
+
+	err = json.Unmarshal(data, schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, locationSchedule := range schedule.Locations {
+		locationSchedule.schedule, err = parseEventScheduleCron(locationSchedule.Cron)
+		if err != nil {
+			return nil, errors.New("invalid cron for event schedule " + locationSchedule.Id + ": " + err.Error())
+		}
+	}
+
+	if schedule.Vms != nil {
+		schedule.Vms.schedule, err = parseEventScheduleCron(schedule.Vms.Cron)
+		if err != nil {
+			return nil, errors.New("invalid cron for event VM schedule: " + err.Error())
+		}
+	}
+
+	if schedule.Periods != nil {
+		if schedule.Periods.Days <= 0 || schedule.Periods.LeadDays < 0 {
+			return nil, errors.New("invalid days for event period schedule")
+		}
+		if len(schedule.Periods.Games) == 0 {
+			return nil, errors.New("no games for event period schedule")
+		}
+	}
+
+	return schedule, nil
+}
+
+// parseEventScheduleCron parses a standard cron expression evaluated in UTC
+// like the scheduler, regardless of the local time zone
+func parseEventScheduleCron(expr string) (cron.Schedule, error) {
+	return cron.ParseStandard("CRON_TZ=UTC " + expr)
+}
+
+func (s *EventSchedule) capExp(weekExp int, exp int) int {
+	if s.WeeklyExpCap <= 0 {
+		return exp
+	}
+	if weekExp >= s.WeeklyExpCap {
+		return 0
+	}
+	if weekExp+exp > s.WeeklyExpCap {
+		return s.WeeklyExpCap - weekExp
+	}
+
+	return exp
+}
+
+func (s *EventLocationSchedule) getDepths(gameId string) (minDepth int, maxDepth int) {
+	minDepth, maxDepth = s.MinDepth, s.MaxDepth
+	if game, ok := s.Games[gameId]; ok {
+		if game.MinDepth != nil {
+			minDepth = *game.MinDepth
+		}
+		if game.MaxDepth != nil {
+			maxDepth = *game.MaxDepth
+		}
+	}
+
+	return minDepth, maxDepth
+}
+
+func (s *EventLocationSchedule) getExp(gameId string) int {
+	if game, ok := s.Games[gameId]; ok && game.Exp != nil {
+		return *game.Exp
+	}
+
+	return s.Exp
+}
+
+// getExps returns every exp value the schedule can award, which together
+// with the type identifies the schedule's events
+func (s *EventLocationSchedule) getExps() []int {
+	exps := []int{s.Exp}
+	for _, game := range s.Games {
+		if game.Exp != nil && !contains(exps, *game.Exp) {
+			exps = append(exps, *game.Exp)
+		}
+	}
+
+	return exps
+}
+
+func (s *EventLocationSchedule) getWeight(gameId string) float64 {
+	if game, ok := s.Games[gameId]; ok && game.Weight != nil {
+		return *game.Weight
+	}
+
+	return 1
+}
+
+// isInDepthRange checks a pool location's depth against the schedule's
+// default depth range, as pool depths are already scaled to it
+func (s *EventLocationSchedule) isInDepthRange(depth int) bool {
+	return depth >= s.MinDepth && (s.MaxDepth < 0 || depth <= s.MaxDepth)
+}
+
+// isEventScheduleDue checks whether a schedule has an occurrence at the
+// specified minute
+func isEventScheduleDue(schedule cron.Schedule, minute time.Time) bool {
+	return schedule.Next(minute.Add(-time.Second)).Equal(minute)
+}
+
+// getEventScheduleDates returns the dates of the latest occurrence of a
+// schedule at or before the specified time
+func getEventScheduleDates(schedule cron.Schedule, days int, now time.Time) (startDate time.Time, endDate time.Time, err error) {
+	var occurrence time.Time
+	for t := schedule.Next(now.AddDate(0, 0, -eventScheduleLookbackDays)); !t.After(now); t = schedule.Next(t) {
+		occurrence = t
+	}
+
+	if occurrence.IsZero() {
+		return startDate, endDate, errors.New("no occurrence within lookback period")
+	}
+
+	startDate = truncateToDate(occurrence)
+
+	if days > 0 {
+		endDate = startDate.AddDate(0, 0, days)
+	} else {
+		endDate = truncateToDate(schedule.Next(occurrence))
+	}
+
+	return startDate, endDate, nil
+}
+
+func truncateToDate(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
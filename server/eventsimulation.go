@@ -0,0 +1,218 @@
+/*
+	Copyright (C) 2021-2023  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// eventSimulationOccurrence is a scheduled event in a simulation, where a nil
+// location schedule means a vending machine event
+type eventSimulationOccurrence struct {
+	time             time.Time
+	locationSchedule *EventLocationSchedule
+}
+
+// simulateEvents prints the expeditions the schedule would generate over a
+// number of weeks from a start date using a fixed seed, weighting games by the
+// given player counts, without writing to the database, so that the same
+// arguments give the same output
+func simulateEvents(startDate time.Time, weeks int, seed int64, playerCounts map[string]int) {
+	r := rand.New(rand.NewSource(seed))
+
+	gamePlayerCounts := getEventSimulationPlayerCounts(playerCounts)
+
+	var gameIds []string
+	for gameId := range gamePlayerCounts {
+		gameIds = append(gameIds, gameId)
+	}
+	sort.Strings(gameIds)
+
+	pools := getGameEventLocationPools(getGameEventLocations(gameIds))
+
+	// start just before midnight so that occurrences on the start date count
+	startTime := truncateToDate(startDate).Add(-time.Second)
+	endTime := truncateToDate(startDate).AddDate(0, 0, weeks*7)
+
+	var occurrences []*eventSimulationOccurrence
+	for _, locationSchedule := range eventSchedule.Locations {
+		for t := locationSchedule.schedule.Next(startTime); t.Before(endTime); t = locationSchedule.schedule.Next(t) {
+			occurrences = append(occurrences, &eventSimulationOccurrence{time: t, locationSchedule: locationSchedule})
+		}
+	}
+	if eventSchedule.Vms != nil {
+		for t := eventSchedule.Vms.schedule.Next(startTime); t.Before(endTime); t = eventSchedule.Vms.schedule.Next(t) {
+			occurrences = append(occurrences, &eventSimulationOccurrence{time: t})
+		}
+	}
+
+	sort.SliceStable(occurrences, func(a, b int) bool {
+		return occurrences[a].time.Before(occurrences[b].time)
+	})
+
+	scheduleGameCounts := make(map[string]map[string]int)
+	gameDepthCounts := make(map[string]map[int]int)
+	vmCounts := make(map[int]int)
+
+	fmt.Printf("Simulating %d weeks of expeditions from %s with seed %d...\n", weeks, startDate.Format("2006-01-02"), seed)
+
+	for _, occurrence := range occurrences {
+		date := occurrence.time.Format("2006-01-02 Mon")
+
+		if occurrence.locationSchedule == nil {
+			mapId, eventId, ok := getRandomEventVm(r)
+			if !ok {
+				fmt.Printf("%s  vm       no vending machines\n", date)
+				continue
+			}
+			vmCounts[mapId]++
+			fmt.Printf("%s  vm       map %04d event %04d (%d exp)\n", date, mapId, eventId, eventSchedule.Vms.Exp)
+			continue
+		}
+
+		locationSchedule := occurrence.locationSchedule
+
+		gameId, err := getRandomGameForEventLocation(r, locationSchedule, pools, gamePlayerCounts)
+		if err != nil {
+			fmt.Printf("%s  %-8s %s\n", date, locationSchedule.Id, err.Error())
+			continue
+		}
+
+		if scheduleGameCounts[locationSchedule.Id] == nil {
+			scheduleGameCounts[locationSchedule.Id] = make(map[string]int)
+		}
+		scheduleGameCounts[locationSchedule.Id][gameId]++
+
+		exp := locationSchedule.getExp(gameId)
+
+		eventLocations, err := getEventLocationsForGame(r, gameId, locationSchedule, pools[locationSchedule.Id][gameId])
+		if err != nil {
+			fmt.Printf("%s  %-8s %s: %s\n", date, locationSchedule.Id, gameId, err.Error())
+			continue
+		}
+
+		for _, eventLocation := range eventLocations {
+			if gameDepthCounts[gameId] == nil {
+				gameDepthCounts[gameId] = make(map[int]int)
+			}
+			gameDepthCounts[gameId][eventLocation.Depth]++
+
+			fmt.Printf("%s  %-8s %s: %s at depth %d (%d exp)\n", date, locationSchedule.Id, gameId, eventLocation.Title, eventLocation.Depth, exp)
+		}
+	}
+
+	fmt.Print("\nExpeditions per game:\n")
+	for _, locationSchedule := range eventSchedule.Locations {
+		var counts []string
+		var total int
+		for _, gameId := range gameIds {
+			if count := scheduleGameCounts[locationSchedule.Id][gameId]; count > 0 {
+				counts = append(counts, fmt.Sprintf("%s %d", gameId, count))
+				total += count
+			}
+		}
+		fmt.Printf("  %-8s %d total: %s\n", locationSchedule.Id, total, strings.Join(counts, ", "))
+	}
+
+	fmt.Print("\nExpeditions per depth:\n")
+	for _, gameId := range gameIds {
+		depthCounts, ok := gameDepthCounts[gameId]
+		if !ok {
+			continue
+		}
+
+		var depths []int
+		for depth := range depthCounts {
+			depths = append(depths, depth)
+		}
+		sort.Ints(depths)
+
+		var counts []string
+		for _, depth := range depths {
+			counts = append(counts, fmt.Sprintf("%d: %d", depth, depthCounts[depth]))
+		}
+		fmt.Printf("  %-8s %s\n", gameId, strings.Join(counts, ", "))
+	}
+
+	if len(vmCounts) != 0 {
+		var mapIds []int
+		for mapId := range vmCounts {
+			mapIds = append(mapIds, mapId)
+		}
+		sort.Ints(mapIds)
+
+		var counts []string
+		for _, mapId := range mapIds {
+			counts = append(counts, fmt.Sprintf("%04d: %d", mapId, vmCounts[mapId]))
+		}
+		fmt.Printf("\nVending machines per map:\n  %s\n", strings.Join(counts, ", "))
+	}
+}
+
+// getEventSimulationPlayerCounts gets the player counts of every game with
+// event locations, where games without a count are weighed as a single player
+// as they are when generating events
+func getEventSimulationPlayerCounts(playerCounts map[string]int) map[string]int {
+	gamePlayerCounts := make(map[string]int)
+
+	files, err := os.ReadDir("eventlocations/")
+	if err == nil {
+		for _, file := range files {
+			if strings.HasSuffix(file.Name(), ".json") {
+				gameId := strings.TrimSuffix(file.Name(), ".json")
+				gamePlayerCounts[gameId] = playerCounts[gameId]
+			}
+		}
+	}
+
+	for gameId, plugin := range gamePlugins {
+		if plugin.HasEventLocationSource() {
+			gamePlayerCounts[gameId] = playerCounts[gameId]
+		}
+	}
+
+	return gamePlayerCounts
+}
+
+// parseEventSimulationPlayerCounts parses player counts given as a comma
+// separated list of game=count pairs
+func parseEventSimulationPlayerCounts(value string) (map[string]int, error) {
+	playerCounts := make(map[string]int)
+
+	for _, pair := range strings.Split(value, ",") {
+		gameId, countStr, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || gameId == "" {
+			return nil, fmt.Errorf("invalid player count %q", pair)
+		}
+
+		count, err := strconv.Atoi(countStr)
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("invalid player count %q", pair)
+		}
+
+		playerCounts[gameId] = count
+	}
+
+	return playerCounts, nil
+}
@@ -20,8 +20,10 @@ package server
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 func (c *RoomClient) handleSr(msg []string) error {
@@ -90,6 +92,8 @@ func (c *RoomClient) handleM(msg []string) error {
 		c.broadcast(buildMsg("m", c.sClient.id, msg[1:])) // user %id% moved to x y
 	}
 
+	c.sendPartyMoveUpdate()
+
 	return nil
 }
 
@@ -137,8 +141,8 @@ func (c *RoomClient) handleSpr(msg []string) error {
 		return errors.New("invalid sprite")
 	}
 
-	if config.gameName == "2kki" && !isValid2kkiSprite(msg[1], c.room.id) {
-		return errors.New("invalid 2kki sprite")
+	if !config.spritePolicy.IsAllowed(msg[1], c.room.id) {
+		return errors.New("sprite not allowed")
 	}
 
 	index, errconv := strconv.Atoi(msg[2])
@@ -151,6 +155,8 @@ func (c *RoomClient) handleSpr(msg []string) error {
 
 	c.broadcast(buildMsg("spr", c.sClient.id, msg[1:]))
 
+	c.sClient.sendPartyMemberUpdate()
+
 	return nil
 }
 
@@ -236,6 +242,8 @@ func (c *RoomClient) handleSys(msg []string) (err error) {
 
 	c.broadcast(buildMsg("sys", c.sClient.id, msg[1]))
 
+	c.sClient.sendPartyMemberUpdate()
+
 	return nil
 }
 
@@ -454,7 +462,7 @@ func (c *RoomClient) handleBa(msg []string) error {
 }
 
 func (c *RoomClient) handleSay(msg []string) error {
-	if c.sClient.muted {
+	if c.sClient.muted.Load() {
 		return nil
 	}
 
@@ -471,6 +479,11 @@ func (c *RoomClient) handleSay(msg []string) error {
 		return errors.New("invalid message")
 	}
 
+	msgContents, err := c.sClient.filterChatMsg("say", msgContents)
+	if err != nil {
+		return err
+	}
+
 	c.broadcast(buildMsg("say", c.sClient.id, msgContents))
 
 	return nil
@@ -488,23 +501,25 @@ func (c *RoomClient) handleSs(msg []string) error {
 
 	value := msg[2] == "1"
 
-	if config.gameName == "2kki" && c.sClient.rank == 0 && switchId == 11 && value {
-		c.sClient.disconnect()
+	c.switchCache[switchId] = value
+
+	handled, err := gamePlugin.SyncSwitch(c, switchId, value)
+	if err != nil {
+		return err
 	}
 
-	c.switchCache[switchId] = value
-	if switchId == 1430 && config.gameName == "2kki" { // time trial mode
-		if value {
-			c.send <- buildMsg("sv", 88, 0) // time elapsed
-		}
-	} else {
-		if len(c.room.minigames) != 0 {
-			for m, minigame := range c.room.minigames {
+	if !handled {
+		handled = c.syncTimeTrialSwitch(switchId, value)
+	}
+
+	if !handled {
+		if roomMinigames := c.room.getMinigames(); len(roomMinigames) != 0 {
+			for _, minigame := range roomMinigames {
 				if minigame.Dev && c.sClient.rank < 1 {
 					continue
 				}
-				if minigame.SwitchId == switchId && minigame.SwitchValue == value && c.minigameScores[m] < c.varCache[minigame.VarId] {
-					tryWritePlayerMinigameScore(c.sClient.uuid, minigame.Id, c.varCache[minigame.VarId])
+				if minigame.SwitchId == switchId && minigame.SwitchValue == value && minigame.isBetterScore(c.minigameScores[minigame.Id], c.varCache[minigame.VarId]) {
+					c.writeMinigameScore(minigame, c.varCache[minigame.VarId])
 				}
 			}
 		}
@@ -550,8 +565,8 @@ func (c *RoomClient) handleSs(msg []string) error {
 										c.send <- buildMsg("b")
 									}
 								}
-							} else if config.gameName == "2kki" {
-								c.send <- buildMsg("ss", 1430, 0)
+							} else {
+								c.startTimeTrial()
 							}
 						} else {
 							varId := condition.VarId
@@ -575,8 +590,8 @@ func (c *RoomClient) handleSs(msg []string) error {
 											c.send <- buildMsg("b")
 										}
 									}
-								} else if config.gameName == "2kki" {
-									c.send <- buildMsg("ss", 1430, 0)
+								} else {
+									c.startTimeTrial()
 								}
 							} else {
 								varId := condition.VarId
@@ -614,31 +629,22 @@ func (c *RoomClient) handleSv(msg []string) error {
 
 	conditions := append(globalConditions, c.room.conditions...)
 
-	if varId == 88 && config.gameName == "2kki" {
-		for _, condition := range conditions {
-			if condition.TimeTrial && value < 3600 {
-				if c.checkConditionCoords(condition) {
-					success, err := tryWritePlayerTimeTrial(c.sClient.uuid, c.room.id, value)
-					if err != nil {
-						return err
-					}
-					if success {
-						c.send <- buildMsg("b")
-					}
-				}
-			}
-		}
-	} else {
-		if len(c.room.minigames) != 0 {
-			for m, minigame := range c.room.minigames {
+	handled, err := c.syncTimeTrialVar(varId, value)
+	if err != nil {
+		return err
+	}
+
+	if !handled {
+		if roomMinigames := c.room.getMinigames(); len(roomMinigames) != 0 {
+			for _, minigame := range roomMinigames {
 				if minigame.Dev && c.sClient.rank < 1 {
 					continue
 				}
-				if minigame.VarId == varId && c.minigameScores[m] < value {
+				if minigame.VarId == varId && minigame.isBetterScore(c.minigameScores[minigame.Id], value) {
 					if minigame.SwitchId > 0 {
 						c.send <- buildMsg("ss", minigame.SwitchId, 0)
 					} else {
-						tryWritePlayerMinigameScore(c.sClient.uuid, minigame.Id, value)
+						c.writeMinigameScore(minigame, value)
 					}
 				}
 			}
@@ -685,8 +691,8 @@ func (c *RoomClient) handleSv(msg []string) error {
 										c.send <- buildMsg("b")
 									}
 								}
-							} else if config.gameName == "2kki" {
-								c.send <- buildMsg("ss", 1430, 0)
+							} else {
+								c.startTimeTrial()
 							}
 						} else {
 							switchId := condition.SwitchId
@@ -710,8 +716,8 @@ func (c *RoomClient) handleSv(msg []string) error {
 											c.send <- buildMsg("b")
 										}
 									}
-								} else if config.gameName == "2kki" {
-									c.send <- buildMsg("ss", 1430, 0)
+								} else {
+									c.startTimeTrial()
 								}
 							} else {
 								switchId := condition.SwitchId
@@ -814,6 +820,8 @@ func (c *SessionClient) handleName(msg []string) error {
 		c.rClient.broadcast(buildMsg("name", c.id, c.name)) // broadcast name change to room if client is in one
 	}
 
+	c.sendPartyMemberUpdate()
+
 	return nil
 }
 
@@ -833,6 +841,8 @@ func (c *SessionClient) handlePloc(msg []string) error {
 	c.rClient.prevMapId = msg[1]
 	c.rClient.prevLocations = msg[2]
 
+	c.sendPartyMemberUpdate()
+
 	c.rClient.checkRoomConditions("prevMap", c.rClient.prevMapId)
 
 	return nil
@@ -854,13 +864,20 @@ func (c *SessionClient) handleLcol(msg []string) error {
 		return nil
 	}
 
+	if graph, ok := gameLocationGraphs[config.gameName]; ok {
+		if location, ok := graph.titleLocations[locationName]; ok && (location.FgColor != "" || location.BgColor != "") {
+			c.send <- buildMsg("lcol", location.FgColor, location.BgColor)
+			return nil
+		}
+	}
+
 	c.send <- buildMsg("lcol", "", "")
 
 	return nil
 }
 
 func (c *SessionClient) handleGPSay(msg []string) error {
-	if c.muted {
+	if c.muted.Load() {
 		return errors.New("player is muted")
 	}
 
@@ -877,6 +894,11 @@ func (c *SessionClient) handleGPSay(msg []string) error {
 		return errors.New("invalid message")
 	}
 
+	msgContents, err := c.filterChatMsg(msg[0], msgContents)
+	if err != nil {
+		return err
+	}
+
 	enableLocBin := 1
 	var partyId int
 	var partyMemberUuids []string
@@ -932,7 +954,7 @@ func (c *SessionClient) handleGPSay(msg []string) error {
 		}
 	} else {
 		for _, uuid := range partyMemberUuids {
-			if client, ok := clients.Load(uuid); ok {
+			if client, ok := clients.Load(uuid); ok && !client.isBlocking(c.uuid) {
 				client.send <- buildMsg("psay", c.uuid, msgContents, msgId)
 			}
 		}
@@ -954,18 +976,145 @@ func (c *SessionClient) handlePt() error {
 	if partyId == 0 {
 		return errors.New("player not in a party")
 	}
-	partyData, err := getPartyData(partyId)
+	partyDataJson, err := getPartyDataJson(partyId)
 	if err != nil {
 		return err
 	}
-	partyDataJson, err := json.Marshal(partyData)
+
+	c.send <- buildMsg("pt", partyDataJson)
+
+	return nil
+}
+
+func (c *SessionClient) handlePw(msg []string) error {
+	if len(msg) != 5 {
+		return errors.New("segment count mismatch")
+	}
+
+	partyId, err := getPlayerPartyId(c.uuid)
 	if err != nil {
 		return err
 	}
+	if partyId == 0 {
+		return errors.New("player not in a party")
+	}
 
-	c.send <- buildMsg("pt", partyDataJson)
+	mapId, errconv := strconv.Atoi(msg[1])
+	if errconv != nil || mapId < 0 {
+		return errors.New("invalid map id")
+	}
+	x, errconv := strconv.Atoi(msg[2])
+	if errconv != nil || x < 0 {
+		return errors.New("invalid x")
+	}
+	y, errconv := strconv.Atoi(msg[3])
+	if errconv != nil || y < 0 {
+		return errors.New("invalid y")
+	}
 
-	return nil
+	label := strings.TrimSpace(msg[4])
+	if utf8.RuneCountInString(label) > 30 {
+		return errors.New("label too long")
+	}
+	if c.muted.Load() && label != "" {
+		return errors.New("player is muted")
+	}
+
+	return setPartyWaypoint(partyId, &PartyWaypoint{
+		Uuid:  c.uuid,
+		MapId: fmt.Sprintf("%04d", mapId),
+		X:     x,
+		Y:     y,
+		Label: label,
+	})
+}
+
+func (c *SessionClient) handlePwc(msg []string) error {
+	if len(msg) > 2 {
+		return errors.New("segment count mismatch")
+	}
+
+	partyId, err := getPlayerPartyId(c.uuid)
+	if err != nil {
+		return err
+	}
+	if partyId == 0 {
+		return errors.New("player not in a party")
+	}
+
+	waypointUuid := c.uuid
+	if len(msg) == 2 && msg[1] != c.uuid {
+		// the owner and officers can clear any member's waypoint
+		ownerUuid, err := getPartyOwnerUuid(partyId)
+		if err != nil {
+			return err
+		}
+		if ownerUuid != c.uuid {
+			isOfficer, err := isPartyOfficer(partyId, c.uuid)
+			if err != nil {
+				return err
+			}
+			if !isOfficer {
+				return errors.New("attempted waypoint clear from non-officer")
+			}
+		}
+		waypointUuid = msg[1]
+	}
+
+	return clearPartyWaypoint(partyId, waypointUuid)
+}
+
+func (c *SessionClient) handlePg(msg []string) error {
+	if len(msg) != 1 && len(msg) != 4 {
+		return errors.New("segment count mismatch")
+	}
+
+	partyId, err := getPlayerPartyId(c.uuid)
+	if err != nil {
+		return err
+	}
+	if partyId == 0 {
+		return errors.New("player not in a party")
+	}
+
+	ownerUuid, err := getPartyOwnerUuid(partyId)
+	if err != nil {
+		return err
+	}
+	if ownerUuid != c.uuid {
+		return errors.New("attempted party gather from non-owner")
+	}
+
+	partyGather := &PartyGather{
+		Uuid: c.uuid,
+		Name: c.name,
+	}
+
+	if len(msg) == 4 {
+		mapId, errconv := strconv.Atoi(msg[1])
+		if errconv != nil || mapId < 0 {
+			return errors.New("invalid map id")
+		}
+		partyGather.X, errconv = strconv.Atoi(msg[2])
+		if errconv != nil || partyGather.X < 0 {
+			return errors.New("invalid x")
+		}
+		partyGather.Y, errconv = strconv.Atoi(msg[3])
+		if errconv != nil || partyGather.Y < 0 {
+			return errors.New("invalid y")
+		}
+		partyGather.MapId = fmt.Sprintf("%04d", mapId)
+	} else {
+		// gather at the owner's location
+		if c.rClient == nil {
+			return errors.New("room client does not exist")
+		}
+		partyGather.MapId = c.rClient.mapId
+		partyGather.X = c.rClient.x
+		partyGather.Y = c.rClient.y
+	}
+
+	return sendPartyGather(partyId, partyGather)
 }
 
 func (c *SessionClient) handleEp() error {
@@ -996,17 +1145,15 @@ func (c *SessionClient) handleE() error {
 		}
 	}
 	if !hasIncompleteEvent {
-		if config.gameName == "2kki" {
-			addPlayer2kkiEventLocation(currentGameEventPeriodId, -1, freeEventLocationMinDepth, 0, 0, c.uuid)
-		} else if len(freeEventLocationPool) > 0 {
-			addPlayerEventLocation(config.gameName, -1, 0, freeEventLocationPool, c.uuid)
-		}
+		addPlayerFreeEventLocation(c.uuid)
 		currentEventLocationsData, err = getCurrentPlayerEventLocationsData(c.uuid)
 		if err != nil {
 			return err
 		}
 	}
 
+	c.updateFreeEventLocationMapIds()
+
 	currentEventVmsData, err := getCurrentPlayerEventVmsData(c.uuid)
 	if err != nil {
 		return err
@@ -1100,11 +1247,7 @@ func (c *SessionClient) handleEec(msg []string) error {
 		}
 	}
 	if !hasIncompleteEvent {
-		if config.gameName == "2kki" {
-			addPlayer2kkiEventLocation(currentGameEventPeriodId, -1, freeEventLocationMinDepth, 0, 0, c.uuid)
-		} else if len(freeEventLocationPool) > 0 {
-			addPlayerEventLocation(config.gameName, -1, 0, freeEventLocationPool, c.uuid)
-		}
+		addPlayerFreeEventLocation(c.uuid)
 	}
 
 	c.send <- buildMsg("eec", exp, true)
@@ -45,8 +45,9 @@ type ChatMessage struct {
 }
 
 type ChatHistory struct {
-	Players  []*ChatPlayer  `json:"players"`
-	Messages []*ChatMessage `json:"messages"`
+	Players        []*ChatPlayer    `json:"players"`
+	Messages       []*ChatMessage   `json:"messages"`
+	DirectMessages []*DirectMessage `json:"directMessages,omitempty"`
 }
 
 var (
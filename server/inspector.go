@@ -0,0 +1,267 @@
+/*
+	Copyright (C) 2021-2023  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const clientErrorHistorySize = 10
+
+// ClientStats tracks the activity of a session and its room clients for the
+// session inspector
+type ClientStats struct {
+	mtx sync.Mutex
+
+	connected time.Time
+
+	sessionMsgs MsgCounter
+	roomMsgs    MsgCounter
+
+	errors    [clientErrorHistorySize]*ClientError
+	errorsIdx int
+}
+
+// MsgCounter counts messages, keeping the count of the last full minute
+type MsgCounter struct {
+	total           int
+	windowStart     time.Time
+	windowCount     int
+	lastWindowCount int
+}
+
+type ClientError struct {
+	Location  string    `json:"location"`
+	Error     string    `json:"error"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type AdminSession struct {
+	Uuid       string `json:"uuid"`
+	Name       string `json:"name"`
+	Rank       int    `json:"rank"`
+	Account    bool   `json:"account"`
+	Ip         string `json:"ip,omitempty"`
+	Muted      bool   `json:"muted"`
+	Connected  int    `json:"connectedSeconds"`
+	SystemName string `json:"systemName"`
+
+	SpriteName  string `json:"spriteName"`
+	SpriteIndex int    `json:"spriteIndex"`
+
+	PartyId int `json:"partyId"`
+
+	MapId string `json:"mapId"`
+	X     int    `json:"x"`
+	Y     int    `json:"y"`
+
+	SendFill     float64 `json:"sendFill"`
+	RoomSendFill float64 `json:"roomSendFill"`
+
+	SessionMsgsTotal     int `json:"sessionMsgsTotal"`
+	SessionMsgsPerMinute int `json:"sessionMsgsPerMinute"`
+	RoomMsgsTotal        int `json:"roomMsgsTotal"`
+	RoomMsgsPerMinute    int `json:"roomMsgsPerMinute"`
+
+	Errors []*ClientError `json:"errors"`
+}
+
+type AdminRoom struct {
+	MapId        string          `json:"mapId"`
+	Singleplayer bool            `json:"singleplayer"`
+	Sessions     []*AdminSession `json:"sessions"`
+}
+
+func newClientStats() *ClientStats {
+	return &ClientStats{connected: time.Now()}
+}
+
+func (m *MsgCounter) add(now time.Time) {
+	m.roll(now)
+	m.total++
+	m.windowCount++
+}
+
+func (m *MsgCounter) roll(now time.Time) {
+	if now.Sub(m.windowStart) < time.Minute {
+		return
+	}
+
+	// the last window is empty if more than a minute passed since it ended
+	if now.Sub(m.windowStart) < 2*time.Minute {
+		m.lastWindowCount = m.windowCount
+	} else {
+		m.lastWindowCount = 0
+	}
+	m.windowStart = now
+	m.windowCount = 0
+}
+
+func (s *ClientStats) addSessionMsg() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.sessionMsgs.add(time.Now())
+}
+
+func (s *ClientStats) addRoomMsg() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.roomMsgs.add(time.Now())
+}
+
+func (s *ClientStats) addError(location string, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.errors[s.errorsIdx] = &ClientError{
+		Location:  location,
+		Error:     err.Error(),
+		Timestamp: time.Now(),
+	}
+	s.errorsIdx = (s.errorsIdx + 1) % clientErrorHistorySize
+}
+
+// getAdminSession gets the live state of a session
+func (c *SessionClient) getAdminSession(showIp bool) *AdminSession {
+	session := &AdminSession{
+		Uuid:        c.uuid,
+		Name:        c.name,
+		Rank:        c.rank,
+		Account:     c.account,
+		Muted:       c.muted.Load(),
+		SystemName:  c.systemName,
+		SpriteName:  c.spriteName,
+		SpriteIndex: c.spriteIndex,
+		SendFill:    float64(len(c.send)) / float64(cap(c.send)),
+		Errors:      []*ClientError{},
+	}
+
+	if showIp {
+		session.Ip = c.ip
+	}
+
+	session.PartyId = c.getPartyId()
+
+	if rClient := c.rClient; rClient != nil {
+		session.MapId = rClient.mapId
+		session.X = rClient.x
+		session.Y = rClient.y
+		session.RoomSendFill = float64(len(rClient.send)) / float64(cap(rClient.send))
+	}
+
+	c.stats.mtx.Lock()
+	defer c.stats.mtx.Unlock()
+
+	now := time.Now()
+
+	session.Connected = int(now.Sub(c.stats.connected).Seconds())
+
+	c.stats.sessionMsgs.roll(now)
+	session.SessionMsgsTotal = c.stats.sessionMsgs.total
+	session.SessionMsgsPerMinute = c.stats.sessionMsgs.lastWindowCount
+
+	c.stats.roomMsgs.roll(now)
+	session.RoomMsgsTotal = c.stats.roomMsgs.total
+	session.RoomMsgsPerMinute = c.stats.roomMsgs.lastWindowCount
+
+	// newest first
+	for i := 1; i <= clientErrorHistorySize; i++ {
+		clientError := c.stats.errors[(c.stats.errorsIdx-i+clientErrorHistorySize)%clientErrorHistorySize]
+		if clientError == nil {
+			break
+		}
+		session.Errors = append(session.Errors, clientError)
+	}
+
+	return session
+}
+
+func adminSessions(w http.ResponseWriter, r *http.Request) {
+	showIp := getAdminActor(r).hasPermission(permissionViewIp)
+
+	commandParam := r.URL.Query().Get("command")
+	if commandParam == "" {
+		handleError(w, r, "command not specified")
+		return
+	}
+
+	var response any
+
+	switch commandParam {
+	case "list":
+		sessions := []*AdminSession{}
+		for _, client := range clients.Get() {
+			sessions = append(sessions, client.getAdminSession(showIp))
+		}
+
+		response = sessions
+	case "session":
+		client, ok := clients.Load(r.URL.Query().Get("uuid"))
+		if !ok {
+			handleError(w, r, "session not found")
+			return
+		}
+
+		response = client.getAdminSession(showIp)
+	case "room":
+		roomId, err := strconv.Atoi(r.URL.Query().Get("mapId"))
+		if err != nil {
+			handleError(w, r, "invalid mapId value")
+			return
+		}
+
+		room, ok := rooms[roomId]
+		if !ok {
+			handleError(w, r, "room not found")
+			return
+		}
+
+		adminRoom := &AdminRoom{
+			MapId:        fmt.Sprintf("%04d", roomId),
+			Singleplayer: room.singleplayer,
+			Sessions:     []*AdminSession{},
+		}
+
+		// singleplayer rooms keep no clients, so find their players by map
+		for _, client := range clients.Get() {
+			if rClient := client.rClient; rClient != nil && rClient.room == room {
+				adminRoom.Sessions = append(adminRoom.Sessions, client.getAdminSession(showIp))
+			}
+		}
+
+		response = adminRoom
+	default:
+		handleError(w, r, "unknown command")
+		return
+	}
+
+	responseJson, err := json.Marshal(response)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	w.Write(responseJson)
+}
@@ -0,0 +1,475 @@
+/*
+	Copyright (C) 2021-2023  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	leaderboardPageSize    = 25
+	leaderboardMaxPageSize = 100
+)
+
+type LeaderboardEntry struct {
+	Position int    `json:"position"`
+	Uuid     string `json:"uuid"`
+	Name     string `json:"name"`
+	Rank     int    `json:"rank"`
+	Badge    string `json:"badge"`
+	Value    int    `json:"value"`
+}
+
+type Leaderboard struct {
+	Category      string              `json:"category"`
+	SubCategory   string              `json:"subCategory"`
+	Game          string              `json:"game,omitempty"`
+	LowerIsBetter bool                `json:"lowerIsBetter"`
+	Entries       []*LeaderboardEntry `json:"entries"`
+
+	playerIndexes map[string]int
+}
+
+type LeaderboardPage struct {
+	Category    string              `json:"category"`
+	SubCategory string              `json:"subCategory"`
+	Game        string              `json:"game,omitempty"`
+	Page        int                 `json:"page"`
+	PageCount   int                 `json:"pageCount"`
+	Entries     []*LeaderboardEntry `json:"entries"`
+}
+
+type LeaderboardCategory struct {
+	Category      string   `json:"category"`
+	SubCategories []string `json:"subCategories"`
+	Games         []string `json:"games"`
+}
+
+// leaderboardRow is a single player's value for one game in a category
+type leaderboardRow struct {
+	subCategory string
+	game        string
+	uuid        string
+	name        string
+	rank        int
+	badge       string
+	value       int
+}
+
+var (
+	leaderboards      map[string]*Leaderboard
+	leaderboardsMutex sync.RWMutex
+)
+
+func initLeaderboards() {
+	leaderboards = make(map[string]*Leaderboard)
+
+	scheduler.Every(15).Minutes().Do(updateLeaderboards)
+}
+
+func getLeaderboardKey(category string, subCategory string, game string) string {
+	return category + "/" + subCategory + "/" + game
+}
+
+// getGameSubCategory qualifies a sub category that is only unique within a
+// game for use on an all-games leaderboard
+func getGameSubCategory(game string, subCategory string) string {
+	return game + ":" + subCategory
+}
+
+func updateLeaderboards() {
+	newLeaderboards := make(map[string]*Leaderboard)
+
+	minigameRows, err := getMinigameLeaderboardRows()
+	if err != nil {
+		writeErrLog("SERVER", "leaderboards", err.Error())
+	} else {
+		var ascendingMinigameRows, descendingMinigameRows []*leaderboardRow
+		for _, row := range minigameRows {
+			if minigame, ok := getMinigame(row.game, row.subCategory); ok && minigame.LowerIsBetter {
+				ascendingMinigameRows = append(ascendingMinigameRows, row)
+			} else {
+				descendingMinigameRows = append(descendingMinigameRows, row)
+			}
+		}
+		// minigame ids are only unique within a game and games can sort them
+		// differently, so the all-games boards are keyed by game as well
+		addLeaderboards(newLeaderboards, "minigame", ascendingMinigameRows, true, false, true)
+		addLeaderboards(newLeaderboards, "minigame", descendingMinigameRows, false, false, true)
+	}
+
+	timeTrialRows, err := getTimeTrialLeaderboardRows()
+	if err != nil {
+		writeErrLog("SERVER", "leaderboards", err.Error())
+	} else {
+		addLeaderboards(newLeaderboards, "timeTrial", timeTrialRows, true, false, false)
+	}
+
+	for _, subCategory := range []string{"week", "period", "total"} {
+		expRows, err := getExpLeaderboardRows(subCategory)
+		if err != nil {
+			writeErrLog("SERVER", "leaderboards", err.Error())
+			continue
+		}
+		addLeaderboards(newLeaderboards, "exp", expRows, false, true, false)
+	}
+
+	for _, subCategory := range []string{"bp", "count"} {
+		badgeRows, err := getBadgeLeaderboardRows(subCategory)
+		if err != nil {
+			writeErrLog("SERVER", "leaderboards", err.Error())
+			continue
+		}
+		addLeaderboards(newLeaderboards, "badge", badgeRows, false, true, false)
+	}
+
+	leaderboardsMutex.Lock()
+	leaderboards = newLeaderboards
+	leaderboardsMutex.Unlock()
+}
+
+// addLeaderboards builds one leaderboard per sub category and game as well as
+// one across all games, which either sums or takes the best value per player;
+// with gameSubCategories the all-games sub category includes the game
+func addLeaderboards(leaderboardMap map[string]*Leaderboard, category string, rows []*leaderboardRow, lowerIsBetter bool, sum bool, gameSubCategories bool) {
+	for _, row := range rows {
+		for _, game := range []string{row.game, ""} {
+			subCategory := row.subCategory
+			if game == "" && gameSubCategories {
+				subCategory = getGameSubCategory(row.game, row.subCategory)
+			}
+
+			key := getLeaderboardKey(category, subCategory, game)
+
+			leaderboard, ok := leaderboardMap[key]
+			if !ok {
+				leaderboard = &Leaderboard{
+					Category:      category,
+					SubCategory:   subCategory,
+					Game:          game,
+					LowerIsBetter: lowerIsBetter,
+					playerIndexes: make(map[string]int),
+				}
+				leaderboardMap[key] = leaderboard
+			}
+
+			if idx, ok := leaderboard.playerIndexes[row.uuid]; ok {
+				entry := leaderboard.Entries[idx]
+				if sum {
+					entry.Value += row.value
+				} else if lowerIsBetter == (row.value < entry.Value) {
+					entry.Value = row.value
+				}
+				continue
+			}
+
+			leaderboard.playerIndexes[row.uuid] = len(leaderboard.Entries)
+			leaderboard.Entries = append(leaderboard.Entries, &LeaderboardEntry{
+				Uuid:  row.uuid,
+				Name:  row.name,
+				Rank:  row.rank,
+				Badge: row.badge,
+				Value: row.value,
+			})
+		}
+	}
+
+	for _, leaderboard := range leaderboardMap {
+		if leaderboard.Category == category {
+			leaderboard.rankEntries()
+		}
+	}
+}
+
+// rankEntries sorts entries and assigns positions, giving tied values the
+// same position and skipping the positions they would otherwise occupy
+func (l *Leaderboard) rankEntries() {
+	sort.SliceStable(l.Entries, func(a, b int) bool {
+		entryA, entryB := l.Entries[a], l.Entries[b]
+		if entryA.Value != entryB.Value {
+			if l.LowerIsBetter {
+				return entryA.Value < entryB.Value
+			}
+			return entryA.Value > entryB.Value
+		}
+		return entryA.Name < entryB.Name
+	})
+
+	for i, entry := range l.Entries {
+		if i > 0 && entry.Value == l.Entries[i-1].Value {
+			entry.Position = l.Entries[i-1].Position
+		} else {
+			entry.Position = i + 1
+		}
+
+		l.playerIndexes[entry.Uuid] = i
+	}
+}
+
+func (l *Leaderboard) getPage(page int, pageSize int) *LeaderboardPage {
+	pageCount := int(math.Ceil(float64(len(l.Entries)) / float64(pageSize)))
+
+	if page > pageCount {
+		page = pageCount
+	}
+	if page < 1 {
+		page = 1
+	}
+
+	start := (page - 1) * pageSize
+	end := start + pageSize
+	if end > len(l.Entries) {
+		end = len(l.Entries)
+	}
+
+	return &LeaderboardPage{
+		Category:    l.Category,
+		SubCategory: l.SubCategory,
+		Game:        l.Game,
+		Page:        page,
+		PageCount:   pageCount,
+		Entries:     l.Entries[start:end],
+	}
+}
+
+// getWindow returns the page containing the specified player, so the page
+// number matches the entries returned and paging on from it lines up
+func (l *Leaderboard) getWindow(playerUuid string, size int) (*LeaderboardPage, error) {
+	idx, ok := l.playerIndexes[playerUuid]
+	if !ok {
+		return nil, errors.New("player not on leaderboard")
+	}
+
+	return l.getPage(idx/size+1, size), nil
+}
+
+func getLeaderboardCategories() (categories []*LeaderboardCategory) {
+	leaderboardsMutex.RLock()
+	defer leaderboardsMutex.RUnlock()
+
+	categoryMap := make(map[string]*LeaderboardCategory)
+	subCategoryMap := make(map[string]bool)
+	gameMap := make(map[string]bool)
+
+	for _, leaderboard := range leaderboards {
+		category, ok := categoryMap[leaderboard.Category]
+		if !ok {
+			category = &LeaderboardCategory{Category: leaderboard.Category}
+			categoryMap[leaderboard.Category] = category
+			categories = append(categories, category)
+		}
+
+		if subCategoryKey := leaderboard.Category + "/" + leaderboard.SubCategory; !subCategoryMap[subCategoryKey] {
+			category.SubCategories = append(category.SubCategories, leaderboard.SubCategory)
+			subCategoryMap[subCategoryKey] = true
+		}
+
+		if gameKey := leaderboard.Category + "/" + leaderboard.Game; leaderboard.Game != "" && !gameMap[gameKey] {
+			category.Games = append(category.Games, leaderboard.Game)
+			gameMap[gameKey] = true
+		}
+	}
+
+	sort.Slice(categories, func(a, b int) bool {
+		return categories[a].Category < categories[b].Category
+	})
+
+	for _, category := range categories {
+		sort.Strings(category.SubCategories)
+		sort.Strings(category.Games)
+	}
+
+	return categories
+}
+
+func getLeaderboard(category string, subCategory string, game string) (*Leaderboard, bool) {
+	leaderboardsMutex.RLock()
+	defer leaderboardsMutex.RUnlock()
+
+	leaderboard, ok := leaderboards[getLeaderboardKey(category, subCategory, game)]
+
+	return leaderboard, ok
+}
+
+func handleLeaderboard(w http.ResponseWriter, r *http.Request) {
+	commandParam := r.URL.Query().Get("command")
+	if commandParam == "" {
+		handleError(w, r, "command not specified")
+		return
+	}
+
+	if commandParam == "categories" {
+		categoriesJson, err := json.Marshal(getLeaderboardCategories())
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		w.Write(categoriesJson)
+		return
+	}
+
+	categoryParam := r.URL.Query().Get("category")
+	if categoryParam == "" {
+		handleError(w, r, "category not specified")
+		return
+	}
+
+	subCategoryParam := r.URL.Query().Get("subCategory")
+	if subCategoryParam == "" {
+		handleError(w, r, "subCategory not specified")
+		return
+	}
+
+	leaderboard, ok := getLeaderboard(categoryParam, subCategoryParam, r.URL.Query().Get("game"))
+	if !ok {
+		handleError(w, r, "leaderboard not found")
+		return
+	}
+
+	pageSize := leaderboardPageSize
+	if sizeParam := r.URL.Query().Get("size"); sizeParam != "" {
+		size, err := strconv.Atoi(sizeParam)
+		if err != nil || size <= 0 {
+			handleError(w, r, "invalid size value")
+			return
+		}
+		if size < leaderboardMaxPageSize {
+			pageSize = size
+		} else {
+			pageSize = leaderboardMaxPageSize
+		}
+	}
+
+	var leaderboardPage *LeaderboardPage
+
+	switch commandParam {
+	case "list":
+		page := 1
+		if pageParam := r.URL.Query().Get("page"); pageParam != "" {
+			var err error
+			page, err = strconv.Atoi(pageParam)
+			if err != nil {
+				handleError(w, r, "invalid page value")
+				return
+			}
+		}
+
+		leaderboardPage = leaderboard.getPage(page, pageSize)
+	case "around":
+		uuid := r.URL.Query().Get("uuid")
+		if uuid == "" {
+			token := r.Header.Get("Authorization")
+			if token == "" {
+				handleError(w, r, "uuid or token not specified")
+				return
+			}
+			uuid = getUuidFromToken(token)
+			if uuid == "" {
+				handleError(w, r, "invalid token")
+				return
+			}
+		}
+
+		var err error
+		leaderboardPage, err = leaderboard.getWindow(uuid, pageSize)
+		if err != nil {
+			handleError(w, r, err.Error())
+			return
+		}
+	default:
+		handleError(w, r, "unknown command")
+		return
+	}
+
+	leaderboardPageJson, err := json.Marshal(leaderboardPage)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	w.Write(leaderboardPageJson)
+}
+
+const leaderboardPlayerJoinClause = " JOIN accounts a ON a.uuid = lb.uuid JOIN players pd ON pd.uuid = a.uuid WHERE pd.banned = 0"
+
+func scanLeaderboardRows(query string, args ...any) (rows []*leaderboardRow, err error) {
+	results, err := db.Query(query, args...)
+	if err != nil {
+		return rows, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		row := &leaderboardRow{}
+
+		err := results.Scan(&row.subCategory, &row.game, &row.uuid, &row.name, &row.rank, &row.badge, &row.value)
+		if err != nil {
+			return rows, err
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+func getMinigameLeaderboardRows() ([]*leaderboardRow, error) {
+	return scanLeaderboardRows("SELECT lb.minigameId, lb.game, lb.uuid, a.user, pd.rank, a.badge, lb.score FROM playerMinigameScores lb" + leaderboardPlayerJoinClause + " AND lb.score > 0")
+}
+
+func getTimeTrialLeaderboardRows() ([]*leaderboardRow, error) {
+	return scanLeaderboardRows("SELECT lb.mapId, lb.game, lb.uuid, a.user, pd.rank, a.badge, MIN(lb.seconds) FROM playerTimeTrialRuns lb" + leaderboardPlayerJoinClause + " GROUP BY lb.mapId, lb.game, lb.uuid, a.user, pd.rank, a.badge")
+}
+
+func getExpLeaderboardRows(subCategory string) ([]*leaderboardRow, error) {
+	var locationWhereClause, vmWhereClause string
+	var args []any
+
+	switch subCategory {
+	case "week":
+		weekdayIndex := int(time.Now().UTC().Weekday())
+		locationWhereClause = " WHERE ep.id = ? AND DATE_SUB(UTC_DATE(), INTERVAL ? DAY) <= el.startDate AND DATE_ADD(UTC_DATE(), INTERVAL ? DAY) >= el.endDate"
+		vmWhereClause = " WHERE ep.id = ? AND DATE_SUB(UTC_DATE(), INTERVAL ? DAY) <= ev.startDate AND DATE_ADD(UTC_DATE(), INTERVAL ? DAY) >= ev.endDate"
+		args = append(args, currentEventPeriodId, weekdayIndex, 7-weekdayIndex, currentEventPeriodId, weekdayIndex, 7-weekdayIndex)
+	case "period":
+		locationWhereClause = " WHERE ep.id = ?"
+		vmWhereClause = " WHERE ep.id = ?"
+		args = append(args, currentEventPeriodId, currentEventPeriodId)
+	}
+
+	query := "SELECT ?, lb.game, lb.uuid, a.user, pd.rank, a.badge, SUM(lb.exp) FROM ((SELECT ec.uuid, gep.game, ec.exp FROM eventCompletions ec JOIN eventLocations el ON el.id = ec.eventId AND ec.type = 0 JOIN gameEventPeriods gep ON gep.id = el.gamePeriodId JOIN eventPeriods ep ON ep.id = gep.periodId" + locationWhereClause + ") UNION ALL (SELECT ec.uuid, gep.game, ec.exp FROM eventCompletions ec JOIN eventVms ev ON ev.id = ec.eventId AND ec.type = 2 JOIN gameEventPeriods gep ON gep.id = ev.gamePeriodId JOIN eventPeriods ep ON ep.id = gep.periodId" + vmWhereClause + ")) lb" + leaderboardPlayerJoinClause + " GROUP BY lb.game, lb.uuid, a.user, pd.rank, a.badge HAVING SUM(lb.exp) > 0"
+
+	return scanLeaderboardRows(query, append([]any{subCategory}, args...)...)
+}
+
+func getBadgeLeaderboardRows(subCategory string) ([]*leaderboardRow, error) {
+	valueClause := "SUM(b.bp)"
+	if subCategory == "count" {
+		valueClause = "COUNT(b.badgeId)"
+	}
+
+	return scanLeaderboardRows("SELECT ?, b.game, lb.uuid, a.user, pd.rank, a.badge, "+valueClause+" FROM playerBadges lb JOIN badges b ON b.badgeId = lb.badgeId AND b.hidden = 0"+leaderboardPlayerJoinClause+" GROUP BY b.game, lb.uuid, a.user, pd.rank, a.badge", subCategory)
+}
@@ -0,0 +1,354 @@
+/*
+	Copyright (C) 2021-2023  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// game ID -> location graph
+var gameLocationGraphs = make(map[string]*LocationGraph)
+
+type Location struct {
+	Title       string   `json:"title"`
+	TitleJP     string   `json:"titleJP,omitempty"`
+	Depth       int      `json:"depth"`
+	MinDepth    int      `json:"minDepth,omitempty"`
+	FgColor     string   `json:"fgColor,omitempty"`
+	BgColor     string   `json:"bgColor,omitempty"`
+	MapIds      []string `json:"mapIds"`
+	Connections []string `json:"connections,omitempty"` // titles of connected locations
+}
+
+type LocationGraph struct {
+	locations      []*Location
+	mapLocations   map[string][]*Location
+	titleLocations map[string]*Location
+}
+
+func newLocationGraph(locations []*Location) *LocationGraph {
+	graph := &LocationGraph{
+		locations:      locations,
+		mapLocations:   make(map[string][]*Location),
+		titleLocations: make(map[string]*Location),
+	}
+
+	for _, location := range locations {
+		graph.titleLocations[location.Title] = location
+		for _, mapId := range location.MapIds {
+			graph.mapLocations[mapId] = append(graph.mapLocations[mapId], location)
+		}
+	}
+
+	return graph
+}
+
+// setLocations reads the location graph of each game from locations/, falling
+// back to the event locations of games without one
+func setLocations() {
+	gameIds := make(map[string]bool)
+
+	for _, dir := range []string{"locations/", "eventlocations/"} {
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+
+		for _, file := range files {
+			name := file.Name()
+			if strings.HasSuffix(name, ".json") {
+				gameIds[strings.TrimSuffix(name, ".json")] = true
+			} else if dir == "locations/" && strings.HasSuffix(name, ".csv") {
+				gameIds[strings.TrimSuffix(name, ".csv")] = true
+			}
+		}
+	}
+
+	for gameId := range gameIds {
+		locations, err := readLocations(gameId)
+		if err != nil {
+			writeErrLog("SERVER", "locations", gameId+": "+err.Error())
+			continue
+		}
+
+		gameLocationGraphs[gameId] = newLocationGraph(locations)
+	}
+}
+
+func readLocations(gameId string) ([]*Location, error) {
+	if data, err := os.ReadFile("locations/" + gameId + ".json"); err == nil {
+		var locations []*Location
+		err = json.Unmarshal(data, &locations)
+		return locations, err
+	}
+
+	if file, err := os.Open("locations/" + gameId + ".csv"); err == nil {
+		defer file.Close()
+		return readLocationsCsv(file)
+	}
+
+	data, err := os.ReadFile("eventlocations/" + gameId + ".json")
+	if err != nil {
+		return nil, err
+	}
+
+	var eventLocations []*EventLocationData
+	err = json.Unmarshal(data, &eventLocations)
+	if err != nil {
+		return nil, err
+	}
+
+	var locations []*Location
+	for _, eventLocation := range eventLocations {
+		locations = append(locations, &Location{
+			Title:    eventLocation.Title,
+			TitleJP:  eventLocation.TitleJP,
+			Depth:    eventLocation.Depth,
+			MinDepth: eventLocation.MinDepth,
+			FgColor:  eventLocation.FgColor,
+			BgColor:  eventLocation.BgColor,
+			MapIds:   eventLocation.MapIds,
+		})
+	}
+
+	return locations, nil
+}
+
+// readLocationsCsv reads locations from CSV with a header row naming the
+// columns, where map IDs and connections are separated by semicolons
+func readLocationsCsv(reader io.Reader) ([]*Location, error) {
+	records, err := csv.NewReader(reader).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) == 0 {
+		return nil, errors.New("missing header row")
+	}
+
+	columns := make(map[string]int)
+	for i, column := range records[0] {
+		columns[strings.TrimSpace(column)] = i
+	}
+	if _, ok := columns["title"]; !ok {
+		return nil, errors.New("missing title column")
+	}
+
+	getField := func(record []string, column string) string {
+		if i, ok := columns[column]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	getList := func(record []string, column string) (list []string) {
+		for _, item := range strings.Split(getField(record, column), ";") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return list
+	}
+
+	var locations []*Location
+	for i, record := range records[1:] {
+		location := &Location{
+			Title:       getField(record, "title"),
+			TitleJP:     getField(record, "titleJP"),
+			FgColor:     getField(record, "fgColor"),
+			BgColor:     getField(record, "bgColor"),
+			MapIds:      getList(record, "mapIds"),
+			Connections: getList(record, "connections"),
+		}
+		if location.Title == "" {
+			return nil, fmt.Errorf("row %d: missing title", i+2)
+		}
+
+		if depth := getField(record, "depth"); depth != "" {
+			location.Depth, err = strconv.Atoi(depth)
+			if err != nil {
+				return nil, fmt.Errorf("row %d: invalid depth", i+2)
+			}
+		}
+		location.MinDepth = location.Depth
+		if minDepth := getField(record, "minDepth"); minDepth != "" {
+			location.MinDepth, err = strconv.Atoi(minDepth)
+			if err != nil {
+				return nil, fmt.Errorf("row %d: invalid minDepth", i+2)
+			}
+		}
+
+		for j, mapId := range location.MapIds {
+			mapIdInt, err := strconv.Atoi(mapId)
+			if err != nil {
+				return nil, fmt.Errorf("row %d: invalid map ID %s", i+2, mapId)
+			}
+			location.MapIds[j] = fmt.Sprintf("%04d", mapIdInt)
+		}
+
+		locations = append(locations, location)
+	}
+
+	return locations, nil
+}
+
+// importLocations merges locations from the game plugin's import source into
+// the game's location file
+func importLocations(gameId string) error {
+	importedLocations, err := getGamePlugin(gameId).ImportLocations()
+	if err != nil {
+		return err
+	}
+
+	locations, err := readLocations(gameId)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	graph := newLocationGraph(locations)
+
+	for _, importedLocation := range importedLocations {
+		location, ok := graph.titleLocations[importedLocation.Title]
+		if !ok {
+			graph.locations = append(graph.locations, importedLocation)
+			graph.titleLocations[importedLocation.Title] = importedLocation
+			continue
+		}
+
+		if location.TitleJP == "" {
+			location.TitleJP = importedLocation.TitleJP
+		}
+		if location.Depth == 0 {
+			location.Depth = importedLocation.Depth
+			location.MinDepth = importedLocation.MinDepth
+		}
+		if location.FgColor == "" && location.BgColor == "" {
+			location.FgColor = importedLocation.FgColor
+			location.BgColor = importedLocation.BgColor
+		}
+		location.MapIds = mergeLocationLists(location.MapIds, importedLocation.MapIds)
+		location.Connections = mergeLocationLists(location.Connections, importedLocation.Connections)
+	}
+
+	sort.Slice(graph.locations, func(a, b int) bool {
+		return graph.locations[a].Title < graph.locations[b].Title
+	})
+
+	data, err := json.MarshalIndent(graph.locations, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll("locations", 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile("locations/"+gameId+".json", data, 0644)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported %d locations into locations/%s.json.\n", len(importedLocations), gameId)
+
+	return nil
+}
+
+func mergeLocationLists(list []string, items []string) []string {
+	for _, item := range items {
+		var found bool
+		for _, listItem := range list {
+			if listItem == item {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, item)
+		}
+	}
+
+	sort.Strings(list)
+
+	return list
+}
+
+func handleLocations(w http.ResponseWriter, r *http.Request) {
+	commandParam := r.URL.Query().Get("command")
+	if commandParam == "" {
+		handleError(w, r, "command not specified")
+		return
+	}
+
+	gameId := r.URL.Query().Get("game")
+	if gameId == "" {
+		gameId = config.gameName
+	}
+
+	graph, ok := gameLocationGraphs[gameId]
+	if !ok {
+		handleError(w, r, "invalid game")
+		return
+	}
+
+	var response any
+
+	switch commandParam {
+	case "list":
+		response = graph.locations
+	case "map":
+		mapId, err := strconv.Atoi(r.URL.Query().Get("mapId"))
+		if err != nil {
+			handleError(w, r, "invalid mapId value")
+			return
+		}
+
+		locations := graph.mapLocations[fmt.Sprintf("%04d", mapId)]
+		if locations == nil {
+			locations = []*Location{}
+		}
+		response = locations
+	case "location":
+		location, ok := graph.titleLocations[r.URL.Query().Get("title")]
+		if !ok {
+			handleError(w, r, "location not found")
+			return
+		}
+		response = location
+	default:
+		handleError(w, r, "unknown command")
+		return
+	}
+
+	responseJson, err := json.Marshal(response)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	w.Write(responseJson)
+}
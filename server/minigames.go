@@ -17,30 +17,209 @@
 
 package server
 
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+)
+
+var (
+	minigames map[string]map[string]*Minigame
+
+	// minigamesMtx guards minigames and the minigames of each room, which
+	// are replaced when definitions are reloaded
+	minigamesMtx sync.RWMutex
+)
+
 type Minigame struct {
-	Id             string `json:"minigameId"` // TODO: make this `json:"id"`
-	VarId          int    `json:"varId"`
-	InitialVarSync bool   `json:"initialVarSync"`
-	SwitchId       int    `json:"switchId"`
-	SwitchValue    bool   `json:"switchValue"`
-	Dev            bool   `json:"dev"`
-}
-
-func getRoomMinigames(roomId int) (minigames []*Minigame) {
-	switch config.gameName {
-	case "yume":
-		if roomId == 155 {
-			minigames = append(minigames, &Minigame{Id: "nasu", VarId: 88, SwitchId: 215})
+	Id              string         `json:"minigameId"` // TODO: make this `json:"id"`
+	Map             int            `json:"map"`
+	VarId           int            `json:"varId"`
+	InitialVarSync  bool           `json:"initialVarSync"`
+	SwitchId        int            `json:"switchId"`
+	SwitchValue     bool           `json:"switchValue"`
+	LowerIsBetter   bool           `json:"lowerIsBetter"`
+	MinScore        int            `json:"minScore"`
+	MaxScore        int            `json:"maxScore"`
+	BadgeThresholds map[string]int `json:"badgeThresholds"`
+	Dev             bool           `json:"dev"`
+}
+
+func (m *Minigame) isValidScore(score int) bool {
+	if score <= 0 {
+		return false
+	}
+	if m.MinScore > 0 && score < m.MinScore {
+		return false
+	}
+	if m.MaxScore > 0 && score > m.MaxScore {
+		return false
+	}
+
+	return true
+}
+
+func (m *Minigame) isBetterScore(prevScore int, score int) bool {
+	if !m.isValidScore(score) {
+		return false
+	}
+	if prevScore <= 0 {
+		return true
+	}
+	if m.LowerIsBetter {
+		return score < prevScore
+	}
+
+	return score > prevScore
+}
+
+func (m *Minigame) meetsThreshold(score int, threshold int) bool {
+	if score <= 0 {
+		return false
+	}
+	if m.LowerIsBetter {
+		return score <= threshold
+	}
+
+	return score >= threshold
+}
+
+func setMinigames() {
+	minigameConfig := make(map[string]map[string]*Minigame)
+
+	gameMinigameDirs, err := os.ReadDir("minigames/")
+	if err != nil {
+		return
+	}
+
+	for _, gameMinigamesDir := range gameMinigameDirs {
+		if gameMinigamesDir.IsDir() {
+			gameId := gameMinigamesDir.Name()
+			minigameConfig[gameId] = make(map[string]*Minigame)
+			configPath := "minigames/" + gameId + "/"
+			minigameConfigs, err := os.ReadDir(configPath)
+			if err != nil {
+				continue
+			}
+
+			for _, minigameConfigFile := range minigameConfigs {
+				minigame := &Minigame{}
+
+				data, err := os.ReadFile(configPath + minigameConfigFile.Name())
+				if err != nil {
+					continue
+				}
+
+				err = json.Unmarshal(data, &minigame)
+				if err == nil {
+					minigameId := minigameConfigFile.Name()[:len(minigameConfigFile.Name())-5]
+					minigame.Id = minigameId
+					minigameConfig[gameId][minigameId] = minigame
+				}
+			}
+		}
+	}
+
+	minigamesMtx.Lock()
+	minigames = minigameConfig
+	minigamesMtx.Unlock()
+}
+
+// reloadMinigames rereads minigame definitions and reattaches them to rooms
+func reloadMinigames() {
+	setMinigames()
+
+	roomMinigames := make(map[int][]*Minigame)
+	for roomId := range rooms {
+		roomMinigames[roomId] = getRoomMinigames(roomId)
+	}
+
+	minigamesMtx.Lock()
+	defer minigamesMtx.Unlock()
+
+	for roomId, room := range rooms {
+		room.minigames = roomMinigames[roomId]
+	}
+}
+
+// getMinigames returns the minigames played in a room
+func (r *Room) getMinigames() []*Minigame {
+	minigamesMtx.RLock()
+	defer minigamesMtx.RUnlock()
+
+	return r.minigames
+}
+
+func getMinigame(game string, minigameId string) (minigame *Minigame, ok bool) {
+	minigamesMtx.RLock()
+	defer minigamesMtx.RUnlock()
+
+	minigame, ok = minigames[game][minigameId]
+
+	return minigame, ok
+}
+
+func getRoomMinigames(roomId int) (roomMinigames []*Minigame) {
+	minigamesMtx.RLock()
+	defer minigamesMtx.RUnlock()
+
+	if gameMinigames, ok := minigames[config.gameName]; ok {
+		for _, minigame := range gameMinigames {
+			if minigame.Map == roomId {
+				roomMinigames = append(roomMinigames, minigame)
+			}
 		}
-	case "2kki":
-		switch roomId {
-		case 102:
-			minigames = append(minigames, &Minigame{Id: "rby", VarId: 1010, InitialVarSync: true})
-		case 618:
-			minigames = append(minigames, &Minigame{Id: "rby_ex", VarId: 79, InitialVarSync: true})
-		case 344:
-			minigames = append(minigames, &Minigame{Id: "fuji_ex", VarId: 3218, SwitchId: 3219, SwitchValue: true})
+	}
+
+	sort.Slice(roomMinigames, func(a, b int) bool {
+		return roomMinigames[a].Id < roomMinigames[b].Id
+	})
+
+	return roomMinigames
+}
+
+func (c *RoomClient) writeMinigameScore(minigame *Minigame, score int) {
+	success, err := tryWritePlayerMinigameScore(c.sClient.uuid, minigame, score)
+	if err != nil {
+		writeErrLog(c.sClient.uuid, c.mapId, err.Error())
+		return
+	}
+	if !success {
+		return
+	}
+
+	prevScore := c.minigameScores[minigame.Id]
+	c.minigameScores[minigame.Id] = score
+
+	for _, threshold := range minigame.BadgeThresholds {
+		if minigame.meetsThreshold(score, threshold) && !minigame.meetsThreshold(prevScore, threshold) {
+			c.send <- buildMsg("b")
+			break
+		}
+	}
+}
+
+// getMinigameBadgeIds returns the ids of badges unlocked by minigame scores
+func getMinigameBadgeIds(minigameScores map[string]map[string]int) map[string]bool {
+	badgeIds := make(map[string]bool)
+
+	minigamesMtx.RLock()
+	defer minigamesMtx.RUnlock()
+
+	for game, gameMinigames := range minigames {
+		for minigameId, minigame := range gameMinigames {
+			score, ok := minigameScores[game][minigameId]
+			if !ok {
+				continue
+			}
+			for badgeId, threshold := range minigame.BadgeThresholds {
+				if minigame.meetsThreshold(score, threshold) {
+					badgeIds[badgeId] = true
+				}
+			}
 		}
 	}
-	return minigames
+
+	return badgeIds
 }
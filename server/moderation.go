@@ -0,0 +1,325 @@
+/*
+	Copyright (C) 2021-2023  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	moderationActionBan    = "ban"
+	moderationActionUnban  = "unban"
+	moderationActionMute   = "mute"
+	moderationActionUnmute = "unmute"
+)
+
+type ModerationAction struct {
+	Id         int        `json:"id"`
+	ActorUuid  string     `json:"actorUuid"`
+	ActorName  string     `json:"actorName"`
+	TargetUuid string     `json:"targetUuid"`
+	Action     string     `json:"action"`
+	Reason     string     `json:"reason"`
+	Timestamp  time.Time  `json:"timestamp"`
+	Expiration *time.Time `json:"expiration"`
+	Expired    bool       `json:"expired"`
+}
+
+type ModeratedPlayer struct {
+	Uuid       string     `json:"uuid"`
+	Name       string     `json:"name"`
+	Rank       int        `json:"rank"`
+	Reason     string     `json:"reason"`
+	Expiration *time.Time `json:"expiration"`
+}
+
+var (
+	lastModerationNotificationId int
+	// lastModerationNotificationIdMtx keeps notifications from being applied
+	// twice if a check runs long
+	lastModerationNotificationIdMtx sync.Mutex
+)
+
+func initModeration() {
+	var err error
+	lastModerationNotificationId, err = getLastModerationNotificationId()
+	if err != nil {
+		writeErrLog("SERVER", "moderation", err.Error())
+	}
+
+	scheduler.Every(1).Minute().Do(expireModerationActions, "")
+	scheduler.Every(5).Seconds().SingletonMode().Do(processModerationNotifications)
+}
+
+// applyModerationAction applies an action to a player connected to this
+// server, kicking them if banned and updating their muted state otherwise
+func applyModerationAction(targetUuid string, action string, reason string) {
+	client, ok := clients.Load(targetUuid)
+	if !ok {
+		return
+	}
+
+	switch action {
+	case moderationActionBan:
+		client.kick(closeCodeBanned, reason)
+	case moderationActionMute, moderationActionUnmute:
+		client.muted.Store(action == moderationActionMute)
+
+		select {
+		case client.send <- buildMsg("mod", action, reason):
+		default:
+			writeErrLog(client.uuid, "sess", "send channel is full")
+		}
+	}
+}
+
+// notifyModerationAction applies an action to a player on this server and
+// notifies the other game servers to do the same
+func notifyModerationAction(targetUuid string, action string, reason string) error {
+	applyModerationAction(targetUuid, action, reason)
+
+	_, err := db.Exec("INSERT INTO moderationNotifications (game, targetUuid, action, reason, timestamp) VALUES (?, ?, ?, ?, UTC_TIMESTAMP())", config.gameName, targetUuid, action, reason)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// processModerationNotifications applies actions taken on other game servers
+// since the last check
+func processModerationNotifications() {
+	lastModerationNotificationIdMtx.Lock()
+	defer lastModerationNotificationIdMtx.Unlock()
+
+	results, err := db.Query("SELECT id, game, targetUuid, action, reason FROM moderationNotifications WHERE id > ? ORDER BY id", lastModerationNotificationId)
+	if err != nil {
+		writeErrLog("SERVER", "moderation", err.Error())
+		return
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		var id int
+		var game, targetUuid, action, reason string
+
+		err := results.Scan(&id, &game, &targetUuid, &action, &reason)
+		if err != nil {
+			writeErrLog("SERVER", "moderation", err.Error())
+			return
+		}
+
+		lastModerationNotificationId = id
+
+		// actions from this server were applied when they were taken
+		if game == config.gameName {
+			continue
+		}
+
+		applyModerationAction(targetUuid, action, reason)
+	}
+}
+
+func getLastModerationNotificationId() (id int, err error) {
+	err = db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM moderationNotifications").Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// getModerationParams reads the reason and the optional duration in minutes
+// of a ban or mute, where no duration means it is permanent
+func getModerationParams(r *http.Request) (reason string, duration time.Duration, err error) {
+	reason = r.URL.Query().Get("reason")
+	if len(reason) > 500 {
+		return "", 0, errors.New("reason too long")
+	}
+
+	if minutesParam := r.URL.Query().Get("minutes"); minutesParam != "" {
+		minutes, err := strconv.Atoi(minutesParam)
+		if err != nil || minutes <= 0 {
+			return "", 0, errors.New("invalid minutes value")
+		}
+
+		duration = time.Duration(minutes) * time.Minute
+	}
+
+	return reason, duration, nil
+}
+
+// writeModerationAction records an action taken on a player, superseding any
+// unexpired ban or mute of the same kind
+func writeModerationAction(actorUuid string, targetUuid string, action string, reason string, duration time.Duration) error {
+	kind := action
+	switch action {
+	case moderationActionUnban:
+		kind = moderationActionBan
+	case moderationActionUnmute:
+		kind = moderationActionMute
+	}
+
+	_, err := db.Exec("UPDATE moderationActions SET expired = 1 WHERE targetUuid = ? AND action = ? AND expired = 0", targetUuid, kind)
+	if err != nil {
+		return err
+	}
+
+	// lifted actions have nothing left to expire
+	expired := action != kind
+
+	if duration == 0 {
+		_, err = db.Exec("INSERT INTO moderationActions (actorUuid, targetUuid, action, reason, timestamp, expired) VALUES (?, ?, ?, ?, UTC_TIMESTAMP(), ?)", actorUuid, targetUuid, action, reason, expired)
+	} else {
+		_, err = db.Exec("INSERT INTO moderationActions (actorUuid, targetUuid, action, reason, timestamp, timestampExpired, expired) VALUES (?, ?, ?, ?, UTC_TIMESTAMP(), DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? SECOND), ?)", actorUuid, targetUuid, action, reason, int(duration.Seconds()), expired)
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// expireModerationActions lifts bans and mutes past their expiration, for one
+// player or for all players if no UUID is given
+func expireModerationActions(targetUuid string) (lifted bool, err error) {
+	query := "SELECT id, targetUuid, action FROM moderationActions WHERE action IN (?, ?) AND expired = 0 AND timestampExpired <= UTC_TIMESTAMP()"
+	args := []any{moderationActionBan, moderationActionMute}
+	if targetUuid != "" {
+		query += " AND targetUuid = ?"
+		args = append(args, targetUuid)
+	}
+
+	results, err := db.Query(query, args...)
+	if err != nil {
+		return false, err
+	}
+
+	var expiredActions []*ModerationAction
+
+	for results.Next() {
+		moderationAction := &ModerationAction{}
+
+		err := results.Scan(&moderationAction.Id, &moderationAction.TargetUuid, &moderationAction.Action)
+		if err != nil {
+			results.Close()
+			return false, err
+		}
+
+		expiredActions = append(expiredActions, moderationAction)
+	}
+
+	results.Close()
+
+	for _, moderationAction := range expiredActions {
+		// another server may have expired the action first
+		result, err := db.Exec("UPDATE moderationActions SET expired = 1 WHERE id = ? AND expired = 0", moderationAction.Id)
+		if err != nil {
+			writeErrLog("SERVER", "moderation", err.Error())
+			continue
+		}
+
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			continue
+		}
+
+		if moderationAction.Action == moderationActionBan {
+			_, err = db.Exec("UPDATE players SET banned = 0 WHERE uuid = ?", moderationAction.TargetUuid)
+		} else {
+			_, err = db.Exec("UPDATE players SET muted = 0 WHERE uuid = ?", moderationAction.TargetUuid)
+		}
+		if err != nil {
+			writeErrLog("SERVER", "moderation", err.Error())
+			continue
+		}
+
+		_, err = db.Exec("INSERT INTO moderationActions (actorUuid, targetUuid, action, reason, timestamp, expired) VALUES ('', ?, ?, 'expired', UTC_TIMESTAMP(), 1)", moderationAction.TargetUuid, "un"+moderationAction.Action)
+		if err != nil {
+			writeErrLog("SERVER", "moderation", err.Error())
+		}
+
+		err = notifyModerationAction(moderationAction.TargetUuid, "un"+moderationAction.Action, "expired")
+		if err != nil {
+			writeErrLog("SERVER", "moderation", err.Error())
+		}
+
+		lifted = true
+	}
+
+	return lifted, nil
+}
+
+func adminModerationHistory(w http.ResponseWriter, r *http.Request) {
+	uuidParam, ok := getAdminTarget(w, r)
+	if !ok {
+		return
+	}
+
+	moderationActions, err := getModerationHistory(uuidParam)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	if moderationActions == nil {
+		moderationActions = []*ModerationAction{}
+	}
+
+	responseJson, err := json.Marshal(moderationActions)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	w.Write(responseJson)
+}
+
+func getModerationHistory(targetUuid string) (moderationActions []*ModerationAction, err error) {
+	results, err := db.Query("SELECT ma.id, ma.actorUuid, COALESCE(a.user, ''), ma.targetUuid, ma.action, ma.reason, ma.timestamp, ma.timestampExpired IS NOT NULL, COALESCE(ma.timestampExpired, ma.timestamp), ma.expired FROM moderationActions ma LEFT JOIN accounts a ON a.uuid = ma.actorUuid WHERE ma.targetUuid = ? ORDER BY ma.timestamp DESC, ma.id DESC", targetUuid)
+	if err != nil {
+		return moderationActions, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		moderationAction := &ModerationAction{}
+
+		var hasExpiration bool
+		var expiration time.Time
+
+		err := results.Scan(&moderationAction.Id, &moderationAction.ActorUuid, &moderationAction.ActorName, &moderationAction.TargetUuid, &moderationAction.Action, &moderationAction.Reason, &moderationAction.Timestamp, &hasExpiration, &expiration, &moderationAction.Expired)
+		if err != nil {
+			return moderationActions, err
+		}
+
+		if hasExpiration {
+			moderationAction.Expiration = &expiration
+		}
+
+		moderationActions = append(moderationActions, moderationAction)
+	}
+
+	return moderationActions, nil
+}
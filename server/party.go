@@ -18,20 +18,28 @@
 package server
 
 import (
+	"crypto/subtle"
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 type Party struct {
-	Id          int            `json:"id"`
-	Name        string         `json:"name"`
-	Public      bool           `json:"public"`
-	Pass        string         `json:"-"`
-	SystemName  string         `json:"systemName"`
-	Description string         `json:"description"`
-	OwnerUuid   string         `json:"ownerUuid"`
-	Members     []*PartyMember `json:"members"`
+	Id          int              `json:"id"`
+	Name        string           `json:"name"`
+	Public      bool             `json:"public"`
+	SystemName  string           `json:"systemName"`
+	Description string           `json:"description"`
+	OwnerUuid   string           `json:"ownerUuid"`
+	Members     []*PartyMember   `json:"members"`
+	Waypoints   []*PartyWaypoint `json:"waypoints"`
+
+	lastSentJson []byte
 }
 
 type PartyMember struct {
@@ -50,39 +58,267 @@ type PartyMember struct {
 	X             int    `json:"x"`
 	Y             int    `json:"y"`
 	Online        bool   `json:"online"`
+	Officer       bool   `json:"officer"`
 }
 
-var parties = make(map[int]*Party)
+type PartyWaypoint struct {
+	Uuid       string    `json:"uuid"`
+	MapId      string    `json:"mapId"`
+	X          int       `json:"x"`
+	Y          int       `json:"y"`
+	Label      string    `json:"label"`
+	Expiration time.Time `json:"expiration"`
+}
 
-func sendPartyUpdate() {
-	parties, err := getAllPartyData()
-	if err != nil {
-		return
+type PartyGather struct {
+	Uuid  string `json:"uuid"`
+	Name  string `json:"name"`
+	MapId string `json:"mapId"`
+	X     int    `json:"x"`
+	Y     int    `json:"y"`
+}
+
+type PartyInvite struct {
+	PartyId     int       `json:"partyId"`
+	PartyName   string    `json:"partyName"`
+	Uuid        string    `json:"uuid"`
+	Name        string    `json:"name"`
+	InviterUuid string    `json:"inviterUuid"`
+	InviterName string    `json:"inviterName"`
+	Expiration  time.Time `json:"expiration"`
+}
+
+type PartyJoinRequest struct {
+	PartyId    int       `json:"partyId"`
+	Uuid       string    `json:"uuid"`
+	Name       string    `json:"name"`
+	Expiration time.Time `json:"expiration"`
+}
+
+var (
+	parties = make(map[int]*Party)
+
+	// partiesMtx guards parties, the cached party and member data and the
+	// cached party id of each session client
+	partiesMtx sync.RWMutex
+
+	errPartyFull = errors.New("party is full")
+)
+
+// partyMoveUpdateInterval throttles party member updates from movement
+const partyMoveUpdateInterval = time.Second
+
+// reconcileParties reloads every cached party from the database to pick up
+// changes made elsewhere, sending the full party to members if it changed
+func reconcileParties() {
+	memberUuids := make(map[int]string)
+
+	partiesMtx.RLock()
+	for partyId, party := range parties {
+		if len(party.Members) != 0 {
+			memberUuids[partyId] = party.Members[0].Uuid
+		}
 	}
+	partiesMtx.RUnlock()
 
-	for _, party := range parties { // for every party
-		partyDataJson, err := json.Marshal(party)
-		if err != nil {
+	for partyId, memberUuid := range memberUuids {
+		reloadedParty, err := getPartyDataFromDatabase(memberUuid)
+		if err != nil || reloadedParty.Id != partyId {
 			continue
 		}
 
-		for _, member := range party.Members { // for every member
-			if member.Online {
-				if client, ok := clients.Load(member.Uuid); ok {
-					client.send <- buildMsg("pt", partyDataJson) // send JSON to client
+		partiesMtx.Lock()
+		if party, ok := parties[partyId]; ok {
+			party.OwnerUuid = reloadedParty.OwnerUuid
+			party.Name = reloadedParty.Name
+			party.Public = reloadedParty.Public
+			party.SystemName = reloadedParty.SystemName
+			party.Description = reloadedParty.Description
+			party.setMembers(reloadedParty.Members)
+			party.Waypoints = reloadedParty.Waypoints
+
+			sendPartyData(partyId, false)
+		}
+		partiesMtx.Unlock()
+	}
+}
+
+// setMembers replaces the cached members of a party and updates the cached
+// party id of its online members and of online players who left it;
+// partiesMtx must be held
+func (party *Party) setMembers(members []*PartyMember) {
+	for _, member := range party.Members {
+		setClientPartyId(member.Uuid, 0, party.Id)
+	}
+
+	for _, member := range members {
+		setClientPartyId(member.Uuid, party.Id, 0)
+	}
+
+	party.Members = members
+}
+
+// setClientPartyId sets the cached party id of a player if they are online
+// and their cached party id is currentPartyId, or any party id when
+// currentPartyId is 0; partiesMtx must be held
+func setClientPartyId(playerUuid string, partyId int, currentPartyId int) {
+	client, ok := clients.Load(playerUuid)
+	if !ok {
+		return
+	}
+
+	if currentPartyId == 0 || client.partyId == currentPartyId {
+		client.partyId = partyId
+	}
+}
+
+// getPartyId returns the id of the cached party of a player, or 0 if they
+// are not in a party
+func (c *SessionClient) getPartyId() int {
+	partiesMtx.RLock()
+	defer partiesMtx.RUnlock()
+
+	return c.partyId
+}
+
+// sendPartyData sends the full party to its online members, which is used
+// when membership or party settings change; partiesMtx must be held
+func sendPartyData(partyId int, force bool) {
+	party, err := getPartyData(partyId)
+	if err != nil {
+		return
+	}
+
+	partyDataJson, err := json.Marshal(party)
+	if err != nil {
+		return
+	}
+
+	if !force && string(partyDataJson) == string(party.lastSentJson) {
+		return
+	}
+
+	party.lastSentJson = partyDataJson
+
+	sendPartyMsg(partyId, buildMsg("pt", partyDataJson), "")
+}
+
+// sendPartyMsg sends a message to the online members of a party, optionally
+// excluding a member; partiesMtx must be held
+func sendPartyMsg(partyId int, msg []byte, excludeUuid string) {
+	party, ok := parties[partyId]
+	if !ok {
+		return
+	}
+
+	for _, member := range party.Members {
+		if member.Online && member.Uuid != excludeUuid {
+			if client, ok := clients.Load(member.Uuid); ok {
+				select {
+				case client.send <- msg:
+				default:
+					writeErrLog(client.uuid, "sess", "send channel is full")
 				}
 			}
 		}
 	}
 }
 
+// sendPartyMemberUpdate sends a player's party member state to the other
+// online members of their party if it changed
+func (c *SessionClient) sendPartyMemberUpdate() {
+	partiesMtx.Lock()
+	defer partiesMtx.Unlock()
+
+	party, ok := parties[c.partyId]
+	if !ok {
+		return
+	}
+
+	var member *PartyMember
+	for _, partyMember := range party.Members {
+		if partyMember.Uuid == c.uuid {
+			member = partyMember
+			break
+		}
+	}
+	if member == nil {
+		return
+	}
+
+	updatedMember := *member
+	if _, ok := clients.Load(c.uuid); ok {
+		updatedMember.setOnlineState(c)
+	} else {
+		updatedMember.setOfflineState()
+	}
+
+	if updatedMember == *member {
+		return
+	}
+
+	*member = updatedMember
+
+	memberJson, err := json.Marshal(member)
+	if err != nil {
+		return
+	}
+
+	party.lastSentJson = nil
+
+	sendPartyMsg(party.Id, buildMsg("ptm", party.Id, memberJson), c.uuid)
+}
+
+// sendPartyMoveUpdate sends party member updates from movement at most once
+// per interval, sending the latest position once the interval has passed
+func (c *RoomClient) sendPartyMoveUpdate() {
+	if c.sClient.getPartyId() == 0 {
+		return
+	}
+
+	c.partyMoveUpdateMtx.Lock()
+
+	if time.Since(c.lastPartyMoveUpdate) >= partyMoveUpdateInterval {
+		c.lastPartyMoveUpdate = time.Now()
+		c.partyMoveUpdateMtx.Unlock()
+
+		c.sClient.sendPartyMemberUpdate()
+		return
+	}
+
+	if c.partyMoveUpdatePending {
+		c.partyMoveUpdateMtx.Unlock()
+		return
+	}
+
+	c.partyMoveUpdatePending = true
+
+	time.AfterFunc(partyMoveUpdateInterval-time.Since(c.lastPartyMoveUpdate), func() {
+		c.partyMoveUpdateMtx.Lock()
+		c.partyMoveUpdatePending = false
+		c.lastPartyMoveUpdate = time.Now()
+		c.partyMoveUpdateMtx.Unlock()
+
+		c.sClient.sendPartyMemberUpdate()
+	})
+
+	c.partyMoveUpdateMtx.Unlock()
+}
+
 func (c *SessionClient) cacheParty() error {
 	partyId, err := getPlayerPartyId(c.uuid)
 	if err != nil {
 		return err
 	}
 
-	if _, ok := parties[partyId]; ok { // it's already in the cache
+	partiesMtx.Lock()
+	_, ok := parties[partyId]
+	if ok {
+		c.partyId = partyId
+	}
+	partiesMtx.Unlock()
+
+	if ok { // it's already in the cache
 		return nil
 	}
 
@@ -91,11 +327,33 @@ func (c *SessionClient) cacheParty() error {
 		return err
 	}
 
-	parties[party.Id] = &party
+	partiesMtx.Lock()
+	defer partiesMtx.Unlock()
+
+	if _, ok := parties[party.Id]; !ok {
+		parties[party.Id] = &party
+	}
+
+	c.partyId = party.Id
 
 	return nil
 }
 
+// sendParty sends a player their cached party, which is used when they
+// connect so they don't keep showing the party as it was before
+func (c *SessionClient) sendParty() {
+	partyDataJson, err := getPartyDataJson(c.getPartyId())
+	if err != nil {
+		return
+	}
+
+	select {
+	case c.send <- buildMsg("pt", partyDataJson):
+	default:
+		writeErrLog(c.uuid, "sess", "send channel is full")
+	}
+}
+
 func getPlayerPartyId(uuid string) (partyId int, err error) {
 	err = db.QueryRow("SELECT pm.partyId FROM partyMembers pm JOIN parties p ON p.id = pm.partyId WHERE pm.uuid = ? AND p.game = ?", uuid, config.gameName).Scan(&partyId)
 	if err != nil {
@@ -109,6 +367,8 @@ func getPlayerPartyId(uuid string) (partyId int, err error) {
 	return partyId, nil
 }
 
+// getPartyData refreshes the online state of the members of a cached party
+// and removes it from the cache if none are online; partiesMtx must be held
 func getPartyData(partyId int) (*Party, error) {
 	party, ok := parties[partyId]
 	if !ok {
@@ -119,41 +379,13 @@ func getPartyData(partyId int) (*Party, error) {
 	for _, member := range party.Members {
 		client, ok := clients.Load(member.Uuid)
 		if !ok {
-			member.Online = false
-
-			member.MapId = "0000"
-			member.PrevMapId = "0000"
-			member.PrevLocations = ""
-			member.X = 0
-			member.Y = 0
-
+			member.setOfflineState()
 			continue
 		}
 
 		hasOnlineMember = true
 
-		if client.name != "" {
-			member.Name = client.name
-		}
-		if client.systemName != "" {
-			member.SystemName = client.systemName
-		}
-		if client.spriteName != "" {
-			member.SpriteName = client.spriteName
-		}
-		if client.spriteIndex > -1 {
-			member.SpriteIndex = client.spriteIndex
-		}
-
-		if client.rClient != nil {
-			member.MapId = client.rClient.mapId
-			member.PrevMapId = client.rClient.prevMapId
-			member.PrevLocations = client.rClient.prevLocations
-			member.X = client.rClient.x
-			member.Y = client.rClient.y
-		}
-
-		member.Online = true
+		member.setOnlineState(client)
 	}
 
 	if !hasOnlineMember {
@@ -164,7 +396,57 @@ func getPartyData(partyId int) (*Party, error) {
 	return party, nil
 }
 
-func getAllPartyData() ([]*Party, error) {
+func getPartyDataJson(partyId int) ([]byte, error) {
+	partiesMtx.Lock()
+	defer partiesMtx.Unlock()
+
+	party, err := getPartyData(partyId)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(party)
+}
+
+func (member *PartyMember) setOfflineState() {
+	member.Online = false
+
+	member.MapId = "0000"
+	member.PrevMapId = "0000"
+	member.PrevLocations = ""
+	member.X = 0
+	member.Y = 0
+}
+
+func (member *PartyMember) setOnlineState(client *SessionClient) {
+	if client.name != "" {
+		member.Name = client.name
+	}
+	if client.systemName != "" {
+		member.SystemName = client.systemName
+	}
+	if client.spriteName != "" {
+		member.SpriteName = client.spriteName
+	}
+	if client.spriteIndex > -1 {
+		member.SpriteIndex = client.spriteIndex
+	}
+
+	if rClient := client.rClient; rClient != nil {
+		member.MapId = rClient.mapId
+		member.PrevMapId = rClient.prevMapId
+		member.PrevLocations = rClient.prevLocations
+		member.X = rClient.x
+		member.Y = rClient.y
+	}
+
+	member.Online = true
+}
+
+func getAllPartyDataJson() ([]byte, error) {
+	partiesMtx.Lock()
+	defer partiesMtx.Unlock()
+
 	var partyData []*Party
 	for partyId := range parties {
 		party, err := getPartyData(partyId)
@@ -175,11 +457,11 @@ func getAllPartyData() ([]*Party, error) {
 		partyData = append(partyData, party)
 	}
 
-	return partyData, nil
+	return json.Marshal(partyData)
 }
 
 func getPartyDataFromDatabase(playerUuid string) (party Party, err error) {
-	err = db.QueryRow("SELECT p.id, p.owner, p.name, p.public, p.pass, p.theme, p.description FROM parties p JOIN partyMembers pm ON pm.partyId = p.id JOIN playerGameData pgd ON pgd.uuid = pm.uuid AND pgd.game = p.game WHERE p.game = ? AND pm.uuid = ?", config.gameName, playerUuid).Scan(&party.Id, &party.OwnerUuid, &party.Name, &party.Public, &party.Pass, &party.SystemName, &party.Description)
+	err = db.QueryRow("SELECT p.id, p.owner, p.name, p.public, p.theme, p.description FROM parties p JOIN partyMembers pm ON pm.partyId = p.id JOIN playerGameData pgd ON pgd.uuid = pm.uuid AND pgd.game = p.game WHERE p.game = ? AND pm.uuid = ?", config.gameName, playerUuid).Scan(&party.Id, &party.OwnerUuid, &party.Name, &party.Public, &party.SystemName, &party.Description)
 	if err != nil {
 		return party, err
 	}
@@ -191,11 +473,18 @@ func getPartyDataFromDatabase(playerUuid string) (party Party, err error) {
 
 	party.Members = partyMembers
 
+	partyWaypoints, err := getPartyWaypointsFromDatabase(party.Id)
+	if err != nil {
+		return party, err
+	}
+
+	party.Waypoints = partyWaypoints
+
 	return party, nil
 }
 
 func getPartyMemberDataFromDatabase(partyId int) (partyMembers []*PartyMember, err error) {
-	results, err := db.Query("SELECT pm.partyId, pm.uuid, COALESCE(a.user, pgd.name), pd.rank, CASE WHEN a.user IS NULL THEN 0 ELSE 1 END, COALESCE(a.badge, ''), pgd.systemName, pgd.spriteName, pgd.spriteIndex, pgd.medalCountBronze, pgd.medalCountSilver, pgd.medalCountGold, pgd.medalCountPlatinum, pgd.medalCountDiamond FROM partyMembers pm JOIN playerGameData pgd ON pgd.uuid = pm.uuid JOIN players pd ON pd.uuid = pgd.uuid JOIN parties p ON p.id = pm.partyId LEFT JOIN accounts a ON a.uuid = pd.uuid WHERE pm.partyId = ? AND pgd.game = ? ORDER BY CASE WHEN p.owner = pm.uuid THEN 0 ELSE 1 END, pd.rank DESC, pm.id", partyId, config.gameName)
+	results, err := db.Query("SELECT pm.partyId, pm.uuid, COALESCE(a.user, pgd.name), pd.rank, CASE WHEN a.user IS NULL THEN 0 ELSE 1 END, COALESCE(a.badge, ''), pgd.systemName, pgd.spriteName, pgd.spriteIndex, pgd.medalCountBronze, pgd.medalCountSilver, pgd.medalCountGold, pgd.medalCountPlatinum, pgd.medalCountDiamond, CASE WHEN po.uuid IS NULL THEN 0 ELSE 1 END FROM partyMembers pm JOIN playerGameData pgd ON pgd.uuid = pm.uuid JOIN players pd ON pd.uuid = pgd.uuid JOIN parties p ON p.id = pm.partyId LEFT JOIN accounts a ON a.uuid = pd.uuid LEFT JOIN partyOfficers po ON po.partyId = pm.partyId AND po.uuid = pm.uuid WHERE pm.partyId = ? AND pgd.game = ? ORDER BY CASE WHEN p.owner = pm.uuid THEN 0 ELSE 1 END, pd.rank DESC, pm.id", partyId, config.gameName)
 	if err != nil {
 		return partyMembers, err
 	}
@@ -205,18 +494,20 @@ func getPartyMemberDataFromDatabase(partyId int) (partyMembers []*PartyMember, e
 	for results.Next() {
 		var partyId int
 		var accountBin int
+		var officerBin int
 
 		partyMember := &PartyMember{
 			MapId:     "0000",
 			PrevMapId: "0000",
 		}
 
-		err := results.Scan(&partyId, &partyMember.Uuid, &partyMember.Name, &partyMember.Rank, &accountBin, &partyMember.Badge, &partyMember.SystemName, &partyMember.SpriteName, &partyMember.SpriteIndex, &partyMember.Medals[0], &partyMember.Medals[1], &partyMember.Medals[2], &partyMember.Medals[3], &partyMember.Medals[4])
+		err := results.Scan(&partyId, &partyMember.Uuid, &partyMember.Name, &partyMember.Rank, &accountBin, &partyMember.Badge, &partyMember.SystemName, &partyMember.SpriteName, &partyMember.SpriteIndex, &partyMember.Medals[0], &partyMember.Medals[1], &partyMember.Medals[2], &partyMember.Medals[3], &partyMember.Medals[4], &officerBin)
 		if err != nil {
 			return partyMembers, err
 		}
 
 		partyMember.Account = accountBin == 1
+		partyMember.Officer = officerBin == 1
 		partyMember.Online = clients.Exists(partyMember.Uuid)
 
 		partyMembers = append(partyMembers, partyMember)
@@ -226,7 +517,12 @@ func getPartyMemberDataFromDatabase(partyId int) (partyMembers []*PartyMember, e
 }
 
 func createPartyData(name string, public bool, pass string, theme string, description string, playerUuid string) (partyId int, err error) {
-	results, err := db.Exec("INSERT INTO parties (game, owner, name, public, pass, theme, description) VALUES (?, ?, ?, ?, ?, ?, ?)", config.gameName, playerUuid, name, public, pass, theme, description)
+	passHash, err := hashPartyPass(pass)
+	if err != nil {
+		return 0, err
+	}
+
+	results, err := db.Exec("INSERT INTO parties (game, owner, name, public, pass, theme, description) VALUES (?, ?, ?, ?, ?, ?, ?)", config.gameName, playerUuid, name, public, passHash, theme, description)
 	if err != nil {
 		return 0, err
 	}
@@ -244,11 +540,19 @@ func createPartyData(name string, public bool, pass string, theme string, descri
 }
 
 func updatePartyData(partyId int, name string, public bool, pass string, theme string, description string, playerUuid string) error {
-	_, err := db.Exec("UPDATE parties SET game = ?, owner = ?, name = ?, public = ?, pass = ?, theme = ?, description = ? WHERE id = ?", config.gameName, playerUuid, name, public, pass, theme, description, partyId)
+	passHash, err := hashPartyPass(pass)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("UPDATE parties SET game = ?, owner = ?, name = ?, public = ?, pass = ?, theme = ?, description = ? WHERE id = ?", config.gameName, playerUuid, name, public, passHash, theme, description, partyId)
 	if err != nil {
 		return err
 	}
 
+	partiesMtx.Lock()
+	defer partiesMtx.Unlock()
+
 	party, ok := parties[partyId]
 	if !ok {
 		return errors.New("party id not in cache")
@@ -257,15 +561,142 @@ func updatePartyData(partyId int, name string, public bool, pass string, theme s
 	party.OwnerUuid = playerUuid
 	party.Name = name
 	party.Public = public
-	party.Pass = pass
 	party.SystemName = theme
 	party.Description = description
 
+	sendPartyData(partyId, true)
+
+	return nil
+}
+
+// hashPartyPass hashes a party password, where an empty password means the
+// party has none
+func hashPartyPass(pass string) (string, error) {
+	if pass == "" {
+		return "", nil
+	}
+
+	passHash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(passHash), nil
+}
+
+// isPartyPassHash tells bcrypt hashes apart from passwords stored in
+// plaintext before they were hashed
+func isPartyPassHash(pass string) bool {
+	return strings.HasPrefix(pass, "$2a$") || strings.HasPrefix(pass, "$2b$") || strings.HasPrefix(pass, "$2y$")
+}
+
+// checkPartyPass checks a password against the one stored for a party, which
+// is read from the database so that it's never cached
+func checkPartyPass(partyId int, pass string) (bool, error) {
+	var storedPass string
+	err := db.QueryRow("SELECT pass FROM parties WHERE id = ?", partyId).Scan(&storedPass)
+	if err != nil {
+		return false, err
+	}
+
+	if storedPass == "" {
+		return true, nil
+	}
+
+	if isPartyPassHash(storedPass) {
+		return bcrypt.CompareHashAndPassword([]byte(storedPass), []byte(pass)) == nil, nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(storedPass), []byte(pass)) != 1 {
+		return false, nil
+	}
+
+	// hash passwords stored by servers that predate hashing
+	passHash, err := hashPartyPass(pass)
+	if err != nil {
+		return true, err
+	}
+
+	_, err = db.Exec("UPDATE parties SET pass = ? WHERE id = ? AND pass = ?", passHash, partyId, storedPass)
+	if err != nil {
+		return true, err
+	}
+
+	return true, nil
+}
+
+// migratePartyPasses hashes any party passwords of the game still stored in
+// plaintext
+func migratePartyPasses() error {
+	results, err := db.Query("SELECT id, pass FROM parties WHERE game = ? AND pass IS NOT NULL AND pass != ''", config.gameName)
+	if err != nil {
+		return err
+	}
+
+	defer results.Close()
+
+	plaintextPasses := make(map[int]string)
+
+	for results.Next() {
+		var partyId int
+		var pass string
+
+		err := results.Scan(&partyId, &pass)
+		if err != nil {
+			return err
+		}
+
+		if !isPartyPassHash(pass) {
+			plaintextPasses[partyId] = pass
+		}
+	}
+
+	for partyId, pass := range plaintextPasses {
+		passHash, err := hashPartyPass(pass)
+		if err != nil {
+			return err
+		}
+
+		_, err = db.Exec("UPDATE parties SET pass = ? WHERE id = ? AND pass = ?", passHash, partyId, pass)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// joinPlayerParty adds a player to a party, returning errPartyFull if the
+// party has no room left
 func joinPlayerParty(partyId int, playerUuid string) error {
-	_, err := db.Exec("INSERT INTO partyMembers (partyId, uuid) VALUES (?, ?)", partyId, playerUuid)
+	err := runInTx(func(tx *sql.Tx) error {
+		// lock the party so that concurrent joins can't exceed the member limit
+		var id int
+		err := tx.QueryRow("SELECT id FROM parties WHERE id = ? FOR UPDATE", partyId).Scan(&id)
+		if err != nil {
+			return err
+		}
+
+		if config.party.maxMembers > 0 {
+			var memberCount int
+			err = tx.QueryRow("SELECT COUNT(*) FROM partyMembers WHERE partyId = ?", partyId).Scan(&memberCount)
+			if err != nil {
+				return err
+			}
+			if memberCount >= config.party.maxMembers {
+				return errPartyFull
+			}
+		}
+
+		_, err = tx.Exec("INSERT INTO partyMembers (partyId, uuid) VALUES (?, ?)", partyId, playerUuid)
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = deletePlayerPartyInvitesAndRequests(playerUuid)
 	if err != nil {
 		return err
 	}
@@ -275,7 +706,10 @@ func joinPlayerParty(partyId int, playerUuid string) error {
 		return err
 	}
 
-	party, ok := parties[partyId]
+	partiesMtx.RLock()
+	_, ok := parties[partyId]
+	partiesMtx.RUnlock()
+
 	if !ok {
 		// this only happens when someone creates a party
 		party, err := getPartyDataFromDatabase(playerUuid)
@@ -283,16 +717,51 @@ func joinPlayerParty(partyId int, playerUuid string) error {
 			return err
 		}
 
+		partiesMtx.Lock()
+		defer partiesMtx.Unlock()
+
 		parties[partyId] = &party
 
+		setClientPartyId(playerUuid, partyId, 0)
+
+		sendPartyData(partyId, true)
+
 		return nil
 	}
 
 	client, ok := clients.Load(playerUuid)
 	if !ok {
-		return errors.New("client not online")
+		// players joining through an approved join request may be offline
+		partyMembers, err := getPartyMemberDataFromDatabase(partyId)
+		if err != nil {
+			return err
+		}
+
+		partiesMtx.Lock()
+		defer partiesMtx.Unlock()
+
+		party, ok := parties[partyId]
+		if !ok {
+			return errors.New("party id not in cache")
+		}
+
+		party.setMembers(partyMembers)
+
+		sendPartyData(partyId, true)
+
+		return nil
+	}
+
+	partiesMtx.Lock()
+	defer partiesMtx.Unlock()
+
+	party, ok := parties[partyId]
+	if !ok {
+		return errors.New("party id not in cache")
 	}
 
+	client.partyId = partyId
+
 	party.Members = append(party.Members, &PartyMember{
 		Uuid:        client.uuid,
 		Name:        client.name,
@@ -307,6 +776,8 @@ func joinPlayerParty(partyId int, playerUuid string) error {
 		PrevMapId:   "0000", // initial value
 	})
 
+	sendPartyData(partyId, true)
+
 	return nil
 }
 
@@ -326,27 +797,47 @@ func leavePlayerParty(playerUuid string) error {
 		return err
 	}
 
-	party, ok := parties[partyId]
-	if !ok {
-		return errors.New("party id not in cache")
+	_, err = db.Exec("DELETE FROM partyOfficers WHERE partyId = ? AND uuid = ?", partyId, playerUuid)
+	if err != nil {
+		return err
 	}
 
+	_, err = db.Exec("DELETE FROM partyWaypoints WHERE partyId = ? AND uuid = ?", partyId, playerUuid)
+	if err != nil {
+		return err
+	}
+
+	partiesMtx.Lock()
+	defer partiesMtx.Unlock()
+
+	party, ok := parties[partyId]
+	if !ok {
+		return errors.New("party id not in cache")
+	}
+
+	removePartyWaypointFromCache(party, playerUuid)
+
 	// remove member from party cache
-	if len(party.Members) <= 1 {
-		party.Members = nil // probably not safe
-	} else {
-		for i, member := range party.Members {
-			if member.Uuid == playerUuid {
-				party.Members = append(party.Members[:i], party.Members[i+1:]...)
-				break
-			}
+	var partyMembers []*PartyMember
+	for _, member := range party.Members {
+		if member.Uuid != playerUuid {
+			partyMembers = append(partyMembers, member)
 		}
 	}
 
+	party.setMembers(partyMembers)
+
+	if len(partyMembers) != 0 {
+		sendPartyData(partyId, true)
+	}
+
 	return nil
 }
 
 func getPartyMemberUuids(partyId int) (partyMemberUuids []string, err error) {
+	partiesMtx.RLock()
+	defer partiesMtx.RUnlock()
+
 	party, ok := parties[partyId]
 	if !ok {
 		return nil, errors.New("party id not in cache")
@@ -359,7 +850,19 @@ func getPartyMemberUuids(partyId int) (partyMemberUuids []string, err error) {
 	return partyMemberUuids, nil
 }
 
+func getPartyName(partyId int) (name string, err error) {
+	err = db.QueryRow("SELECT name FROM parties WHERE id = ? AND game = ?", partyId, config.gameName).Scan(&name)
+	if err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
 func getPartyOwnerUuid(partyId int) (ownerUuid string, err error) {
+	partiesMtx.RLock()
+	defer partiesMtx.RUnlock()
+
 	party, ok := parties[partyId]
 	if !ok {
 		return "", errors.New("party id not in cache")
@@ -368,6 +871,30 @@ func getPartyOwnerUuid(partyId int) (ownerUuid string, err error) {
 	return party.OwnerUuid, nil
 }
 
+func getPartyDescription(partyId int) (description string, err error) {
+	partiesMtx.RLock()
+	defer partiesMtx.RUnlock()
+
+	party, ok := parties[partyId]
+	if !ok {
+		return "", errors.New("party id not in cache")
+	}
+
+	return party.Description, nil
+}
+
+func isPartyPublic(partyId int) (bool, error) {
+	partiesMtx.RLock()
+	defer partiesMtx.RUnlock()
+
+	party, ok := parties[partyId]
+	if !ok {
+		return false, errors.New("party id not in cache")
+	}
+
+	return party.Public, nil
+}
+
 func assumeNextPartyOwner(partyId int) error {
 	partyMemberUuids, err := getPartyMemberUuids(partyId)
 	if err != nil {
@@ -406,6 +933,15 @@ func setPartyOwner(partyId int, playerUuid string) error {
 		return err
 	}
 
+	// the owner has every officer permission
+	err = setPartyOfficer(partyId, playerUuid, false)
+	if err != nil {
+		return err
+	}
+
+	partiesMtx.Lock()
+	defer partiesMtx.Unlock()
+
 	party, ok := parties[partyId]
 	if !ok {
 		return errors.New("party id not in cache")
@@ -413,22 +949,35 @@ func setPartyOwner(partyId int, playerUuid string) error {
 
 	party.OwnerUuid = playerUuid
 
+	sendPartyData(partyId, true)
+
 	return nil
 }
 
 func checkDeleteOrphanedParty(partyId int) (deleted bool, err error) {
+	partiesMtx.RLock()
 	party, ok := parties[partyId]
+	orphaned := ok && len(party.Members) == 0
+	partiesMtx.RUnlock()
+
 	if !ok {
 		return false, errors.New("party id not in cache")
 	}
 
-	if len(party.Members) == 0 {
+	if orphaned {
 		_, err := db.Exec("DELETE FROM parties WHERE id = ?", partyId)
 		if err != nil {
 			return true, err
 		}
 
+		err = deletePartyInvitesAndRequests(partyId)
+		if err != nil {
+			return true, err
+		}
+
+		partiesMtx.Lock()
 		delete(parties, partyId)
+		partiesMtx.Unlock()
 
 		return true, nil
 	}
@@ -442,16 +991,413 @@ func deletePartyAndMembers(partyId int) error {
 		return err
 	}
 
+	_, err = db.Exec("DELETE FROM partyOfficers WHERE partyId = ?", partyId)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("DELETE FROM partyWaypoints WHERE partyId = ?", partyId)
+	if err != nil {
+		return err
+	}
+
+	err = deletePartyInvitesAndRequests(partyId)
+	if err != nil {
+		return err
+	}
+
 	_, err = db.Exec("DELETE FROM parties WHERE id = ?", partyId)
 	if err != nil {
 		return err
 	}
 
+	partiesMtx.Lock()
+	defer partiesMtx.Unlock()
+
+	if party, ok := parties[partyId]; ok {
+		party.setMembers(nil)
+	}
+
 	delete(parties, partyId)
 
 	return nil
 }
 
+func isPartyFull(partyId int) (bool, error) {
+	if config.party.maxMembers <= 0 {
+		return false, nil
+	}
+
+	var memberCount int
+	err := db.QueryRow("SELECT COUNT(*) FROM partyMembers WHERE partyId = ?", partyId).Scan(&memberCount)
+	if err != nil {
+		return false, err
+	}
+
+	return memberCount >= config.party.maxMembers, nil
+}
+
+func isPartyOfficer(partyId int, playerUuid string) (bool, error) {
+	var officerCount int
+	err := db.QueryRow("SELECT COUNT(*) FROM partyOfficers WHERE partyId = ? AND uuid = ?", partyId, playerUuid).Scan(&officerCount)
+	if err != nil {
+		return false, err
+	}
+
+	return officerCount > 0, nil
+}
+
+func setPartyOfficer(partyId int, playerUuid string, officer bool) error {
+	var err error
+	if officer {
+		_, err = db.Exec("INSERT IGNORE INTO partyOfficers (partyId, uuid) VALUES (?, ?)", partyId, playerUuid)
+	} else {
+		_, err = db.Exec("DELETE FROM partyOfficers WHERE partyId = ? AND uuid = ?", partyId, playerUuid)
+	}
+	if err != nil {
+		return err
+	}
+
+	partiesMtx.Lock()
+	defer partiesMtx.Unlock()
+
+	if party, ok := parties[partyId]; ok {
+		for _, member := range party.Members {
+			if member.Uuid == playerUuid {
+				member.Officer = officer
+				break
+			}
+		}
+
+		sendPartyData(partyId, true)
+	}
+
+	return nil
+}
+
+func getPartyWaypointsFromDatabase(partyId int) (partyWaypoints []*PartyWaypoint, err error) {
+	results, err := db.Query("SELECT uuid, mapId, x, y, label, timestampExpired FROM partyWaypoints WHERE partyId = ? AND timestampExpired > UTC_TIMESTAMP() ORDER BY timestampCreated", partyId)
+	if err != nil {
+		return partyWaypoints, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		partyWaypoint := &PartyWaypoint{}
+
+		err := results.Scan(&partyWaypoint.Uuid, &partyWaypoint.MapId, &partyWaypoint.X, &partyWaypoint.Y, &partyWaypoint.Label, &partyWaypoint.Expiration)
+		if err != nil {
+			return partyWaypoints, err
+		}
+
+		partyWaypoints = append(partyWaypoints, partyWaypoint)
+	}
+
+	return partyWaypoints, nil
+}
+
+// setPartyWaypoint sets a member's waypoint, replacing their previous one
+func setPartyWaypoint(partyId int, partyWaypoint *PartyWaypoint) error {
+	partyWaypoint.Expiration = time.Now().UTC().Add(time.Duration(config.party.waypointExpiryMinutes) * time.Minute)
+
+	_, err := db.Exec("INSERT INTO partyWaypoints (partyId, uuid, mapId, x, y, label, timestampCreated, timestampExpired) VALUES (?, ?, ?, ?, ?, ?, UTC_TIMESTAMP(), ?) ON DUPLICATE KEY UPDATE mapId = ?, x = ?, y = ?, label = ?, timestampCreated = UTC_TIMESTAMP(), timestampExpired = ?", partyId, partyWaypoint.Uuid, partyWaypoint.MapId, partyWaypoint.X, partyWaypoint.Y, partyWaypoint.Label, partyWaypoint.Expiration, partyWaypoint.MapId, partyWaypoint.X, partyWaypoint.Y, partyWaypoint.Label, partyWaypoint.Expiration)
+	if err != nil {
+		return err
+	}
+
+	partiesMtx.Lock()
+	defer partiesMtx.Unlock()
+
+	party, ok := parties[partyId]
+	if !ok {
+		return errors.New("party id not in cache")
+	}
+
+	removePartyWaypointFromCache(party, partyWaypoint.Uuid)
+	party.Waypoints = append(party.Waypoints, partyWaypoint)
+
+	partyWaypointJson, err := json.Marshal(partyWaypoint)
+	if err != nil {
+		return err
+	}
+
+	sendPartyMsg(partyId, buildMsg("pw", partyWaypointJson), "")
+
+	return nil
+}
+
+func clearPartyWaypoint(partyId int, playerUuid string) error {
+	_, err := db.Exec("DELETE FROM partyWaypoints WHERE partyId = ? AND uuid = ?", partyId, playerUuid)
+	if err != nil {
+		return err
+	}
+
+	partiesMtx.Lock()
+	defer partiesMtx.Unlock()
+
+	party, ok := parties[partyId]
+	if !ok {
+		return errors.New("party id not in cache")
+	}
+
+	if removePartyWaypointFromCache(party, playerUuid) {
+		sendPartyMsg(partyId, buildMsg("pwc", playerUuid), "")
+	}
+
+	return nil
+}
+
+// removePartyWaypointFromCache removes a member's waypoint from a cached
+// party; partiesMtx must be held
+func removePartyWaypointFromCache(party *Party, playerUuid string) (removed bool) {
+	for i, partyWaypoint := range party.Waypoints {
+		if partyWaypoint.Uuid == playerUuid {
+			party.Waypoints = append(party.Waypoints[:i], party.Waypoints[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// expirePartyWaypoints removes expired waypoints from cached parties and
+// tells their members
+func expirePartyWaypoints() {
+	now := time.Now().UTC()
+
+	partiesMtx.Lock()
+	for partyId, party := range parties {
+		var expiredUuids []string
+		for _, partyWaypoint := range party.Waypoints {
+			if !partyWaypoint.Expiration.After(now) {
+				expiredUuids = append(expiredUuids, partyWaypoint.Uuid)
+			}
+		}
+
+		for _, uuid := range expiredUuids {
+			removePartyWaypointFromCache(party, uuid)
+			sendPartyMsg(partyId, buildMsg("pwc", uuid), "")
+		}
+	}
+	partiesMtx.Unlock()
+
+	_, err := db.Exec("DELETE FROM partyWaypoints WHERE timestampExpired <= UTC_TIMESTAMP()")
+	if err != nil {
+		writeErrLog("SERVER", "party", err.Error())
+	}
+}
+
+// sendPartyGather asks the other online members of a party to gather at a
+// location
+func sendPartyGather(partyId int, partyGather *PartyGather) error {
+	partyGatherJson, err := json.Marshal(partyGather)
+	if err != nil {
+		return err
+	}
+
+	partiesMtx.RLock()
+	defer partiesMtx.RUnlock()
+
+	sendPartyMsg(partyId, buildMsg("pg", partyGatherJson), partyGather.Uuid)
+
+	return nil
+}
+
+func createPartyInvite(partyId int, playerUuid string, inviterUuid string) error {
+	_, err := db.Exec("INSERT INTO partyInvites (partyId, uuid, inviterUuid, timestampCreated, timestampExpired) VALUES (?, ?, ?, UTC_TIMESTAMP(), DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? HOUR)) ON DUPLICATE KEY UPDATE inviterUuid = ?, timestampCreated = UTC_TIMESTAMP(), timestampExpired = DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? HOUR)", partyId, playerUuid, inviterUuid, config.party.inviteExpiryHours, inviterUuid, config.party.inviteExpiryHours)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func getPlayerPartyInvites(playerUuid string) (partyInvites []*PartyInvite, err error) {
+	results, err := db.Query("SELECT pi.partyId, p.name, pi.uuid, pi.inviterUuid, pi.timestampExpired FROM partyInvites pi JOIN parties p ON p.id = pi.partyId WHERE pi.uuid = ? AND p.game = ? AND pi.timestampExpired > UTC_TIMESTAMP() ORDER BY pi.timestampCreated", playerUuid, config.gameName)
+	if err != nil {
+		return partyInvites, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		partyInvite := &PartyInvite{}
+
+		err := results.Scan(&partyInvite.PartyId, &partyInvite.PartyName, &partyInvite.Uuid, &partyInvite.InviterUuid, &partyInvite.Expiration)
+		if err != nil {
+			return partyInvites, err
+		}
+
+		partyInvite.Name = getNameFromUuid(partyInvite.Uuid)
+		partyInvite.InviterName = getNameFromUuid(partyInvite.InviterUuid)
+
+		partyInvites = append(partyInvites, partyInvite)
+	}
+
+	return partyInvites, nil
+}
+
+func hasPartyInvite(partyId int, playerUuid string) (bool, error) {
+	var inviteCount int
+	err := db.QueryRow("SELECT COUNT(*) FROM partyInvites WHERE partyId = ? AND uuid = ? AND timestampExpired > UTC_TIMESTAMP()", partyId, playerUuid).Scan(&inviteCount)
+	if err != nil {
+		return false, err
+	}
+
+	return inviteCount > 0, nil
+}
+
+func deletePartyInvite(partyId int, playerUuid string) error {
+	_, err := db.Exec("DELETE FROM partyInvites WHERE partyId = ? AND uuid = ?", partyId, playerUuid)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func createPartyJoinRequest(partyId int, playerUuid string) error {
+	_, err := db.Exec("INSERT INTO partyJoinRequests (partyId, uuid, timestampCreated, timestampExpired) VALUES (?, ?, UTC_TIMESTAMP(), DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? HOUR)) ON DUPLICATE KEY UPDATE timestampCreated = UTC_TIMESTAMP(), timestampExpired = DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? HOUR)", partyId, playerUuid, config.party.inviteExpiryHours, config.party.inviteExpiryHours)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func getPartyJoinRequests(partyId int) (partyJoinRequests []*PartyJoinRequest, err error) {
+	results, err := db.Query("SELECT partyId, uuid, timestampExpired FROM partyJoinRequests WHERE partyId = ? AND timestampExpired > UTC_TIMESTAMP() ORDER BY timestampCreated", partyId)
+	if err != nil {
+		return partyJoinRequests, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		partyJoinRequest := &PartyJoinRequest{}
+
+		err := results.Scan(&partyJoinRequest.PartyId, &partyJoinRequest.Uuid, &partyJoinRequest.Expiration)
+		if err != nil {
+			return partyJoinRequests, err
+		}
+
+		partyJoinRequest.Name = getNameFromUuid(partyJoinRequest.Uuid)
+
+		partyJoinRequests = append(partyJoinRequests, partyJoinRequest)
+	}
+
+	return partyJoinRequests, nil
+}
+
+func hasPartyJoinRequest(partyId int, playerUuid string) (bool, error) {
+	var requestCount int
+	err := db.QueryRow("SELECT COUNT(*) FROM partyJoinRequests WHERE partyId = ? AND uuid = ? AND timestampExpired > UTC_TIMESTAMP()", partyId, playerUuid).Scan(&requestCount)
+	if err != nil {
+		return false, err
+	}
+
+	return requestCount > 0, nil
+}
+
+func deletePartyJoinRequest(partyId int, playerUuid string) error {
+	_, err := db.Exec("DELETE FROM partyJoinRequests WHERE partyId = ? AND uuid = ?", partyId, playerUuid)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// deletePlayerPartyInvitesAndRequests clears invites and join requests once a
+// player has joined a party
+func deletePlayerPartyInvitesAndRequests(playerUuid string) error {
+	_, err := db.Exec("DELETE pi FROM partyInvites pi JOIN parties p ON p.id = pi.partyId WHERE pi.uuid = ? AND p.game = ?", playerUuid, config.gameName)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("DELETE pjr FROM partyJoinRequests pjr JOIN parties p ON p.id = pjr.partyId WHERE pjr.uuid = ? AND p.game = ?", playerUuid, config.gameName)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func deletePartyInvitesAndRequests(partyId int) error {
+	_, err := db.Exec("DELETE FROM partyInvites WHERE partyId = ?", partyId)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("DELETE FROM partyJoinRequests WHERE partyId = ?", partyId)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// sendPartyInvite notifies a player of an invite if they are online
+func sendPartyInvite(partyInvite *PartyInvite) {
+	if client, ok := clients.Load(partyInvite.Uuid); ok {
+		partyInviteJson, err := json.Marshal(partyInvite)
+		if err != nil {
+			return
+		}
+
+		select {
+		case client.send <- buildMsg("pi", partyInviteJson):
+		default:
+			writeErrLog(client.uuid, "sess", "send channel is full")
+		}
+	}
+}
+
+// sendPartyInvites sends a player their pending invites when they connect
+func (c *SessionClient) sendPartyInvites() {
+	partyInvites, err := getPlayerPartyInvites(c.uuid)
+	if err != nil {
+		writeErrLog(c.uuid, "sess", err.Error())
+		return
+	}
+
+	for _, partyInvite := range partyInvites {
+		sendPartyInvite(partyInvite)
+	}
+}
+
+// sendPartyJoinRequest notifies the online owner and officers of a party of a
+// join request
+func sendPartyJoinRequest(partyJoinRequest *PartyJoinRequest) {
+	partiesMtx.RLock()
+	defer partiesMtx.RUnlock()
+
+	party, ok := parties[partyJoinRequest.PartyId]
+	if !ok {
+		return
+	}
+
+	partyJoinRequestJson, err := json.Marshal(partyJoinRequest)
+	if err != nil {
+		return
+	}
+
+	for _, member := range party.Members {
+		if member.Uuid != party.OwnerUuid && !member.Officer {
+			continue
+		}
+		if client, ok := clients.Load(member.Uuid); ok {
+			select {
+			case client.send <- buildMsg("pjr", partyJoinRequestJson):
+			default:
+				writeErrLog(client.uuid, "sess", "send channel is full")
+			}
+		}
+	}
+}
+
 func writePartyChatMessage(msgId, uuid, mapId, prevMapId, prevLocations string, x, y int, contents string, partyId int) error {
 	_, err := db.Exec("INSERT INTO chatMessages (msgId, game, uuid, mapId, prevMapId, prevLocations, x, y, contents, partyId) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", msgId, config.gameName, uuid, mapId, prevMapId, prevLocations, x, y, contents, partyId)
 	if err != nil {
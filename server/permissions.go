@@ -0,0 +1,334 @@
+/*
+	Copyright (C) 2021-2023  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+)
+
+const (
+	permissionBan            = "ban"
+	permissionMute           = "mute"
+	permissionGrantBadge     = "grant_badge"
+	permissionResetPassword  = "reset_password"
+	permissionRename         = "rename"
+	permissionManageEvents   = "manage_events"
+	permissionManageRoles    = "manage_roles"
+	permissionViewIp         = "view_ip"
+	permissionKick           = "kick"
+	permissionAnnounce       = "announce"
+	permissionViewModeration = "view_moderation"
+	permissionViewSessions   = "view_sessions"
+	permissionReports        = "reports"
+)
+
+var permissions = []string{
+	permissionBan,
+	permissionMute,
+	permissionGrantBadge,
+	permissionResetPassword,
+	permissionRename,
+	permissionManageEvents,
+	permissionManageRoles,
+	permissionViewIp,
+	permissionKick,
+	permissionAnnounce,
+	permissionViewModeration,
+	permissionViewSessions,
+	permissionReports,
+}
+
+// roles given to staff ranks without needing to be assigned
+var rankRoles = map[int]string{
+	1: "moderator",
+	2: "admin",
+}
+
+type adminActorKey struct{}
+
+type AdminActor struct {
+	Uuid        string
+	Rank        int
+	Permissions map[string]bool
+}
+
+type AdminRole struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+type AdminPlayerRoles struct {
+	Uuid        string   `json:"uuid"`
+	Name        string   `json:"name"`
+	Rank        int      `json:"rank"`
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+}
+
+// getDefaultRoles gets the roles used when none are configured
+func getDefaultRoles() map[string][]string {
+	return map[string][]string{
+		"moderator": {permissionBan, permissionMute, permissionRename, permissionKick, permissionViewModeration, permissionViewSessions, permissionReports},
+		"admin":     permissions,
+	}
+}
+
+func isValidPermission(permission string) bool {
+	for _, p := range permissions {
+		if p == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+// adminHandler wraps an admin route, allowing only players with the given
+// permission, or with any permission if none is given
+func adminHandler(permission string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uuid, _, rank, _, banned, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
+		if uuid == "" || banned {
+			handleError(w, r, "access denied")
+			return
+		}
+
+		actorPermissions, err := getPlayerPermissions(uuid, rank)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		if (permission == "" && len(actorPermissions) == 0) || (permission != "" && !actorPermissions[permission]) {
+			handleError(w, r, "access denied")
+			return
+		}
+
+		actor := &AdminActor{
+			Uuid:        uuid,
+			Rank:        rank,
+			Permissions: actorPermissions,
+		}
+
+		handler(w, r.WithContext(context.WithValue(r.Context(), adminActorKey{}, actor)))
+	}
+}
+
+// getAdminActor gets the player making a request to an admin route
+func getAdminActor(r *http.Request) *AdminActor {
+	return r.Context().Value(adminActorKey{}).(*AdminActor)
+}
+
+func (a *AdminActor) hasPermission(permission string) bool {
+	return a.Permissions[permission]
+}
+
+// canActOn checks whether the actor outranks a player
+func (a *AdminActor) canActOn(targetUuid string) bool {
+	return a.Uuid != targetUuid && a.Rank > getPlayerRank(targetUuid)
+}
+
+// getPlayerPermissions gets the permissions of a player from their rank role
+// and assigned roles
+func getPlayerPermissions(uuid string, rank int) (map[string]bool, error) {
+	playerPermissions := make(map[string]bool)
+
+	roles, err := getPlayerRoles(uuid)
+	if err != nil {
+		return playerPermissions, err
+	}
+
+	if rankRole, ok := rankRoles[rank]; ok {
+		roles = append(roles, rankRole)
+	}
+
+	for _, role := range roles {
+		for _, permission := range config.roles[role] {
+			playerPermissions[permission] = true
+		}
+	}
+
+	return playerPermissions, nil
+}
+
+func adminRoles(w http.ResponseWriter, r *http.Request) {
+	actor := getAdminActor(r)
+
+	commandParam := r.URL.Query().Get("command")
+	if commandParam == "" {
+		handleError(w, r, "command not specified")
+		return
+	}
+
+	var response any
+
+	if (commandParam == "list" || commandParam == "player") && !actor.hasPermission(permissionViewModeration) && !actor.hasPermission(permissionManageRoles) {
+		handleError(w, r, "access denied")
+		return
+	}
+
+	switch commandParam {
+	case "list":
+		var roles []*AdminRole
+		for name, rolePermissions := range config.roles {
+			roles = append(roles, &AdminRole{Name: name, Permissions: rolePermissions})
+		}
+		sort.Slice(roles, func(a, b int) bool {
+			return roles[a].Name < roles[b].Name
+		})
+
+		response = roles
+	case "player", "grant", "revoke":
+		uuidParam, ok := getAdminTarget(w, r)
+		if !ok {
+			return
+		}
+
+		if commandParam != "player" {
+			roleParam := r.URL.Query().Get("role")
+			rolePermissions, ok := config.roles[roleParam]
+			if !ok {
+				handleError(w, r, "invalid role specified")
+				return
+			}
+
+			if !actor.hasPermission(permissionManageRoles) || !actor.canActOn(uuidParam) {
+				handleError(w, r, "access denied")
+				return
+			}
+
+			// roles can only be managed by players holding all of their permissions
+			for _, permission := range rolePermissions {
+				if !actor.hasPermission(permission) {
+					handleError(w, r, "access denied")
+					return
+				}
+			}
+
+			err := setPlayerRole(uuidParam, roleParam, commandParam == "grant")
+			if err != nil {
+				handleInternalError(w, r, err)
+				return
+			}
+
+			err = writeAuditLog(actor.Uuid, "roles/"+commandParam, uuidParam+" "+roleParam)
+			if err != nil {
+				handleInternalError(w, r, err)
+				return
+			}
+
+			w.Write([]byte("ok"))
+			return
+		}
+
+		rank := getPlayerRank(uuidParam)
+
+		roles, err := getPlayerRoles(uuidParam)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		playerPermissions, err := getPlayerPermissions(uuidParam, rank)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		playerRoles := &AdminPlayerRoles{
+			Uuid:        uuidParam,
+			Name:        getNameFromUuid(uuidParam),
+			Rank:        rank,
+			Roles:       roles,
+			Permissions: []string{},
+		}
+		if playerRoles.Roles == nil {
+			playerRoles.Roles = []string{}
+		}
+		for _, permission := range permissions {
+			if playerPermissions[permission] {
+				playerRoles.Permissions = append(playerRoles.Permissions, permission)
+			}
+		}
+
+		response = playerRoles
+	default:
+		handleError(w, r, "unknown command")
+		return
+	}
+
+	responseJson, err := json.Marshal(response)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	w.Write(responseJson)
+}
+
+func getPlayerRoles(uuid string) (roles []string, err error) {
+	results, err := db.Query("SELECT role FROM playerRoles WHERE uuid = ? ORDER BY role", uuid)
+	if err != nil {
+		return roles, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		var role string
+
+		err := results.Scan(&role)
+		if err != nil {
+			return roles, err
+		}
+
+		roles = append(roles, role)
+	}
+
+	return roles, nil
+}
+
+func setPlayerRole(uuid string, role string, granted bool) error {
+	if granted {
+		exists, err := playerExists(uuid)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errors.New("player not found")
+		}
+
+		_, err = db.Exec("INSERT IGNORE INTO playerRoles (uuid, role) VALUES (?, ?)", uuid, role)
+		if err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	_, err := db.Exec("DELETE FROM playerRoles WHERE uuid = ? AND role = ?", uuid, role)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
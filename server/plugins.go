@@ -0,0 +1,119 @@
+/*
+	Copyright (C) 2021-2023  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+)
+
+// GamePlugin holds the game-specific rules that would otherwise be
+// special-cased throughout the server
+type GamePlugin interface {
+	// JoinRoom is called after a client has switched rooms
+	JoinRoom(c *RoomClient)
+
+	// SyncSwitch is called when a client syncs a switch; returning true skips
+	// time trial, minigame and condition checks. Time trials and sprite rules
+	// are configured per game in timetrials/ and the sprite policy instead
+	SyncSwitch(c *RoomClient, switchId int, value bool) (handled bool, err error)
+
+	// GetApiRoutes returns additional HTTP routes by path, which respond as
+	// unsupported on servers running other games
+	GetApiRoutes() map[string]http.HandlerFunc
+
+	// HasEventLocationSource returns true if event locations are added from a
+	// game-specific source rather than the default event location pools
+	HasEventLocationSource() bool
+	// GetEventLocations returns event locations from the game-specific source
+	// within a depth range, where a max depth below the min depth means no max
+	GetEventLocations(r *rand.Rand, minDepth int, maxDepth int) ([]*EventLocationData, error)
+
+	// ImportLocations returns locations from a game-specific source to merge
+	// into the game's location graph
+	ImportLocations() ([]*Location, error)
+}
+
+// defaultGamePlugin is used for games without any custom rules
+type defaultGamePlugin struct{}
+
+func (defaultGamePlugin) JoinRoom(c *RoomClient) {}
+
+func (defaultGamePlugin) SyncSwitch(c *RoomClient, switchId int, value bool) (bool, error) {
+	return false, nil
+}
+
+func (defaultGamePlugin) GetApiRoutes() map[string]http.HandlerFunc {
+	return nil
+}
+
+func (defaultGamePlugin) HasEventLocationSource() bool {
+	return false
+}
+
+func (defaultGamePlugin) GetEventLocations(r *rand.Rand, minDepth int, maxDepth int) ([]*EventLocationData, error) {
+	return nil, nil
+}
+
+func (defaultGamePlugin) ImportLocations() ([]*Location, error) {
+	return nil, errors.New("game has no location import source")
+}
+
+var (
+	gamePlugins = make(map[string]GamePlugin)
+
+	// gamePlugin is the plugin for the game this server is running
+	gamePlugin GamePlugin = defaultGamePlugin{}
+)
+
+func registerGamePlugin(gameId string, plugin GamePlugin) {
+	gamePlugins[gameId] = plugin
+}
+
+func getGamePlugin(gameId string) GamePlugin {
+	if plugin, ok := gamePlugins[gameId]; ok {
+		return plugin
+	}
+
+	return defaultGamePlugin{}
+}
+
+// initGamePluginApis registers the HTTP routes of every game plugin, so that
+// routes of other games respond with an error rather than not being found
+func initGamePluginApis() {
+	for gameId, plugin := range gamePlugins {
+		for path, handler := range plugin.GetApiRoutes() {
+			if gameId != config.gameName {
+				handler = handleUnsupportedEndpoint
+			}
+
+			http.HandleFunc(path, handler)
+		}
+	}
+}
+
+func handleUnsupportedEndpoint(w http.ResponseWriter, r *http.Request) {
+	handleError(w, r, "endpoint not supported")
+}
+
+func setGamePlugins() {
+	registerGamePlugin("2kki", &yume2kkiPlugin{})
+
+	gamePlugin = getGamePlugin(config.gameName)
+}
@@ -0,0 +1,617 @@
+/*
+	Copyright (C) 2021-2023  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	reportStatusOpen      = "open"
+	reportStatusClaimed   = "claimed"
+	reportStatusResolved  = "resolved"
+	reportStatusDismissed = "dismissed"
+
+	// how long room visits are kept to find co-presence for reports
+	roomVisitRetention = 30 * time.Minute
+
+	// how many messages before and after a reported message are attached
+	reportSurroundingMsgCount = 5
+
+	maxOpenReportsPerPlayer = 10
+)
+
+var (
+	// player UUID -> recently visited rooms
+	roomVisits    = make(map[string][]*RoomVisit)
+	roomVisitsMtx sync.Mutex
+)
+
+type RoomVisit struct {
+	MapId   string    `json:"mapId"`
+	Entered time.Time `json:"entered"`
+	Left    time.Time `json:"left"`
+}
+
+type ReportChatMessage struct {
+	MsgId     string    `json:"msgId"`
+	Uuid      string    `json:"uuid"`
+	MapId     string    `json:"mapId"`
+	Contents  string    `json:"contents"`
+	Party     bool      `json:"party"`
+	Direct    bool      `json:"direct"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type ReportContext struct {
+	Message             *ReportChatMessage   `json:"message,omitempty"`
+	SurroundingMessages []*ReportChatMessage `json:"surroundingMessages,omitempty"`
+	ReporterMapId       string               `json:"reporterMapId"`
+	TargetMapId         string               `json:"targetMapId"`
+	CoPresence          []*RoomVisit         `json:"coPresence"`
+}
+
+type PlayerReport struct {
+	Id                 int            `json:"id"`
+	Game               string         `json:"game"`
+	ReporterUuid       string         `json:"reporterUuid"`
+	ReporterName       string         `json:"reporterName"`
+	TargetUuid         string         `json:"targetUuid"`
+	TargetName         string         `json:"targetName"`
+	MsgId              string         `json:"msgId"`
+	Reason             string         `json:"reason"`
+	Context            *ReportContext `json:"context"`
+	Status             string         `json:"status"`
+	ClaimedUuid        string         `json:"claimedUuid"`
+	Note               string         `json:"note"`
+	ModerationActionId int            `json:"moderationActionId"`
+	Timestamp          time.Time      `json:"timestamp"`
+}
+
+// addRoomVisit records a player entering a room
+func addRoomVisit(uuid string, mapId string) {
+	roomVisitsMtx.Lock()
+	defer roomVisitsMtx.Unlock()
+
+	threshold := time.Now().Add(-roomVisitRetention)
+
+	var visits []*RoomVisit
+	for _, visit := range roomVisits[uuid] {
+		if visit.Left.IsZero() || visit.Left.After(threshold) {
+			visits = append(visits, visit)
+		}
+	}
+
+	roomVisits[uuid] = append(visits, &RoomVisit{MapId: mapId, Entered: time.Now()})
+}
+
+// endRoomVisit records a player leaving their current room
+func endRoomVisit(uuid string) {
+	roomVisitsMtx.Lock()
+	defer roomVisitsMtx.Unlock()
+
+	visits := roomVisits[uuid]
+	if len(visits) != 0 && visits[len(visits)-1].Left.IsZero() {
+		visits[len(visits)-1].Left = time.Now()
+	}
+}
+
+// pruneRoomVisits removes visits past the retention period
+func pruneRoomVisits() {
+	roomVisitsMtx.Lock()
+	defer roomVisitsMtx.Unlock()
+
+	threshold := time.Now().Add(-roomVisitRetention)
+
+	for uuid, visits := range roomVisits {
+		var keptVisits []*RoomVisit
+		for _, visit := range visits {
+			if visit.Left.IsZero() || visit.Left.After(threshold) {
+				keptVisits = append(keptVisits, visit)
+			}
+		}
+
+		if keptVisits == nil {
+			delete(roomVisits, uuid)
+		} else {
+			roomVisits[uuid] = keptVisits
+		}
+	}
+}
+
+// getRoomCoPresence gets the times two players were recently in the same room
+func getRoomCoPresence(uuid string, otherUuid string) (coPresence []*RoomVisit) {
+	roomVisitsMtx.Lock()
+	defer roomVisitsMtx.Unlock()
+
+	now := time.Now()
+
+	for _, visit := range roomVisits[uuid] {
+		for _, otherVisit := range roomVisits[otherUuid] {
+			if visit.MapId != otherVisit.MapId {
+				continue
+			}
+
+			entered, left := visit.Entered, visit.Left
+			if otherVisit.Entered.After(entered) {
+				entered = otherVisit.Entered
+			}
+			if left.IsZero() {
+				left = now
+			}
+			if !otherVisit.Left.IsZero() && otherVisit.Left.Before(left) {
+				left = otherVisit.Left
+			}
+
+			if entered.Before(left) {
+				coPresence = append(coPresence, &RoomVisit{MapId: visit.MapId, Entered: entered, Left: left})
+			}
+		}
+	}
+
+	return coPresence
+}
+
+func getPlayerMapId(uuid string) string {
+	if client, ok := clients.Load(uuid); ok && client.rClient != nil {
+		return client.rClient.mapId
+	}
+
+	return ""
+}
+
+// getReportContext gathers the context of a report at the time it is made
+func getReportContext(reporterUuid string, targetUuid string, msgId string) (*ReportContext, error) {
+	reportContext := &ReportContext{
+		ReporterMapId: getPlayerMapId(reporterUuid),
+		TargetMapId:   getPlayerMapId(targetUuid),
+		CoPresence:    getRoomCoPresence(reporterUuid, targetUuid),
+	}
+
+	if reportContext.CoPresence == nil {
+		reportContext.CoPresence = []*RoomVisit{}
+	}
+
+	if msgId == "" {
+		return reportContext, nil
+	}
+
+	message, surroundingMessages, err := getReportChatMessages(reporterUuid, msgId)
+	if err != nil {
+		return reportContext, err
+	}
+	if message == nil || message.Uuid != targetUuid {
+		return reportContext, errors.New("message not found")
+	}
+
+	reportContext.Message = message
+	reportContext.SurroundingMessages = surroundingMessages
+
+	return reportContext, nil
+}
+
+func handleReport(w http.ResponseWriter, r *http.Request) {
+	var uuid string
+	var banned bool
+
+	token := r.Header.Get("Authorization")
+	if token == "" {
+		uuid, banned, _ = getOrCreatePlayerData(getIp(r))
+	} else {
+		uuid, _, _, _, banned, _ = getPlayerDataFromToken(token)
+		if uuid == "" {
+			handleError(w, r, "invalid token")
+			return
+		}
+	}
+
+	if banned {
+		handleError(w, r, "player is banned")
+		return
+	}
+
+	targetUuid := r.URL.Query().Get("uuid")
+	if targetUuid == "" {
+		handleError(w, r, "uuid not specified")
+		return
+	}
+	if targetUuid == uuid {
+		handleError(w, r, "cannot report self")
+		return
+	}
+
+	msgId := r.URL.Query().Get("msgId")
+	if msgId != "" && len(msgId) != 12 {
+		handleError(w, r, "invalid msgId")
+		return
+	}
+
+	reason := strings.TrimSpace(r.URL.Query().Get("reason"))
+	if reason == "" || len(reason) > 500 {
+		handleError(w, r, "invalid reason")
+		return
+	}
+
+	exists, err := playerExists(targetUuid)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+	if !exists {
+		handleError(w, r, "player not found")
+		return
+	}
+
+	openReportCount, duplicate, err := getPlayerOpenReportInfo(uuid, targetUuid, msgId)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+	if duplicate {
+		handleError(w, r, "already reported")
+		return
+	}
+	if openReportCount >= maxOpenReportsPerPlayer {
+		handleError(w, r, "too many open reports")
+		return
+	}
+
+	reportContext, err := getReportContext(uuid, targetUuid, msgId)
+	if err != nil {
+		handleError(w, r, err.Error())
+		return
+	}
+
+	err = writePlayerReport(uuid, targetUuid, msgId, reason, reportContext)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	w.Write([]byte("ok"))
+}
+
+func adminReports(w http.ResponseWriter, r *http.Request) {
+	uuid := getAdminActor(r).Uuid
+
+	commandParam := r.URL.Query().Get("command")
+	if commandParam == "" {
+		handleError(w, r, "command not specified")
+		return
+	}
+
+	if commandParam == "list" {
+		statuses := []string{reportStatusOpen, reportStatusClaimed}
+		if statusParam := r.URL.Query().Get("status"); statusParam != "" {
+			statuses = strings.Split(statusParam, ",")
+		}
+
+		reports, err := getPlayerReports(statuses, r.URL.Query().Get("uuid"))
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		if reports == nil {
+			reports = []*PlayerReport{}
+		}
+
+		reportsJson, err := json.Marshal(reports)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		w.Write(reportsJson)
+		return
+	}
+
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		handleError(w, r, "invalid id value")
+		return
+	}
+
+	note := r.URL.Query().Get("note")
+	if len(note) > 500 {
+		handleError(w, r, "note too long")
+		return
+	}
+
+	var moderationActionId int
+	if actionIdParam := r.URL.Query().Get("actionId"); actionIdParam != "" {
+		moderationActionId, err = strconv.Atoi(actionIdParam)
+		if err != nil {
+			handleError(w, r, "invalid actionId value")
+			return
+		}
+	}
+
+	switch commandParam {
+	case "claim":
+		err = claimPlayerReport(id, uuid)
+	case "resolve", "dismiss":
+		status := reportStatusResolved
+		if commandParam == "dismiss" {
+			status = reportStatusDismissed
+		}
+		err = closePlayerReport(id, uuid, status, note)
+		if err == nil && moderationActionId != 0 {
+			err = linkPlayerReport(id, moderationActionId)
+		}
+	case "link":
+		err = linkPlayerReport(id, moderationActionId)
+	default:
+		handleError(w, r, "unknown command")
+		return
+	}
+	if err != nil {
+		handleError(w, r, err.Error())
+		return
+	}
+
+	err = writeAuditLog(uuid, "reports/"+commandParam, strconv.Itoa(id))
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	w.Write([]byte("ok"))
+}
+
+// getReportChatMessages finds a chat message, or a direct message sent to the
+// reporter, along with the messages around it in the same chat
+func getReportChatMessages(reporterUuid string, msgId string) (message *ReportChatMessage, surroundingMessages []*ReportChatMessage, err error) {
+	message = &ReportChatMessage{}
+
+	var game string
+	var partyId int
+
+	err = db.QueryRow("SELECT cm.msgId, cm.uuid, cm.mapId, cm.contents, cm.partyId IS NOT NULL, cm.timestamp, cm.game, COALESCE(cm.partyId, 0) FROM ((SELECT msgId, uuid, mapId, contents, partyId, timestamp, game FROM chatMessages WHERE msgId = ?) UNION ALL (SELECT msgId, uuid, mapId, contents, partyId, timestamp, game FROM chatMessagesArchive WHERE msgId = ?)) cm LIMIT 1", msgId, msgId).Scan(&message.MsgId, &message.Uuid, &message.MapId, &message.Contents, &message.Party, &message.Timestamp, &game, &partyId)
+	if err == sql.ErrNoRows {
+		return getReportDirectMessages(reporterUuid, msgId)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// party messages can only be reported by party members
+	if message.Party {
+		reporterPartyId, err := getPlayerPartyId(reporterUuid)
+		if err != nil {
+			return nil, nil, err
+		}
+		if reporterPartyId != partyId {
+			return nil, nil, nil
+		}
+	}
+
+	selectClause := "SELECT msgId, uuid, mapId, contents, partyId IS NOT NULL, timestamp FROM "
+	whereClause := " WHERE game = ? AND COALESCE(partyId, 0) = ? AND msgId <> ? AND timestamp "
+	var query string
+	for i, table := range []string{"chatMessages", "chatMessagesArchive"} {
+		if i != 0 {
+			query += " UNION ALL "
+		}
+		query += "(" + selectClause + table + whereClause + "<= ? ORDER BY timestamp DESC LIMIT ?) UNION ALL (" + selectClause + table + whereClause + ">= ? ORDER BY timestamp LIMIT ?)"
+	}
+
+	var args []any
+	for i := 0; i < 2; i++ {
+		args = append(args, game, partyId, msgId, message.Timestamp, reportSurroundingMsgCount, game, partyId, msgId, message.Timestamp, reportSurroundingMsgCount)
+	}
+
+	surroundingMessages, err = scanReportChatMessages("SELECT * FROM ("+query+") m ORDER BY timestamp", args...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return message, trimSurroundingMessages(surroundingMessages, message.Timestamp), nil
+}
+
+// trimSurroundingMessages keeps the messages closest to a reported message
+// from the results of both the live and archived chat tables
+func trimSurroundingMessages(messages []*ReportChatMessage, timestamp time.Time) []*ReportChatMessage {
+	var beforeCount int
+	for _, message := range messages {
+		if !message.Timestamp.After(timestamp) {
+			beforeCount++
+		}
+	}
+
+	start := 0
+	if beforeCount > reportSurroundingMsgCount {
+		start = beforeCount - reportSurroundingMsgCount
+	}
+
+	end := len(messages)
+	if end-beforeCount > reportSurroundingMsgCount {
+		end = beforeCount + reportSurroundingMsgCount
+	}
+
+	return messages[start:end]
+}
+
+func getReportDirectMessages(reporterUuid string, msgId string) (message *ReportChatMessage, surroundingMessages []*ReportChatMessage, err error) {
+	message = &ReportChatMessage{Direct: true}
+
+	err = db.QueryRow("SELECT msgId, uuid, contents, timestamp FROM directMessages WHERE msgId = ? AND recipientUuid = ?", msgId, reporterUuid).Scan(&message.MsgId, &message.Uuid, &message.Contents, &message.Timestamp)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	conversationClause := "FROM directMessages WHERE ((uuid = ? AND recipientUuid = ?) OR (uuid = ? AND recipientUuid = ?)) AND msgId <> ? AND timestamp "
+	query := "SELECT * FROM ((SELECT msgId, uuid, '', contents, 0, timestamp " + conversationClause + "<= ? ORDER BY timestamp DESC LIMIT ?) UNION ALL (SELECT msgId, uuid, '', contents, 0, timestamp " + conversationClause + ">= ? ORDER BY timestamp LIMIT ?)) m ORDER BY timestamp"
+
+	var args []any
+	for i := 0; i < 2; i++ {
+		args = append(args, message.Uuid, reporterUuid, reporterUuid, message.Uuid, msgId, message.Timestamp, reportSurroundingMsgCount)
+	}
+
+	surroundingMessages, err = scanReportChatMessages(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, surroundingMessage := range surroundingMessages {
+		surroundingMessage.Direct = true
+	}
+
+	return message, surroundingMessages, nil
+}
+
+func scanReportChatMessages(query string, args ...any) (messages []*ReportChatMessage, err error) {
+	results, err := db.Query(query, args...)
+	if err != nil {
+		return messages, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		message := &ReportChatMessage{}
+
+		err := results.Scan(&message.MsgId, &message.Uuid, &message.MapId, &message.Contents, &message.Party, &message.Timestamp)
+		if err != nil {
+			return messages, err
+		}
+
+		messages = append(messages, message)
+	}
+
+	return messages, nil
+}
+
+// getPlayerOpenReportInfo gets how many unhandled reports a player has made and
+// whether one of them is for the same player and message
+func getPlayerOpenReportInfo(reporterUuid string, targetUuid string, msgId string) (openReportCount int, duplicate bool, err error) {
+	err = db.QueryRow("SELECT COUNT(*), COALESCE(SUM(CASE WHEN targetUuid = ? AND msgId = ? THEN 1 ELSE 0 END), 0) > 0 FROM playerReports WHERE reporterUuid = ? AND status IN (?, ?)", targetUuid, msgId, reporterUuid, reportStatusOpen, reportStatusClaimed).Scan(&openReportCount, &duplicate)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return openReportCount, duplicate, nil
+}
+
+func writePlayerReport(reporterUuid string, targetUuid string, msgId string, reason string, reportContext *ReportContext) error {
+	contextJson, err := json.Marshal(reportContext)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("INSERT INTO playerReports (game, reporterUuid, targetUuid, msgId, reason, context, status, claimedUuid, note, moderationActionId, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, '', '', 0, UTC_TIMESTAMP())", config.gameName, reporterUuid, targetUuid, msgId, reason, contextJson, reportStatusOpen)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func getPlayerReports(statuses []string, targetUuid string) (reports []*PlayerReport, err error) {
+	query := "SELECT pr.id, pr.game, pr.reporterUuid, COALESCE(ra.user, rpgd.name, ''), pr.targetUuid, COALESCE(ta.user, tpgd.name, ''), pr.msgId, pr.reason, pr.context, pr.status, pr.claimedUuid, pr.note, pr.moderationActionId, pr.timestamp FROM playerReports pr LEFT JOIN accounts ra ON ra.uuid = pr.reporterUuid LEFT JOIN playerGameData rpgd ON rpgd.uuid = pr.reporterUuid AND rpgd.game = pr.game LEFT JOIN accounts ta ON ta.uuid = pr.targetUuid LEFT JOIN playerGameData tpgd ON tpgd.uuid = pr.targetUuid AND tpgd.game = pr.game WHERE pr.status IN (?" + strings.Repeat(", ?", len(statuses)-1) + ")"
+
+	var args []any
+	for _, status := range statuses {
+		args = append(args, status)
+	}
+
+	if targetUuid != "" {
+		query += " AND pr.targetUuid = ?"
+		args = append(args, targetUuid)
+	}
+
+	query += " ORDER BY pr.timestamp"
+
+	results, err := db.Query(query, args...)
+	if err != nil {
+		return reports, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		report := &PlayerReport{}
+
+		var contextJson []byte
+
+		err := results.Scan(&report.Id, &report.Game, &report.ReporterUuid, &report.ReporterName, &report.TargetUuid, &report.TargetName, &report.MsgId, &report.Reason, &contextJson, &report.Status, &report.ClaimedUuid, &report.Note, &report.ModerationActionId, &report.Timestamp)
+		if err != nil {
+			return reports, err
+		}
+
+		err = json.Unmarshal(contextJson, &report.Context)
+		if err != nil {
+			return reports, err
+		}
+
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+func claimPlayerReport(id int, uuid string) error {
+	result, err := db.Exec("UPDATE playerReports SET status = ?, claimedUuid = ? WHERE id = ? AND status = ?", reportStatusClaimed, uuid, id, reportStatusOpen)
+	if err != nil {
+		return err
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errors.New("report not open")
+	}
+
+	return nil
+}
+
+// closePlayerReport resolves or dismisses a report, claiming it if unclaimed
+func closePlayerReport(id int, uuid string, status string, note string) error {
+	result, err := db.Exec("UPDATE playerReports SET status = ?, claimedUuid = CASE WHEN claimedUuid = '' THEN ? ELSE claimedUuid END, note = ? WHERE id = ? AND status IN (?, ?)", status, uuid, note, id, reportStatusOpen, reportStatusClaimed)
+	if err != nil {
+		return err
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errors.New("report already closed")
+	}
+
+	return nil
+}
+
+// linkPlayerReport links a report to a moderation action taken on its target
+func linkPlayerReport(id int, moderationActionId int) error {
+	result, err := db.Exec("UPDATE playerReports pr JOIN moderationActions ma ON ma.id = ? AND ma.targetUuid = pr.targetUuid SET pr.moderationActionId = ma.id WHERE pr.id = ?", moderationActionId, id)
+	if err != nil {
+		return err
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errors.New("report or moderation action not found")
+	}
+
+	return nil
+}
@@ -100,6 +100,8 @@ func joinRoomWs(conn *websocket.Conn, ip string, token string, roomId int) {
 		send:      make(chan []byte, 256),
 		receive:   make(chan []byte, 8),
 		key:       serverSecurity.NewClientKey(),
+
+		presenceUpdates: make(chan string, 8),
 	}
 
 	if session, ok := clients.Load(uuid); ok {
@@ -157,15 +159,17 @@ func (c *RoomClient) joinRoom(room *Room) {
 
 	c.send <- buildMsg("ri", c.room.id) // tell client they've switched rooms serverside
 
-	if config.gameName == "2kki" && c.sClient.rank == 0 {
-		c.send <- buildMsg("ss", 11, 2)
-	}
+	gamePlugin.JoinRoom(c)
+
+	c.checkTimeTrialSplits()
 
 	if !c.room.singleplayer {
 		c.getRoomPlayerData()
 
 		room.clients = append(room.clients, c)
 
+		addRoomVisit(c.sClient.uuid, c.mapId)
+
 		// tell everyone that a new client has connected
 		c.broadcast(buildMsg("c", c.sClient.id, c.sClient.uuid, c.sClient.rank, c.sClient.account, c.sClient.badge, c.sClient.medals[:])) // user %id% has connected message
 
@@ -178,6 +182,8 @@ func (c *RoomClient) joinRoom(room *Room) {
 	if c.sClient.account {
 		c.getRoomEventData()
 	}
+
+	c.sClient.sendPartyMemberUpdate()
 }
 
 func (c *RoomClient) leaveRoom() {
@@ -193,6 +199,8 @@ func (c *RoomClient) leaveRoom() {
 		c.room.clients = c.room.clients[:len(c.room.clients)-1]
 	}
 
+	endRoomVisit(c.sClient.uuid)
+
 	c.broadcast(buildMsg("d", c.sClient.id)) // user %id% has disconnected message
 }
 
@@ -202,6 +210,10 @@ func (c *RoomClient) broadcast(msg []byte) {
 			continue
 		}
 
+		if client.sClient.isHidingPresence(c.sClient.uuid) || (len(msg) > 3 && string(msg[:3]) == "say" && client.sClient.isBlocking(c.sClient.uuid)) {
+			continue
+		}
+
 		select {
 		case client.send <- msg:
 		default:
@@ -290,43 +302,50 @@ func (c *RoomClient) processMsg(msgStr string) (err error) {
 func (c *RoomClient) getRoomPlayerData() {
 	// send the new client info about the game state
 	for _, otherClient := range c.room.clients {
-		if otherClient == c {
+		if otherClient == c || c.sClient.isHidingPresence(otherClient.sClient.uuid) {
 			continue
 		}
 
-		c.send <- buildMsg("c", otherClient.sClient.id, otherClient.sClient.uuid, otherClient.sClient.rank, otherClient.sClient.account, otherClient.sClient.badge, otherClient.sClient.medals[:])
-		c.send <- buildMsg("m", otherClient.sClient.id, otherClient.x, otherClient.y)
-		if otherClient.facing != 0 {
-			c.send <- buildMsg("f", otherClient.sClient.id, otherClient.facing)
-		}
-		if otherClient.speed != 0 {
-			c.send <- buildMsg("spd", otherClient.sClient.id, otherClient.speed)
-		}
-		if otherClient.sClient.name != "" {
-			c.send <- buildMsg("name", otherClient.sClient.id, otherClient.sClient.name)
-		}
-		if otherClient.sClient.spriteIndex != -1 {
-			c.send <- buildMsg("spr", otherClient.sClient.id, otherClient.sClient.spriteName, otherClient.sClient.spriteIndex) // if the other client sent us valid sprite and index before
-		}
-		if otherClient.repeatingFlash {
-			c.send <- buildMsg("rfl", otherClient.sClient.id, otherClient.flash[:])
-		}
-		if otherClient.hidden {
-			c.send <- buildMsg("h", otherClient.sClient.id, 1)
-		}
-		if otherClient.sClient.systemName != "" {
-			c.send <- buildMsg("sys", otherClient.sClient.id, otherClient.sClient.systemName)
-		}
-		for picId, pic := range otherClient.pictures {
-			c.send <- buildMsg("ap", otherClient.sClient.id, picId, pic.posX, pic.posY, pic.mapX, pic.mapY, pic.panX, pic.panY, pic.magnify, pic.topTrans, pic.bottomTrans, pic.red, pic.blue, pic.green, pic.saturation, pic.effectMode, pic.effectPower, pic.name, pic.useTransparentColor, pic.fixedToMap)
-		}
+		c.sendPlayerData(otherClient)
+	}
+}
+
+// sendPlayerData sends the client the state of another client in the room
+func (c *RoomClient) sendPlayerData(otherClient *RoomClient) {
+	c.send <- buildMsg("c", otherClient.sClient.id, otherClient.sClient.uuid, otherClient.sClient.rank, otherClient.sClient.account, otherClient.sClient.badge, otherClient.sClient.medals[:])
+	c.send <- buildMsg("m", otherClient.sClient.id, otherClient.x, otherClient.y)
+	if otherClient.facing != 0 {
+		c.send <- buildMsg("f", otherClient.sClient.id, otherClient.facing)
+	}
+	if otherClient.speed != 0 {
+		c.send <- buildMsg("spd", otherClient.sClient.id, otherClient.speed)
+	}
+	if otherClient.sClient.name != "" {
+		c.send <- buildMsg("name", otherClient.sClient.id, otherClient.sClient.name)
+	}
+	if otherClient.sClient.spriteIndex != -1 {
+		c.send <- buildMsg("spr", otherClient.sClient.id, otherClient.sClient.spriteName, otherClient.sClient.spriteIndex) // if the other client sent us valid sprite and index before
+	}
+	if otherClient.repeatingFlash {
+		c.send <- buildMsg("rfl", otherClient.sClient.id, otherClient.flash[:])
+	}
+	if otherClient.hidden {
+		c.send <- buildMsg("h", otherClient.sClient.id, 1)
+	}
+	if otherClient.sClient.systemName != "" {
+		c.send <- buildMsg("sys", otherClient.sClient.id, otherClient.sClient.systemName)
+	}
+	for picId, pic := range otherClient.pictures {
+		c.send <- buildMsg("ap", otherClient.sClient.id, picId, pic.posX, pic.posY, pic.mapX, pic.mapY, pic.panX, pic.panY, pic.magnify, pic.topTrans, pic.bottomTrans, pic.red, pic.blue, pic.green, pic.saturation, pic.effectMode, pic.effectPower, pic.name, pic.useTransparentColor, pic.fixedToMap)
 	}
 }
 
 func (c *RoomClient) getRoomEventData() {
 	c.checkRoomConditions("", "")
 
-	for _, minigame := range c.room.minigames {
+	c.checkEventLocationCompletion()
+
+	for _, minigame := range c.room.getMinigames() {
 		if minigame.Dev && c.sClient.rank < 1 {
 			continue
 		}
@@ -334,7 +353,7 @@ func (c *RoomClient) getRoomEventData() {
 		if err != nil {
 			writeErrLog(c.sClient.uuid, c.mapId, "failed to read player minigame score for "+minigame.Id)
 		}
-		c.minigameScores = append(c.minigameScores, score)
+		c.minigameScores[minigame.Id] = score
 		varSyncType := 1
 		if minigame.InitialVarSync {
 			varSyncType = 2
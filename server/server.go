@@ -67,9 +67,20 @@ func Start() {
 	fmt.Println("Now starting YNOserver...")
 
 	configFile := flag.String("config", "config.yml", "Path to the configuration file")
+	validate := flag.Bool("validate", false, "Validate the configuration against the game files and exit")
+	simulateWeeks := flag.Int("simulate-events", 0, "Simulate expedition generation for a number of weeks and exit")
+	simulateSeed := flag.Int64("seed", 1, "Random seed for expedition simulation")
+	simulateStart := flag.String("simulate-start", "", "Start date (YYYY-MM-DD) for expedition simulation, defaults to today")
+	simulateCounts := flag.String("simulate-counts", "", "Player counts (game=count,...) for expedition simulation, defaults to the recorded averages")
+	importLocationsGame := flag.String("import-locations", "", "Import the location graph of a game from its plugin source and exit")
+	migrateTimeTrials := flag.Bool("migrate-time-trials", false, "Copy legacy time trial records into the run history and exit")
 	flag.Parse()
 
-	config = parseConfigFile(*configFile)
+	var err error
+	config, err = parseConfigFile(*configFile)
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
 
 	fmt.Printf("Current game ID is \"%s\".\n", config.gameName)
 
@@ -78,11 +89,44 @@ func Start() {
 	serverSecurity = security.New(config.signKey)
 	assets = getAssets(config.gamePath)
 
+	if *validate {
+		fmt.Print("Validating sprite policy...\n")
+		if validateSpritePolicy(config.spritePolicy, assets.spriteNames) != 0 {
+			os.Exit(1)
+		}
+		fmt.Print("Done.\n")
+		return
+	}
+
 	assets.ignoredSoundNames = config.badSounds
 	assets.pictureNames = config.pictureNames
 	assets.picturePrefixes = config.picturePrefixes
 	assets.battleAnimIds = config.battleAnimIds
 
+	setGamePlugins()
+
+	if *importLocationsGame != "" {
+		fmt.Printf("Importing locations for %s...\n", *importLocationsGame)
+		if err := importLocations(*importLocationsGame); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Print("Done.\n")
+		return
+	}
+
+	if *migrateTimeTrials {
+		fmt.Print("Migrating legacy time trials...\n")
+		setTimeTrials()
+		migrated, err := migrateLegacyTimeTrials()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Done, %d records migrated.\n", migrated)
+		return
+	}
+
 	fmt.Print("Setting conditions...\n")
 	setConditions()
 	fmt.Print("Done.\n")
@@ -91,10 +135,57 @@ func Start() {
 	setBadges()
 	fmt.Print("Done.\n")
 
+	fmt.Print("Setting minigames...\n")
+	setMinigames()
+	fmt.Print("Done.\n")
+
+	fmt.Print("Setting time trials...\n")
+	setTimeTrials()
+	fmt.Print("Done.\n")
+
+	fmt.Print("Setting event schedule...\n")
+	setEventSchedule()
+	fmt.Print("Done.\n")
+
+	fmt.Print("Setting locations...\n")
+	setLocations()
+	fmt.Print("Done.\n")
+
 	fmt.Print("Setting event VMs...\n")
 	setEventVms()
 	fmt.Print("Done.\n")
 
+	if *simulateWeeks > 0 {
+		startDate := truncateToDate(time.Now().UTC())
+		if *simulateStart != "" {
+			var err error
+			startDate, err = time.Parse("2006-01-02", *simulateStart)
+			if err != nil {
+				fmt.Println("invalid simulate-start value")
+				os.Exit(1)
+			}
+		}
+
+		var playerCounts map[string]int
+		if *simulateCounts != "" {
+			var err error
+			playerCounts, err = parseEventSimulationPlayerCounts(*simulateCounts)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		} else {
+			var err error
+			playerCounts, err = getAverageGamePlayerCounts()
+			if err != nil {
+				fmt.Printf("failed to read player counts, weighing games equally: %v\n", err)
+			}
+		}
+
+		simulateEvents(startDate, *simulateWeeks, *simulateSeed, playerCounts)
+		return
+	}
+
 	globalConditions = getGlobalConditions()
 
 	createRooms(assets.mapIds, config.spRooms)
@@ -117,16 +208,27 @@ func Start() {
 
 	fmt.Print("Initializing events...\n")
 	initEvents()
+	initEventPeriods()
+	initEventLocationMapIndex()
 	fmt.Print("Done.\n")
 
 	fmt.Print("Initializing badges...\n")
 	initBadges()
 	fmt.Print("Done.\n")
 
+	fmt.Print("Initializing leaderboards...\n")
+	initLeaderboards()
+	fmt.Print("Done.\n")
+
 	fmt.Print("Initializing session...\n")
 	initSession()
 	fmt.Print("Done.\n")
 
+	fmt.Print("Initializing moderation...\n")
+	initModeration()
+	initAdminActions()
+	fmt.Print("Done.\n")
+
 	scheduler.StartAsync()
 
 	http.HandleFunc("/room", handleRoom)
@@ -37,14 +37,26 @@ type Session struct {
 }
 
 func initSession() {
+	err := migratePartyPasses()
+	if err != nil {
+		writeErrLog("SERVER", "party", err.Error())
+	}
+
 	// we need a sender
 	sender := SessionClient{}
 
 	scheduler.Every(5).Seconds().Do(func() {
 		sender.broadcast(buildMsg("pc", clients.GetAmount()))
-		sendPartyUpdate()
 	})
 
+	// party updates are sent as they happen, this only catches changes made
+	// by other servers or missed updates
+	scheduler.Every(1).Minute().Do(reconcileParties)
+
+	scheduler.Every(1).Minute().Do(expirePartyWaypoints)
+
+	scheduler.Every(5).Minutes().Do(pruneRoomVisits)
+
 	scheduler.Cron("0 2,8,14,20 * * *").Do(func() {
 		writeGamePlayerCount(clients.GetAmount())
 	})
@@ -76,11 +88,12 @@ func joinSessionWs(conn *websocket.Conn, ip string, token string) {
 		writerEnd: make(chan bool, 1),
 		send:      make(chan []byte, 8),
 		receive:   make(chan []byte, 4),
+		stats:     newClientStats(),
 	}
 
-	var banned bool
+	var banned, muted bool
 	if token != "" {
-		client.uuid, client.name, client.rank, client.badge, banned, client.muted = getPlayerDataFromToken(token)
+		client.uuid, client.name, client.rank, client.badge, banned, muted = getPlayerDataFromToken(token)
 		if client.uuid != "" {
 			client.medals = getPlayerMedals(client.uuid)
 		}
@@ -89,9 +102,21 @@ func joinSessionWs(conn *websocket.Conn, ip string, token string) {
 	if client.uuid != "" {
 		client.account = true
 	} else {
-		client.uuid, banned, client.muted = getOrCreatePlayerData(ip)
+		client.uuid, banned, muted = getOrCreatePlayerData(ip)
 	}
 
+	if banned || muted {
+		// lift bans and mutes that expired since the last check
+		lifted, err := expireModerationActions(client.uuid)
+		if err != nil {
+			writeErrLog(client.uuid, "sess", err.Error())
+		} else if lifted {
+			banned, muted = getPlayerModerationStatus(client.uuid)
+		}
+	}
+
+	client.muted.Store(muted)
+
 	if banned {
 		writeErrLog(client.uuid, "sess", "player is banned")
 		return
@@ -123,6 +148,10 @@ func joinSessionWs(conn *websocket.Conn, ip string, token string) {
 
 	client.spriteName, client.spriteIndex, client.systemName = getPlayerGameData(client.uuid)
 
+	client.loadBlocks()
+
+	client.loadChatFilterState()
+
 	go client.msgWriter()
 
 	// register client to the clients list
@@ -131,11 +160,29 @@ func joinSessionWs(conn *websocket.Conn, ip string, token string) {
 	go client.msgProcessor()
 	go client.msgReader()
 
+	client.sendPartyMemberUpdate()
+
+	client.sendParty()
+
+	if client.account {
+		client.sendEventPeriodSummary()
+	}
+
+	client.sendPartyInvites()
+
+	client.sendDirectMessages()
+
 	writeLog(client.uuid, "sess", "connect", 200)
 }
 
 func (c *SessionClient) broadcast(msg []byte) {
+	isChat := len(msg) > 4 && string(msg[:4]) == "gsay"
+
 	for _, client := range clients.Get() {
+		if isChat && client.isBlocking(c.uuid) {
+			continue
+		}
+
 		select {
 		case client.send <- buildMsg(msg):
 		default:
@@ -160,11 +207,19 @@ func (c *SessionClient) processMsg(msg []byte) (err error) {
 		err = c.handleLcol(msgFields)
 	case "gsay", "psay": // global say and party say
 		err = c.handleGPSay(msgFields)
+	case "dm": // direct message
+		err = c.handleDm(msgFields)
 	case "pt": // party update
 		err = c.handlePt()
 		if err != nil {
 			c.send <- buildMsg("pt", "null")
 		}
+	case "pw": // party waypoint
+		err = c.handlePw(msgFields)
+	case "pwc": // clear party waypoint
+		err = c.handlePwc(msgFields)
+	case "pg": // party gather
+		err = c.handlePg(msgFields)
 	case "ep": // event period
 		err = c.handleEp()
 	case "e": // event list
@@ -0,0 +1,250 @@
+/*
+	Copyright (C) 2021-2023  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SpritePolicy restricts which sprites players may use on top of the sprites
+// present in the game files. A policy without any allow rules allows every
+// sprite, while room restrictions apply regardless.
+type SpritePolicy struct {
+	names      map[string]bool
+	substrings []string
+	regexes    []*regexp.Regexp
+
+	roomRestrictions []*SpriteRoomRestriction
+}
+
+// SpriteRoomRestriction limits sprites containing a substring to a set of rooms
+type SpriteRoomRestriction struct {
+	substring string
+	roomIds   map[int]bool
+}
+
+func newSpritePolicy(names []string, substrings []string, regexes []string) (*SpritePolicy, error) {
+	policy := &SpritePolicy{
+		names:      make(map[string]bool),
+		substrings: substrings,
+	}
+	for _, name := range names {
+		policy.names[name] = true
+	}
+	for _, expr := range regexes {
+		regex, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sprite policy regex %q: %w", expr, err)
+		}
+
+		policy.regexes = append(policy.regexes, regex)
+	}
+
+	return policy, nil
+}
+
+// parseSpriteRoomIds parses the comma-separated room ids of a room
+// restriction, rejecting any that aren't numbers
+func parseSpriteRoomIds(roomIds string) ([]int, error) {
+	var ids []int
+	for _, id := range strings.Split(roomIds, ",") {
+		idInt, err := strconv.Atoi(strings.TrimSpace(id))
+		if err != nil {
+			return nil, fmt.Errorf("invalid sprite policy room id %q", id)
+		}
+
+		ids = append(ids, idInt)
+	}
+
+	return ids, nil
+}
+
+func (p *SpritePolicy) addRoomRestriction(substring string, roomIds []int) {
+	restriction := &SpriteRoomRestriction{
+		substring: substring,
+		roomIds:   make(map[int]bool),
+	}
+	for _, roomId := range roomIds {
+		restriction.roomIds[roomId] = true
+	}
+
+	p.roomRestrictions = append(p.roomRestrictions, restriction)
+}
+
+func (p *SpritePolicy) hasAllowRules() bool {
+	return len(p.names) != 0 || len(p.substrings) != 0 || len(p.regexes) != 0
+}
+
+// spriteAllowRule is a single allow rule of a sprite policy
+type spriteAllowRule struct {
+	description string
+	matches     func(name string) bool
+}
+
+// getAllowRules returns the allow rules of the policy in the order they are
+// checked, with sprite names sorted
+func (p *SpritePolicy) getAllowRules() (rules []*spriteAllowRule) {
+	names := make([]string, 0, len(p.names))
+	for name := range p.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		name := name
+		rules = append(rules, &spriteAllowRule{
+			description: "name \"" + name + "\"",
+			matches:     func(spriteName string) bool { return spriteName == name },
+		})
+	}
+
+	for _, substring := range p.substrings {
+		substring := substring
+		rules = append(rules, &spriteAllowRule{
+			description: "substring \"" + substring + "\"",
+			matches:     func(spriteName string) bool { return strings.Contains(spriteName, substring) },
+		})
+	}
+
+	for _, regex := range p.regexes {
+		rules = append(rules, &spriteAllowRule{
+			description: "regex \"" + regex.String() + "\"",
+			matches:     regex.MatchString,
+		})
+	}
+
+	return rules
+}
+
+func (p *SpritePolicy) isAllowedByRules(name string) bool {
+	if p.names[name] {
+		return true
+	}
+
+	for _, substring := range p.substrings {
+		if strings.Contains(name, substring) {
+			return true
+		}
+	}
+
+	for _, regex := range p.regexes {
+		if regex.MatchString(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *SpritePolicy) getRoomRestriction(name string) *SpriteRoomRestriction {
+	for _, restriction := range p.roomRestrictions {
+		if strings.Contains(name, restriction.substring) {
+			return restriction
+		}
+	}
+
+	return nil
+}
+
+func (p *SpritePolicy) IsAllowed(name string, roomId int) bool {
+	if name == "" {
+		return true
+	}
+
+	if p.hasAllowRules() && !p.isAllowedByRules(name) {
+		return false
+	}
+
+	if restriction := p.getRoomRestriction(name); restriction != nil && !restriction.roomIds[roomId] {
+		return false
+	}
+
+	return true
+}
+
+// validateSpritePolicy reports how the sprite policy applies to the sprites
+// present in the game files and returns the number of problems found
+func validateSpritePolicy(policy *SpritePolicy, spriteNames map[string]bool) (problems int) {
+	names := make([]string, 0, len(spriteNames))
+	for name := range spriteNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if !policy.hasAllowRules() {
+		fmt.Printf("Sprite policy has no allow rules, all %d sprites are allowed.\n", len(names))
+	} else {
+		var rejected []string
+
+		for _, name := range names {
+			if !policy.isAllowedByRules(name) {
+				rejected = append(rejected, name)
+			}
+		}
+
+		fmt.Printf("%d of %d sprites are allowed.\n", len(names)-len(rejected), len(names))
+
+		// each rule is checked on its own so that rules overlapping an
+		// earlier rule are not reported as unused
+		for _, rule := range policy.getAllowRules() {
+			var matched bool
+			for _, name := range names {
+				if rule.matches(name) {
+					matched = true
+					break
+				}
+			}
+
+			if !matched {
+				fmt.Printf("Warning: %s does not match any sprite.\n", rule.description)
+				problems++
+			}
+		}
+
+		for _, name := range rejected {
+			fmt.Printf("Rejected: %s\n", name)
+		}
+	}
+
+	for _, restriction := range policy.roomRestrictions {
+		var count int
+		for _, name := range names {
+			if strings.Contains(name, restriction.substring) {
+				count++
+			}
+		}
+
+		roomIds := make([]int, 0, len(restriction.roomIds))
+		for roomId := range restriction.roomIds {
+			roomIds = append(roomIds, roomId)
+		}
+		sort.Ints(roomIds)
+
+		fmt.Printf("Sprites containing \"%s\" (%d) are restricted to rooms %v.\n", restriction.substring, count, roomIds)
+		if count == 0 {
+			fmt.Printf("Warning: room restriction \"%s\" does not match any sprite.\n", restriction.substring)
+			problems++
+		}
+	}
+
+	return problems
+}
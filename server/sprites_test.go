@@ -0,0 +1,209 @@
+/*
+	Copyright (C) 2021-2023  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+// mustNewSpritePolicy creates a sprite policy, failing the test if it is invalid
+func mustNewSpritePolicy(t *testing.T, names []string, substrings []string, regexes []string) *SpritePolicy {
+	t.Helper()
+
+	policy, err := newSpritePolicy(names, substrings, regexes)
+	if err != nil {
+		t.Fatalf("newSpritePolicy() error = %v", err)
+	}
+
+	return policy
+}
+
+func TestSpritePolicyIsAllowed(t *testing.T) {
+	policy := mustNewSpritePolicy(t,
+		[]string{"#null", "kura CharSet01"},
+		[]string{"syujinkou", "zenmaigaharaten_kisekae"},
+		[]string{"^urotsuki_.+$"},
+	)
+	policy.addRoomRestriction("zenmaigaharaten_kisekae", []int{176})
+
+	tests := []struct {
+		name   string
+		sprite string
+		roomId int
+		want   bool
+	}{
+		{"empty sprite", "", 1, true},
+		{"allowed name", "#null", 1, true},
+		{"allowed name with space", "kura CharSet01", 1, true},
+		{"name is matched exactly", "kura CharSet012", 1, false},
+		{"allowed substring", "syujinkou_02", 1, true},
+		{"allowed substring in middle", "new_syujinkou_b", 1, true},
+		{"allowed regex", "urotsuki_Swimsuit01", 1, true},
+		{"regex is anchored", "kong_urotsuki_sniper", 1, false},
+		{"regex requires suffix", "urotsuki_", 1, false},
+		{"unlisted sprite", "kodomo_04-1", 1, false},
+		{"restricted sprite in allowed room", "zenmaigaharaten_kisekae01", 176, true},
+		{"restricted sprite in other room", "zenmaigaharaten_kisekae01", 175, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.IsAllowed(tt.sprite, tt.roomId); got != tt.want {
+				t.Errorf("IsAllowed(%q, %d) = %v, want %v", tt.sprite, tt.roomId, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSpritePolicyWithoutAllowRules(t *testing.T) {
+	policy := mustNewSpritePolicy(t, nil, nil, nil)
+	policy.addRoomRestriction("kisekae", []int{10, 20})
+
+	tests := []struct {
+		name   string
+		sprite string
+		roomId int
+		want   bool
+	}{
+		{"any sprite", "kodomo_04-1", 1, true},
+		{"restricted sprite in first room", "kisekae01", 10, true},
+		{"restricted sprite in second room", "kisekae01", 20, true},
+		{"restricted sprite in other room", "kisekae01", 30, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.IsAllowed(tt.sprite, tt.roomId); got != tt.want {
+				t.Errorf("IsAllowed(%q, %d) = %v, want %v", tt.sprite, tt.roomId, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateSpritePolicy(t *testing.T) {
+	tests := []struct {
+		name         string
+		names        []string
+		substrings   []string
+		regexes      []string
+		restrictions []string
+		sprites      []string
+		wantProblems int
+	}{
+		{
+			name:         "no rules",
+			sprites:      []string{"a", "b"},
+			wantProblems: 0,
+		},
+		{
+			name:         "every rule matches",
+			names:        []string{"#null"},
+			substrings:   []string{"syujinkou"},
+			regexes:      []string{"^urotsuki_.+$"},
+			sprites:      []string{"#null", "syujinkou_01", "urotsuki_taoru"},
+			wantProblems: 0,
+		},
+		{
+			name:         "rules shadowed by an earlier rule",
+			names:        []string{"urotsuki_taoru"},
+			substrings:   []string{"urotsuki"},
+			regexes:      []string{"^urotsuki_.+$"},
+			sprites:      []string{"urotsuki_taoru"},
+			wantProblems: 0,
+		},
+		{
+			name:         "unused name",
+			names:        []string{"#null", "missing"},
+			sprites:      []string{"#null"},
+			wantProblems: 1,
+		},
+		{
+			name:         "unused substring and regex",
+			substrings:   []string{"effect", "missing"},
+			regexes:      []string{"^nothing$"},
+			sprites:      []string{"effect_01"},
+			wantProblems: 2,
+		},
+		{
+			name:         "unused room restriction",
+			restrictions: []string{"kisekae"},
+			sprites:      []string{"a"},
+			wantProblems: 1,
+		},
+		{
+			name:         "used room restriction",
+			substrings:   []string{"kisekae"},
+			restrictions: []string{"kisekae"},
+			sprites:      []string{"kisekae01"},
+			wantProblems: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := mustNewSpritePolicy(t, tt.names, tt.substrings, tt.regexes)
+			for _, substring := range tt.restrictions {
+				policy.addRoomRestriction(substring, []int{1})
+			}
+
+			spriteNames := make(map[string]bool)
+			for _, sprite := range tt.sprites {
+				spriteNames[sprite] = true
+			}
+
+			if got := validateSpritePolicy(policy, spriteNames); got != tt.wantProblems {
+				t.Errorf("validateSpritePolicy() = %d problems, want %d", got, tt.wantProblems)
+			}
+		})
+	}
+}
+
+func TestNewSpritePolicyInvalidRegex(t *testing.T) {
+	if _, err := newSpritePolicy(nil, nil, []string{"^urotsuki_(.+$"}); err == nil {
+		t.Error("newSpritePolicy() with an invalid regex returned no error")
+	}
+}
+
+func TestParseSpriteRoomIds(t *testing.T) {
+	tests := []struct {
+		name    string
+		roomIds string
+		want    []int
+		wantErr bool
+	}{
+		{"single", "176", []int{176}, false},
+		{"multiple", "176,177", []int{176, 177}, false},
+		{"spaces", "176, 177 ", []int{176, 177}, false},
+		{"not a number", "176,abc", nil, true},
+		{"empty id", "176,,177", nil, true},
+		{"empty", "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSpriteRoomIds(tt.roomIds)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSpriteRoomIds(%q) error = %v, want error %v", tt.roomIds, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSpriteRoomIds(%q) = %v, want %v", tt.roomIds, got, tt.want)
+			}
+		})
+	}
+}
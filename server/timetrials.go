@@ -0,0 +1,429 @@
+/*
+	Copyright (C) 2021-2023  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	timeTrialRecordLimit    = 10
+	timeTrialMaxRecordLimit = 100
+	timeTrialHistoryLimit   = 50
+)
+
+// legacyTimeTrialRouteId is the host game route that records from before
+// routes existed are moved to
+const legacyTimeTrialRouteId = "default"
+
+var timeTrials map[string]map[string]*TimeTrial
+
+type TimeTrial struct {
+	Id            string `json:"id"`
+	MapId         int    `json:"mapId"` // 0 for any map with a time trial condition
+	StartSwitchId int    `json:"startSwitchId"`
+	StopSwitchId  int    `json:"stopSwitchId"` // 0 to stop inside a time trial condition
+	TimerVarId    int    `json:"timerVarId"`
+	MaxSeconds    int    `json:"maxSeconds"`
+	SplitMapIds   []int  `json:"splitMapIds"`
+}
+
+type TimeTrialSplit struct {
+	MapId   int `json:"mapId"`
+	Seconds int `json:"seconds"`
+}
+
+type TimeTrialRun struct {
+	Uuid         string            `json:"uuid"`
+	Name         string            `json:"name"`
+	Game         string            `json:"game"`
+	RouteId      string            `json:"routeId"`
+	MapId        int               `json:"mapId"`
+	Seconds      int               `json:"seconds"`
+	Splits       []*TimeTrialSplit `json:"splits"`
+	PersonalBest bool              `json:"personalBest"`
+	Timestamp    time.Time         `json:"timestamp"`
+}
+
+func setTimeTrials() {
+	timeTrialConfig := make(map[string]map[string]*TimeTrial)
+
+	gameTimeTrialDirs, err := os.ReadDir("timetrials/")
+	if err != nil {
+		return
+	}
+
+	for _, gameTimeTrialsDir := range gameTimeTrialDirs {
+		if gameTimeTrialsDir.IsDir() {
+			gameId := gameTimeTrialsDir.Name()
+			timeTrialConfig[gameId] = make(map[string]*TimeTrial)
+			configPath := "timetrials/" + gameId + "/"
+			timeTrialConfigs, err := os.ReadDir(configPath)
+			if err != nil {
+				continue
+			}
+
+			for _, timeTrialConfigFile := range timeTrialConfigs {
+				timeTrial := &TimeTrial{}
+
+				data, err := os.ReadFile(configPath + timeTrialConfigFile.Name())
+				if err != nil {
+					continue
+				}
+
+				err = json.Unmarshal(data, &timeTrial)
+				if err == nil {
+					timeTrialId := timeTrialConfigFile.Name()[:len(timeTrialConfigFile.Name())-5]
+					timeTrial.Id = timeTrialId
+					timeTrialConfig[gameId][timeTrialId] = timeTrial
+				}
+			}
+		}
+	}
+
+	timeTrials = timeTrialConfig
+}
+
+func (t *TimeTrial) isValidTime(seconds int) bool {
+	return seconds > 0 && (t.MaxSeconds <= 0 || seconds < t.MaxSeconds)
+}
+
+func (t *TimeTrial) isSplitMap(mapId int) bool {
+	for _, splitMapId := range t.SplitMapIds {
+		if splitMapId == mapId {
+			return true
+		}
+	}
+
+	return false
+}
+
+func getGameTimeTrials() (gameTimeTrials []*TimeTrial) {
+	for _, timeTrial := range timeTrials[config.gameName] {
+		gameTimeTrials = append(gameTimeTrials, timeTrial)
+	}
+
+	sort.Slice(gameTimeTrials, func(a, b int) bool {
+		return gameTimeTrials[a].Id < gameTimeTrials[b].Id
+	})
+
+	return gameTimeTrials
+}
+
+// startTimeTrial requests the start switch of each time trial that can end
+// in the current room, returning false if there are none
+func (c *RoomClient) startTimeTrial() bool {
+	var started bool
+
+	for _, timeTrial := range getGameTimeTrials() {
+		if timeTrial.MapId != 0 && timeTrial.MapId != c.room.id {
+			continue
+		}
+
+		c.send <- buildMsg("ss", timeTrial.StartSwitchId, 0)
+		started = true
+	}
+
+	return started
+}
+
+// checkTimeTrialSplits requests the start switch of time trials with a split
+// in the current room so that the elapsed time can be recorded
+func (c *RoomClient) checkTimeTrialSplits() {
+	for _, timeTrial := range getGameTimeTrials() {
+		if timeTrial.isSplitMap(c.room.id) {
+			c.send <- buildMsg("ss", timeTrial.StartSwitchId, 0)
+		}
+	}
+}
+
+func (c *RoomClient) isAtTimeTrialFinish(timeTrial *TimeTrial) bool {
+	if timeTrial.MapId != 0 && timeTrial.MapId != c.room.id {
+		return false
+	}
+
+	if timeTrial.StopSwitchId > 0 {
+		return c.switchCache[timeTrial.StopSwitchId]
+	}
+
+	for _, condition := range append(globalConditions, c.room.conditions...) {
+		if condition.TimeTrial && c.checkConditionCoords(condition) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// syncTimeTrialSwitch requests the timer when a time trial is running or its
+// stop switch is set, returning true if the switch is a start switch
+func (c *RoomClient) syncTimeTrialSwitch(switchId int, value bool) (handled bool) {
+	for _, timeTrial := range getGameTimeTrials() {
+		if timeTrial.StartSwitchId == switchId {
+			if value {
+				c.send <- buildMsg("sv", timeTrial.TimerVarId, 0) // time elapsed
+			}
+			handled = true
+		} else if timeTrial.StopSwitchId == switchId && value {
+			c.send <- buildMsg("sv", timeTrial.TimerVarId, 0)
+		}
+	}
+
+	return handled
+}
+
+// syncTimeTrialVar records the elapsed time as the final time if the client
+// is at the finish of a time trial or as a split otherwise
+func (c *RoomClient) syncTimeTrialVar(varId int, value int) (handled bool, err error) {
+	for _, timeTrial := range getGameTimeTrials() {
+		if timeTrial.TimerVarId != varId {
+			continue
+		}
+
+		handled = true
+
+		if !timeTrial.isValidTime(value) {
+			continue
+		}
+
+		splits := c.timeTrialSplits[timeTrial.Id]
+
+		// a lower time than the last split means a new run has started
+		if len(splits) != 0 && value < splits[len(splits)-1].Seconds {
+			splits = nil
+		}
+
+		if c.isAtTimeTrialFinish(timeTrial) {
+			delete(c.timeTrialSplits, timeTrial.Id)
+
+			personalBest, err := tryWritePlayerTimeTrialRun(c.sClient.uuid, timeTrial, c.room.id, value, splits)
+			if err != nil {
+				return true, err
+			}
+			if personalBest {
+				c.send <- buildMsg("b")
+			}
+		} else if timeTrial.isSplitMap(c.room.id) {
+			if len(splits) == 0 || splits[len(splits)-1].MapId != c.room.id {
+				splits = append(splits, &TimeTrialSplit{MapId: c.room.id, Seconds: value})
+			}
+			c.timeTrialSplits[timeTrial.Id] = splits
+		}
+	}
+
+	return handled, nil
+}
+
+// migrateLegacyTimeTrials copies host game records from before routes existed
+// into the run history under the legacy route, so that they count towards
+// records and history like any other run. Records that were already copied
+// are skipped, so it can be run again to pick up records written by servers
+// that were still running an older version; the legacy table is left as is
+func migrateLegacyTimeTrials() (migrated int64, err error) {
+	if _, ok := timeTrials[hostGameId][legacyTimeTrialRouteId]; !ok {
+		return 0, errors.New("legacy time trial route not found")
+	}
+
+	result, err := db.Exec("INSERT INTO playerTimeTrialRuns (uuid, game, routeId, mapId, seconds, splits, personalBest, timestampCompleted) SELECT t.uuid, ?, ?, t.mapId, t.seconds, '[]', 1, t.timestampCompleted FROM playerTimeTrials t WHERE NOT EXISTS (SELECT * FROM playerTimeTrialRuns r WHERE r.uuid = t.uuid AND r.game = ? AND r.routeId = ? AND r.mapId = t.mapId AND r.seconds = t.seconds AND r.timestampCompleted = t.timestampCompleted)", hostGameId, legacyTimeTrialRouteId, hostGameId, legacyTimeTrialRouteId)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// tryWritePlayerTimeTrialRun records a completed run and returns whether it is
+// a new personal best for the map
+func tryWritePlayerTimeTrialRun(playerUuid string, timeTrial *TimeTrial, mapId int, seconds int, splits []*TimeTrialSplit) (personalBest bool, err error) {
+	var prevSeconds int
+	err = db.QueryRow("SELECT COALESCE(MIN(seconds), 0) FROM playerTimeTrialRuns WHERE uuid = ? AND game = ? AND mapId = ?", playerUuid, config.gameName, mapId).Scan(&prevSeconds)
+	if err != nil {
+		return false, err
+	}
+
+	personalBest = prevSeconds == 0 || seconds < prevSeconds
+
+	if splits == nil {
+		splits = []*TimeTrialSplit{}
+	}
+
+	splitsJson, err := json.Marshal(splits)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = db.Exec("INSERT INTO playerTimeTrialRuns (uuid, game, routeId, mapId, seconds, splits, personalBest, timestampCompleted) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", playerUuid, config.gameName, timeTrial.Id, mapId, seconds, string(splitsJson), personalBest, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	return personalBest, nil
+}
+
+func scanTimeTrialRuns(query string, args ...any) (runs []*TimeTrialRun, err error) {
+	results, err := db.Query(query, args...)
+	if err != nil {
+		return runs, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		run := &TimeTrialRun{}
+		var splitsJson string
+
+		err := results.Scan(&run.Uuid, &run.Name, &run.Game, &run.RouteId, &run.MapId, &run.Seconds, &splitsJson, &run.PersonalBest, &run.Timestamp)
+		if err != nil {
+			return runs, err
+		}
+
+		err = json.Unmarshal([]byte(splitsJson), &run.Splits)
+		if err != nil {
+			return runs, err
+		}
+
+		runs = append(runs, run)
+	}
+
+	return runs, nil
+}
+
+// getTimeTrialRecords returns the best run of each player for a route
+func getTimeTrialRecords(gameId string, routeId string, mapId int, limit int) (runs []*TimeTrialRun, err error) {
+	mapClause := ""
+	args := []any{gameId, routeId}
+	if mapId > 0 {
+		mapClause = " AND r.mapId = ?"
+		args = append(args, mapId)
+	}
+	args = append(args, limit)
+
+	return scanTimeTrialRuns("SELECT r.uuid, a.user, r.game, r.routeId, r.mapId, r.seconds, r.splits, r.personalBest, r.timestampCompleted FROM playerTimeTrialRuns r JOIN accounts a ON a.uuid = r.uuid JOIN players pd ON pd.uuid = r.uuid WHERE pd.banned = 0 AND r.game = ? AND r.routeId = ?"+mapClause+" AND NOT EXISTS (SELECT * FROM playerTimeTrialRuns br WHERE br.uuid = r.uuid AND br.game = r.game AND br.routeId = r.routeId AND br.mapId = r.mapId AND (br.seconds < r.seconds OR (br.seconds = r.seconds AND br.timestampCompleted < r.timestampCompleted))) ORDER BY r.seconds, r.timestampCompleted LIMIT ?", args...)
+}
+
+// getPlayerTimeTrialRuns returns the personal best history of a player for a route
+func getPlayerTimeTrialRuns(playerUuid string, gameId string, routeId string) (runs []*TimeTrialRun, err error) {
+	return scanTimeTrialRuns("SELECT r.uuid, COALESCE(a.user, ''), r.game, r.routeId, r.mapId, r.seconds, r.splits, r.personalBest, r.timestampCompleted FROM playerTimeTrialRuns r LEFT JOIN accounts a ON a.uuid = r.uuid WHERE r.uuid = ? AND r.game = ? AND r.routeId = ? AND r.personalBest = 1 ORDER BY r.timestampCompleted DESC LIMIT ?", playerUuid, gameId, routeId, timeTrialHistoryLimit)
+}
+
+func handleTimeTrial(w http.ResponseWriter, r *http.Request) {
+	commandParam := r.URL.Query().Get("command")
+	if commandParam == "" {
+		handleError(w, r, "command not specified")
+		return
+	}
+
+	gameId := r.URL.Query().Get("game")
+	if gameId == "" {
+		gameId = config.gameName
+	}
+
+	if commandParam == "routes" {
+		var routes []*TimeTrial
+		for _, timeTrial := range timeTrials[gameId] {
+			routes = append(routes, timeTrial)
+		}
+		sort.Slice(routes, func(a, b int) bool {
+			return routes[a].Id < routes[b].Id
+		})
+
+		routesJson, err := json.Marshal(routes)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		w.Write(routesJson)
+		return
+	}
+
+	routeParam := r.URL.Query().Get("route")
+	if _, ok := timeTrials[gameId][routeParam]; !ok {
+		handleError(w, r, "invalid route")
+		return
+	}
+
+	var runs []*TimeTrialRun
+	var err error
+
+	switch commandParam {
+	case "records":
+		var mapId int
+		if mapParam := r.URL.Query().Get("map"); mapParam != "" {
+			mapId, err = strconv.Atoi(mapParam)
+			if err != nil {
+				handleError(w, r, "invalid map value")
+				return
+			}
+		}
+
+		limit := timeTrialRecordLimit
+		if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+			limit, err = strconv.Atoi(limitParam)
+			if err != nil || limit <= 0 {
+				handleError(w, r, "invalid limit value")
+				return
+			}
+			if limit > timeTrialMaxRecordLimit {
+				limit = timeTrialMaxRecordLimit
+			}
+		}
+
+		runs, err = getTimeTrialRecords(gameId, routeParam, mapId, limit)
+	case "history":
+		uuid := r.URL.Query().Get("uuid")
+		if uuid == "" {
+			token := r.Header.Get("Authorization")
+			if token == "" {
+				handleError(w, r, "uuid or token not specified")
+				return
+			}
+			uuid = getUuidFromToken(token)
+			if uuid == "" {
+				handleError(w, r, "invalid token")
+				return
+			}
+		}
+
+		runs, err = getPlayerTimeTrialRuns(uuid, gameId, routeParam)
+	default:
+		handleError(w, r, "unknown command")
+		return
+	}
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	if runs == nil {
+		runs = []*TimeTrialRun{}
+	}
+
+	runsJson, err := json.Marshal(runs)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	w.Write(runsJson)
+}